@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With -access-log, every request gets a line in an access log, kept apart
+// from the application log so it can go straight into a log pipeline. It's
+// the Apache combined format with the time taken (in microseconds) added on
+// the end, or JSON. The file is opened again on reload, so it can be
+// rotated by moving it and sending SIGHUP.
+
+var accessLogFlag = flag.String("access-log", "", "file to write the access log to, or - for stdout (off if empty)")
+var accessLogFormatFlag = flag.String("access-log-format", "combined", "access log format: combined or json")
+
+type accessLogStruct struct {
+	out   io.Writer // nil when off
+	file  *os.File  // to close when reopening; nil for stdout
+	json  bool
+	mutex sync.Mutex
+}
+
+var accessLog = &accessLogStruct{}
+
+func init() {
+	registerReload(openAccessLog, "access-log", "access-log-format")
+}
+
+// Opens -access-log, closing whatever was open before.
+func openAccessLog() error {
+	var asJSON bool
+	switch *accessLogFormatFlag {
+	case "combined":
+	case "json":
+		asJSON = true
+	default:
+		return fmt.Errorf("invalid -access-log-format %q: expected combined or json", *accessLogFormatFlag)
+	}
+
+	var out io.Writer
+	var file *os.File
+	switch *accessLogFlag {
+	case "":
+	case "-":
+		out = os.Stdout
+	default:
+		var err error
+		file, err = os.OpenFile(*accessLogFlag, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		out = file
+	}
+
+	accessLog.mutex.Lock()
+	defer accessLog.mutex.Unlock()
+
+	if accessLog.file != nil {
+		accessLog.file.Close()
+	}
+	accessLog.out = out
+	accessLog.file = file
+	accessLog.json = asJSON
+
+	return nil
+}
+
+// One access log line, as JSON
+type accessLogEntry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	ClientIP  string    `json:"client_ip"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Query     string    `json:"query,omitempty"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Duration  float64   `json:"duration_seconds"`
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+}
+
+func (l *accessLogStruct) write(entry accessLogEntry) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.out == nil {
+		return
+	}
+
+	if l.json {
+		line, _ := json.Marshal(entry)
+		l.out.Write(append(line, '\n'))
+		return
+	}
+
+	target := entry.Path
+	if entry.Query != "" {
+		target += "?" + entry.Query
+	}
+
+	fmt.Fprintf(l.out, "%s - - [%s] \"%s %s %s\" %d %d \"%s\" \"%s\" %d\n",
+		entry.ClientIP, entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		entry.Method, escapeAccessLog(target), entry.Proto, entry.Status, entry.Bytes,
+		escapeAccessLog(orDash(entry.Referer)), escapeAccessLog(orDash(entry.UserAgent)),
+		int64(entry.Duration*1e6))
+}
+
+// so a quote or newline from the client can't forge a line
+var accessLogEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`, "\n", `\n`, "\r", `\r`)
+
+func escapeAccessLog(s string) string {
+	return accessLogEscaper.Replace(s)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func withAccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+
+		accessLog.write(accessLogEntry{
+			Time:      start,
+			RequestID: requestID(r.Context()),
+			ClientIP:  clientIP(r),
+			Method:    r.Method,
+			Path:      r.URL.EscapedPath(),
+			Query:     r.URL.RawQuery,
+			Proto:     r.Proto,
+			Status:    sw.statusCode(),
+			Bytes:     sw.bytes,
+			Duration:  time.Since(start).Seconds(),
+			Referer:   r.Referer(),
+			UserAgent: r.UserAgent(),
+		})
+	})
+}
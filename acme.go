@@ -0,0 +1,71 @@
+//go:build acme
+
+package main
+
+// Certificates from Let's Encrypt (or another ACME CA) need
+// golang.org/x/crypto/acme/autocert, so this is only compiled in with:
+// go build -tags acme
+//
+// With -acme-domain, certificates for those names are obtained on the first
+// TLS connection for each and renewed before they expire. The CA checks we
+// control a name by connecting to us on port 443 (TLS-ALPN-01), so a
+// listener has to be reachable there; -acme-http-addr also answers its
+// checks over plain HTTP on port 80, and redirects everything else there to
+// HTTPS.
+
+import (
+	"crypto/tls"
+	"flag"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var acmeDomainFlag = flag.String("acme-domain", "", "comma-separated host names to get certificates for from -acme-directory (disabled if empty)")
+var acmeCacheDirFlag = flag.String("acme-cache-dir", "acme-cache", "directory to keep ACME account keys and certificates in, so they survive restarts")
+var acmeEmailFlag = flag.String("acme-email", "", "contact address for the ACME account, for expiry warnings")
+var acmeDirectoryFlag = flag.String("acme-directory", autocert.DefaultACMEDirectory, "ACME CA directory URL (Let's Encrypt by default; use their staging URL to test)")
+var acmeHTTPAddrFlag = flag.String("acme-http-addr", "", "address for a plain HTTP listener answering ACME HTTP-01 checks and redirecting to HTTPS, e.g. :80 (disabled if empty)")
+
+func init() {
+	acmeTLSConfig = newACMETLSConfig
+}
+
+func newACMETLSConfig() (*tls.Config, error) {
+	if *acmeDomainFlag == "" {
+		return nil, nil
+	}
+
+	var domains []string
+	for _, domain := range strings.Split(*acmeDomainFlag, ",") {
+		domain = strings.TrimSpace(domain)
+		if domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(*acmeCacheDirFlag),
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Email:      *acmeEmailFlag,
+		Client:     &acme.Client{DirectoryURL: *acmeDirectoryFlag},
+	}
+
+	if *acmeHTTPAddrFlag != "" {
+		go func() {
+			slog.Info("Running ACME HTTP-01 listener", "addr", *acmeHTTPAddrFlag)
+
+			err := http.ListenAndServe(*acmeHTTPAddrFlag, manager.HTTPHandler(nil))
+			slog.Error("ACME HTTP-01 listener stopped", "err", err)
+		}()
+	}
+
+	return &tls.Config{
+		GetCertificate: manager.GetCertificate,
+		NextProtos:     []string{acme.ALPNProto},
+	}, nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"crypto/subtle"
+	"flag"
+	"net/http"
+	"strings"
+)
+
+// Admin endpoints (like purging the cache) need the token from -admin-token
+// as a bearer token. Without one, they're turned off.
+
+var adminTokenFlag = flag.String("admin-token", "", "bearer token required by admin endpoints (disabled if empty)")
+
+// whether the request has the admin token
+func isAdmin(r *http.Request) bool {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return found && *adminTokenFlag != "" && subtle.ConstantTimeCompare([]byte(token), []byte(*adminTokenFlag)) == 1
+}
+
+func withAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if *adminTokenFlag == "" {
+			http.Error(w, "Admin endpoints are disabled", http.StatusForbidden)
+			return
+		}
+
+		if !isAdmin(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="http-math admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		handler(w, r)
+	}
+}
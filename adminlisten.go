@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
+	"net/http"
+)
+
+// With -admin-listen, the admin endpoints (cache purge and export, reload,
+// operation and maintenance switches, client statistics, log streaming,
+// network lists and bans) move to a listener of their own, along with the
+// profiles from /debug/pprof/, and aren't served on the public one at all.
+// Everything on it needs -admin-token, as a bearer token or as the basic
+// auth password. Bind it to localhost, a unix socket or a management
+// network, so the admin surface is never where the public API is.
+
+var adminListenFlag = flag.String("admin-listen", "", "separate address for the admin endpoints and /debug/pprof/: host:port, unix:/path/to.sock or systemd:NAME (on the public listener, without pprof, if empty)")
+
+// the admin listener's routes, when there is one
+var adminMux = http.NewServeMux()
+
+// Serves an admin endpoint: on the admin listener if there is one (the
+// public one says it's not found, rather than take it for a question), or
+// else on the public one, behind -admin-token.
+func handleAdmin(pattern string, handler http.HandlerFunc) {
+	if *adminListenFlag != "" {
+		adminMux.HandleFunc(pattern, handler)
+		publicMux.HandleFunc(pattern, http.NotFound)
+		return
+	}
+
+	publicMux.HandleFunc(pattern, withAdmin(handler))
+}
+
+func startAdminListener() error {
+	if *adminListenFlag == "" {
+		return nil
+	}
+	if *adminTokenFlag == "" {
+		return errors.New("-admin-listen needs an -admin-token")
+	}
+
+	handlePprof(adminMux)
+
+	l, err := listen(*adminListenFlag)
+	if err != nil {
+		return err
+	}
+
+	// no write timeout: log streams stay open, and a CPU profile takes as
+	// long as it was asked to
+	server := &http.Server{
+		Handler:           withRequestID(withSecurityHeaders(withAccessLog(withTokenAuth(withBodyLimit(adminMux), *adminTokenFlag, "http-math admin")))),
+		ReadHeaderTimeout: *readHeaderTimeoutFlag,
+		ReadTimeout:       *readTimeoutFlag,
+		IdleTimeout:       *idleTimeoutFlag,
+	}
+	onShutdown(func(ctx context.Context) {
+		server.Shutdown(ctx)
+	})
+
+	go func() {
+		slog.Info("Running admin server", "addr", *adminListenFlag)
+
+		err := server.Serve(l)
+		if !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Admin server stopped", "err", err)
+		}
+	}()
+
+	return nil
+}
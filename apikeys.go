@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// With -api-keys (which, like any flag, can come from the config file or
+// HTTPMATH_API_KEYS), computations need an X-API-Key header with one of the
+// keys. Each key has a name, which is what logs, usage statistics, history
+// and the audit log know the client by; the key itself isn't written
+// anywhere. Without -api-keys, anyone can ask, and X-API-Key is ignored.
+
+var apiKeysFlag = flag.String("api-keys", "", "comma-separated NAME:KEY pairs; if set, computations need an X-API-Key header with one of the keys")
+
+const apiKeyHeader = "X-API-Key"
+
+// key names by the key's SHA-256, so looking one up doesn't take longer the
+// more of it is right; nil when there are no keys
+var apiKeys atomic.Pointer[map[[sha256.Size]byte]string]
+
+type apiKeyKey struct{}
+
+func init() {
+	registerReload(loadAPIKeys, "api-keys")
+}
+
+func loadAPIKeys() error {
+	if *apiKeysFlag == "" {
+		apiKeys.Store(nil)
+		return nil
+	}
+
+	keys := map[[sha256.Size]byte]string{}
+	for i, pair := range strings.Split(*apiKeysFlag, ",") {
+		// the entries are secret, so errors only say which
+		name, key, found := strings.Cut(strings.TrimSpace(pair), ":")
+		if !found || name == "" || key == "" {
+			return fmt.Errorf("invalid -api-keys entry %d: expected NAME:KEY", i+1)
+		}
+
+		hash := sha256.Sum256([]byte(key))
+		if _, exists := keys[hash]; exists {
+			return fmt.Errorf("invalid -api-keys: key for %s is used twice", name)
+		}
+		keys[hash] = name
+	}
+
+	apiKeys.Store(&keys)
+	return nil
+}
+
+// The name of the API key the request came with, if it's one of ours
+func apiKeyName(ctx context.Context) (string, bool) {
+	name, ok := ctx.Value(apiKeyKey{}).(string)
+	return name, ok
+}
+
+// withAPIKey checks the request's X-API-Key, and if it's one of ours, puts
+// its name in the context for what comes after. It doesn't turn anyone
+// away; requireAuth does that.
+func withAPIKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys := apiKeys.Load()
+		key := r.Header.Get(apiKeyHeader)
+		if keys == nil || key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		name, exists := (*keys)[sha256.Sum256([]byte(key))]
+		if !exists {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyKey{}, name)))
+	})
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// The web UI (/ui/) and API explorer (/ui/explorer.html, from
+// /ui/openapi.json) are built into the binary, so there's still just the one
+// file to deploy.
+
+//go:embed assets
+var assetFiles embed.FS
+
+// One file under assets/, ready to serve
+type asset struct {
+	content     []byte
+	contentType string
+	etag        string
+}
+
+var assets = map[string]asset{}
+
+func init() {
+	err := fs.WalkDir(assetFiles, "assets", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		content, err := assetFiles.ReadFile(name)
+		if err != nil {
+			return err
+		}
+
+		contentType := mime.TypeByExtension(path.Ext(name))
+		if contentType == "" {
+			contentType = http.DetectContentType(content)
+		}
+
+		sum := sha256.Sum256(content)
+		assets[strings.TrimPrefix(name, "assets/")] = asset{
+			content:     content,
+			contentType: contentType,
+			etag:        `"` + hex.EncodeToString(sum[:16]) + `"`,
+		}
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Pages (and the API description) are checked for changes every time, since
+// they name the other files without a version; those are cached for a while.
+func assetCacheControl(name string) string {
+	switch path.Ext(name) {
+	case ".html", ".json":
+		return "no-cache"
+	}
+
+	return "public, max-age=3600"
+}
+
+func doAssets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/ui/")
+	if name == "" {
+		name = "index.html"
+	}
+
+	a, exists := assets[name]
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", a.contentType)
+	w.Header().Set("ETag", a.etag)
+	w.Header().Set("Cache-Control", assetCacheControl(name))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	// handles If-None-Match and ranges
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(a.content))
+}
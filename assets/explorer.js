@@ -0,0 +1,90 @@
+"use strict";
+
+// A small stand-in for Swagger UI: lists every operation in openapi.json and
+// lets you try it.
+
+const base = new URL("..", location.href);
+
+function element(tag, props, ...children) {
+  const el = Object.assign(document.createElement(tag), props);
+  el.append(...children);
+  return el;
+}
+
+function renderOperation(path, method, operation) {
+  const params = operation.parameters || [];
+  const inputs = {};
+
+  const form = element("form");
+  for (const param of params) {
+    inputs[param.name] = element("input", { name: param.name, placeholder: param.schema?.type || "" });
+    form.append(element("label", {}, `${param.name} (${param.in}) `, inputs[param.name]), element("br"));
+  }
+
+  let body;
+  const content = operation.requestBody?.content;
+  if (content) {
+    const [type, media] = Object.entries(content)[0];
+    body = element("textarea", { rows: 6, cols: 60, value: media.example ? JSON.stringify(media.example, null, 2) : "" });
+    body.dataset.type = type;
+    form.append(element("label", {}, `Body (${type})`), element("br"), body, element("br"));
+  }
+
+  const result = element("pre");
+  form.append(element("button", {}, "Send"), result);
+
+  form.addEventListener("submit", async (event) => {
+    event.preventDefault();
+
+    let url = path;
+    const query = new URLSearchParams();
+    for (const param of params) {
+      const value = inputs[param.name].value;
+      if (param.in === "path") {
+        url = url.replace(`{${param.name}}`, encodeURIComponent(value));
+      } else if (value !== "") {
+        query.set(param.name, value);
+      }
+    }
+    if ([...query].length > 0) {
+      url += `?${query}`;
+    }
+
+    const headers = { Accept: "application/json" };
+    const token = document.querySelector("#token").value;
+    if (token) {
+      headers.Authorization = `Bearer ${token}`;
+    }
+    const apiKey = document.querySelector("#api-key").value;
+    if (apiKey) {
+      headers["X-API-Key"] = apiKey;
+    }
+    if (body) {
+      headers["Content-Type"] = body.dataset.type;
+    }
+
+    try {
+      const resp = await fetch(new URL(url.slice(1), base), { method: method.toUpperCase(), headers, body: body?.value });
+      result.textContent = `${resp.status} ${resp.statusText}\n\n${await resp.text()}`;
+    } catch (err) {
+      result.textContent = err.message;
+    }
+  });
+
+  return element("details", {},
+    element("summary", {}, element("code", {}, `${method.toUpperCase()} ${path}`), ` ${operation.summary || ""}`),
+    element("p", {}, operation.description || ""),
+    form);
+}
+
+fetch("openapi.json")
+  .then((resp) => resp.json())
+  .then((spec) => {
+    const list = document.querySelector("#operations");
+    for (const [path, methods] of Object.entries(spec.paths)) {
+      for (const [method, operation] of Object.entries(methods)) {
+        list.append(renderOperation(path, method, operation));
+      }
+    }
+  })
+  .catch((err) => { document.querySelector("#operations").textContent = err.message; });
@@ -0,0 +1,70 @@
+"use strict";
+
+// The UI talks to the same API as everything else; see explorer.html.
+
+const base = new URL("..", location.href);
+const symbols = { add: "+", subtract: "−", multiply: "×", divide: "÷" };
+
+// needed when the server has -api-keys
+function apiKeyHeaders() {
+  const key = document.querySelector("#api-key").value;
+  return key ? { "X-API-Key": key } : {};
+}
+
+async function getJSON(path, init = {}) {
+  init.headers = { ...apiKeyHeaders(), ...init.headers };
+  const resp = await fetch(new URL(path, base), init);
+  const data = await resp.json().catch(() => ({ error: resp.statusText }));
+  if (!resp.ok) {
+    throw new Error(data.error || resp.statusText);
+  }
+  return data;
+}
+
+async function loadOps() {
+  const select = document.querySelector("#calc select");
+  for (const op of await getJSON("ops")) {
+    const option = new Option(symbols[op.op] || op.op, op.op);
+    option.disabled = !op.enabled;
+    select.add(option);
+  }
+}
+
+async function loadHistory() {
+  const body = document.querySelector("#history tbody");
+  const data = await getJSON("history");
+  body.replaceChildren();
+  for (const entry of data.history || []) {
+    const row = body.insertRow();
+    row.insertCell().textContent = new Date(entry.time).toLocaleTimeString();
+    row.insertCell().textContent = `${entry.x} ${symbols[entry.action] || entry.action} ${entry.y}`;
+    row.insertCell().textContent = entry.answer;
+    row.insertCell().textContent = entry.cached ? "yes" : "";
+  }
+}
+
+document.querySelector("#api-key").addEventListener("change", () => loadHistory().catch(() => {}));
+
+document.querySelector("#calc").addEventListener("submit", async (event) => {
+  event.preventDefault();
+  const form = new FormData(event.target);
+  const output = document.querySelector("#answer");
+  const query = new URLSearchParams({ x: form.get("x"), y: form.get("y") });
+  if (document.querySelector("#nocache").checked) {
+    query.set("nocache", "1");
+  }
+
+  output.classList.remove("error");
+  try {
+    const data = await getJSON(`${form.get("op")}?${query}`, { headers: { Accept: "application/json" } });
+    output.textContent = data.answer;
+  } catch (err) {
+    output.textContent = err.message;
+    output.classList.add("error");
+  }
+  loadHistory().catch(() => {});
+});
+
+getJSON("version").then((v) => { document.querySelector("#version").textContent = v.version; }).catch(() => {});
+loadOps().catch((err) => { document.querySelector("#answer").textContent = err.message; });
+loadHistory().catch(() => {});
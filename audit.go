@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// With -audit-log, every computation gets a JSON line in an audit log: who
+// asked, the operation and operands, the answer (or error), whether it was
+// cached, and how long it took. The file is only ever appended to; once it
+// gets bigger than -audit-log-max-size or has been written to for longer
+// than -audit-log-max-age, it's renamed with the time on the end and a new
+// one is started. Rotated files are left for whoever archives them.
+
+var auditLogFlag = flag.String("audit-log", "", "file to append an audit log of every computation to (off if empty)")
+var auditLogMaxSizeFlag = flag.Int64("audit-log-max-size", 100<<20, "rotate the audit log when it gets bigger than this many bytes (never if 0)")
+var auditLogMaxAgeFlag = flag.Duration("audit-log-max-age", 24*time.Hour, "rotate the audit log when it has been written to for this long (never if 0)")
+
+// how rotated audit logs are named, after the log's own name
+const auditRotatedFormat = "20060102T150405.000000000Z"
+
+type auditLogStruct struct {
+	path    string
+	file    *os.File // nil when off
+	size    int64
+	opened  time.Time
+	maxSize int64
+	maxAge  time.Duration
+	mutex   sync.Mutex
+}
+
+var auditLog = &auditLogStruct{}
+
+func init() {
+	registerReload(openAuditLog, "audit-log", "audit-log-max-size", "audit-log-max-age")
+	onShutdown(func(ctx context.Context) {
+		auditLog.close()
+	})
+}
+
+// Opens -audit-log, closing whatever was open before.
+func openAuditLog() error {
+	if *auditLogMaxSizeFlag < 0 {
+		return fmt.Errorf("invalid -audit-log-max-size %d", *auditLogMaxSizeFlag)
+	}
+	if *auditLogMaxAgeFlag < 0 {
+		return fmt.Errorf("invalid -audit-log-max-age %v", *auditLogMaxAgeFlag)
+	}
+
+	auditLog.mutex.Lock()
+	defer auditLog.mutex.Unlock()
+
+	auditLog.maxSize = *auditLogMaxSizeFlag
+	auditLog.maxAge = *auditLogMaxAgeFlag
+
+	if *auditLogFlag == auditLog.path && auditLog.file != nil {
+		return nil
+	}
+
+	if *auditLogFlag == "" {
+		auditLog.closeFile()
+		auditLog.path = ""
+		return nil
+	}
+
+	file, size, err := openAuditFile(*auditLogFlag)
+	if err != nil {
+		return err
+	}
+
+	auditLog.closeFile()
+	auditLog.path = *auditLogFlag
+	auditLog.file = file
+	auditLog.size = size
+	auditLog.opened = time.Now()
+
+	return nil
+}
+
+func openAuditFile(path string) (*os.File, int64, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+
+	return file, info.Size(), nil
+}
+
+// must hold the mutex
+func (l *auditLogStruct) closeFile() {
+	if l.file == nil {
+		return
+	}
+
+	err := l.file.Close()
+	if err != nil {
+		slog.Error("Error closing audit log", "path", l.path, "err", err)
+	}
+	l.file = nil
+}
+
+func (l *auditLogStruct) close() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.closeFile()
+}
+
+// Moves the log aside and starts a new one; must hold the mutex.
+func (l *auditLogStruct) rotate(now time.Time) error {
+	rotated := l.path + "." + now.UTC().Format(auditRotatedFormat)
+	err := os.Rename(l.path, rotated)
+	if err != nil {
+		return err
+	}
+
+	file, size, err := openAuditFile(l.path)
+	if err != nil {
+		return err
+	}
+
+	l.closeFile()
+	l.file = file
+	l.size = size
+	l.opened = now
+
+	slog.Info("Rotated audit log", "path", l.path, "rotated", rotated)
+
+	return nil
+}
+
+// One audit log line
+type auditEntry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id,omitempty"`
+	Client    string    `json:"client"`
+	Op        string    `json:"op"`
+	X         any       `json:"x"`
+	Y         any       `json:"y"`
+	Answer    any       `json:"answer,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Cached    bool      `json:"cached"`
+	Duration  float64   `json:"duration_seconds"`
+}
+
+// JSON can't hold infinities or NaN, so those are written as strings.
+func auditNumber(f float64) any {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	return f
+}
+
+// Logs a computation, if there's an audit log.
+func (l *auditLogStruct) record(ctx context.Context, op string, x float64, y float64, answer float64, cached bool, d time.Duration, err error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.file == nil {
+		return
+	}
+
+	now := time.Now()
+	entry := auditEntry{
+		Time:      now,
+		RequestID: requestID(ctx),
+		Client:    requestClient(ctx),
+		Op:        op,
+		X:         auditNumber(x),
+		Y:         auditNumber(y),
+		Cached:    cached,
+		Duration:  d.Seconds(),
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	} else {
+		entry.Answer = auditNumber(answer)
+	}
+
+	line, _ := json.Marshal(entry)
+	line = append(line, '\n')
+
+	if (l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize) ||
+		(l.maxAge > 0 && now.Sub(l.opened) >= l.maxAge) {
+		rotateErr := l.rotate(now)
+		if rotateErr != nil {
+			// keep appending to the one we've got
+			slog.Error("Error rotating audit log", "path", l.path, "err", rotateErr)
+		}
+	}
+
+	n, writeErr := l.file.Write(line)
+	l.size += int64(n)
+	if writeErr != nil {
+		slog.Error("Error writing audit log", "path", l.path, "err", writeErr)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Computations are open to anyone, unless there's a way to say who you are:
+// -api-keys (apikeys.go), -jwt-issuer (jwt.go), -introspection-url
+// (introspect.go), -basic-auth-users (basicauth.go) or -hmac-keys
+// (signature.go). Then they need one of those. Middleware earlier in the
+// chain works out who's asking; this just turns away those it couldn't.
+
+// Turns away requests that didn't say who they are, when they have to.
+func requireAuth(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		keys, tokens, users, signed := apiKeys.Load() != nil, jwks != nil || introspection != nil, basicAuth.Load() != nil, hmacKeys.Load() != nil
+		if !keys && !tokens && !users && !signed {
+			handler(w, r)
+			return
+		}
+
+		if _, ok := apiKeyName(r.Context()); ok {
+			handler(w, r)
+			return
+		}
+		if isPeer(r) {
+			// asking for a client we've already let in
+			handler(w, r)
+			return
+		}
+		if _, ok := requestJWT(r.Context()); ok {
+			handler(w, r)
+			return
+		}
+		if _, ok := basicAuthUser(r.Context()); ok {
+			handler(w, r)
+			return
+		}
+		if _, ok := signatureKeyName(r.Context()); ok {
+			handler(w, r)
+			return
+		}
+
+		var challenges, ways []string
+		if keys {
+			challenges = append(challenges, `ApiKey realm="http-math", header="X-API-Key"`)
+			ways = append(ways, "an API key in the X-API-Key header")
+		}
+		tokenErr, _ := r.Context().Value(jwtErrorKey{}).(error)
+		var unreachable *introspectionUnreachableError
+		if errors.As(tokenErr, &unreachable) {
+			// we couldn't check it; that's on us, not them
+			w.Header().Set("Retry-After", ceilSeconds(introspectionRetry))
+			httpErrorCode(w, http.StatusServiceUnavailable, "auth_unavailable", "Can't check tokens right now; try again later")
+			return
+		}
+		if tokens {
+			if tokenErr != nil {
+				challenges = append(challenges, `Bearer realm="http-math", error="invalid_token"`)
+			} else {
+				challenges = append(challenges, `Bearer realm="http-math"`)
+			}
+			ways = append(ways, "a bearer token")
+		}
+		if users {
+			challenges = append(challenges, `Basic realm="http-math", charset="UTF-8"`)
+			ways = append(ways, "a user and password with Basic auth")
+		}
+		if signed {
+			challenges = append(challenges, `HMAC-SHA256 realm="http-math", headers="X-Signature-Key X-Signature-Timestamp X-Signature"`)
+			ways = append(ways, "a signature in the X-Signature headers")
+		}
+
+		message := "Missing credentials; send " + strings.Join(ways, " or ")
+
+		_, _, basic := r.BasicAuth()
+		signatureErr, _ := r.Context().Value(signatureErrorKey{}).(error)
+
+		switch {
+		case tokenErr != nil:
+			message = "Invalid token: " + tokenErr.Error()
+		case signatureErr != nil:
+			message = "Invalid signature: " + signatureErr.Error()
+		case users && basic:
+			message = "Invalid user or password"
+		case keys && r.Header.Get(apiKeyHeader) != "":
+			message = "Invalid API key"
+		}
+
+		for _, challenge := range challenges {
+			w.Header().Add("WWW-Authenticate", challenge)
+		}
+		httpErrorCode(w, http.StatusUnauthorized, "unauthorized", message)
+	}
+}
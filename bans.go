@@ -0,0 +1,285 @@
+package main
+
+import (
+	"cmp"
+	"container/list"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Clients that keep getting things wrong are banned for a while, rather
+// than waiting for someone to edit the firewall. A client that gets
+// -ban-errors error responses (other than 429s, and 503s, which are our
+// doing), or -ban-rate-limited 429s, within -ban-window is turned away with
+// a 403 (code "banned") for -ban-duration. Clients are known as the rate
+// limiter knows them: by credentials, or by address. Requests with the
+// admin token are never banned, so an admin can always get in to list bans
+// at /admin/bans or lift them:
+//
+//	curl -X DELETE 'http://localhost:8080/admin/bans?client=ip:203.0.113.7'
+//	curl -X DELETE http://localhost:8080/admin/bans (all of them)
+
+var banErrorsFlag = flag.Int("ban-errors", 0, "error responses within -ban-window that get a client banned (0 to never ban for them)")
+var banRateLimitedFlag = flag.Int("ban-rate-limited", 0, "429 responses within -ban-window that get a client banned (0 to never ban for them)")
+var banWindowFlag = flag.Duration("ban-window", time.Minute, "how long -ban-errors and -ban-rate-limited are counted over")
+var banDurationFlag = flag.Duration("ban-duration", 15*time.Minute, "how long a ban lasts")
+
+// how many clients are watched; the ones watched longest ago make way
+const banMaxClients = 10000
+
+// JSON data for one ban in GET /admin/bans
+type ban struct {
+	Client string    `json:"client"`
+	Reason string    `json:"reason"`
+	Since  time.Time `json:"since"`
+	Until  time.Time `json:"until"`
+}
+
+// a client's misbehavior in the current window
+type banWatch struct {
+	client  string
+	start   time.Time
+	errors  int
+	limited int
+	element *list.Element // its place in banStruct.order
+}
+
+type banStruct struct {
+	errors      int
+	rateLimited int
+	window      time.Duration
+	duration    time.Duration
+	watches     map[string]*banWatch
+	order       *list.List // of *banWatch, started most recently at the front
+	bans        map[string]*ban
+	mutex       sync.Mutex
+}
+
+var bans = &banStruct{watches: map[string]*banWatch{}, order: list.New(), bans: map[string]*ban{}}
+
+var bansTotal = newCounterVec("http_math_bans_total",
+	"Clients banned, by reason", "reason")
+var bannedRequests = newCounterVec("http_math_banned_requests_total",
+	"Requests turned away from banned clients")
+
+func init() {
+	registerReload(loadBans, "ban-errors", "ban-rate-limited", "ban-window", "ban-duration")
+	registerMetrics(func() []metricValue {
+		bans.mutex.Lock()
+		defer bans.mutex.Unlock()
+
+		return []metricValue{
+			{"http_math_bans", "Clients banned right now.", "gauge", float64(len(bans.bans))},
+		}
+	})
+}
+
+func loadBans() error {
+	if *banErrorsFlag < 0 || *banRateLimitedFlag < 0 {
+		return errors.New("-ban-errors and -ban-rate-limited can't be negative")
+	}
+	if *banWindowFlag <= 0 || *banDurationFlag <= 0 {
+		return errors.New("-ban-window and -ban-duration must be positive")
+	}
+
+	bans.mutex.Lock()
+	defer bans.mutex.Unlock()
+
+	bans.errors = *banErrorsFlag
+	bans.rateLimited = *banRateLimitedFlag
+	bans.window = *banWindowFlag
+	bans.duration = *banDurationFlag
+
+	return nil
+}
+
+// The ban on client, if there is one
+func (b *banStruct) banned(client string, now time.Time) (*ban, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	current, exists := b.bans[client]
+	if exists && !now.Before(current.Until) {
+		delete(b.bans, client)
+		return nil, false
+	}
+
+	return current, exists
+}
+
+// Counts a response against client, banning them if that's too many.
+func (b *banStruct) observe(r *http.Request, client string, status int, now time.Time) {
+	if status < 400 || status == http.StatusServiceUnavailable {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.errors == 0 && b.rateLimited == 0 {
+		return
+	}
+
+	watch, exists := b.watches[client]
+	switch {
+	case !exists:
+		if len(b.watches) >= banMaxClients {
+			b.forget(b.order.Back().Value.(*banWatch))
+		}
+
+		watch = &banWatch{client: client, start: now}
+		watch.element = b.order.PushFront(watch)
+		b.watches[client] = watch
+	case now.Sub(watch.start) >= b.window:
+		watch.start, watch.errors, watch.limited = now, 0, 0
+		b.order.MoveToFront(watch.element)
+	}
+
+	var reason string
+	if status == http.StatusTooManyRequests {
+		watch.limited++
+		if b.rateLimited > 0 && watch.limited >= b.rateLimited {
+			reason = fmt.Sprintf("%d rate-limited requests in %v", watch.limited, b.window)
+		}
+	} else {
+		watch.errors++
+		if b.errors > 0 && watch.errors >= b.errors {
+			reason = fmt.Sprintf("%d errors in %v", watch.errors, b.window)
+		}
+	}
+	if reason == "" {
+		return
+	}
+
+	b.forget(watch)
+	b.bans[client] = &ban{Client: client, Reason: reason, Since: now, Until: now.Add(b.duration)}
+
+	if status == http.StatusTooManyRequests {
+		bansTotal.add(1, "rate_limited")
+	} else {
+		bansTotal.add(1, "errors")
+	}
+	slog.WarnContext(r.Context(), "Client banned", "banned", client, "reason", reason, "until", now.Add(b.duration))
+}
+
+// Stops watching; must hold the mutex.
+func (b *banStruct) forget(watch *banWatch) {
+	b.order.Remove(watch.element)
+	delete(b.watches, watch.client)
+}
+
+// Lifts the ban on client, or all of them if client is empty, returning how
+// many there were.
+func (b *banStruct) lift(client string) int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if client == "" {
+		n := len(b.bans)
+		clear(b.bans)
+		return n
+	}
+
+	if _, exists := b.bans[client]; !exists {
+		return 0
+	}
+	delete(b.bans, client)
+	return 1
+}
+
+// The bans in force, ending soonest first
+func (b *banStruct) list(now time.Time) []ban {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	list := []ban{}
+	for client, current := range b.bans {
+		if !now.Before(current.Until) {
+			delete(b.bans, client)
+			continue
+		}
+		list = append(list, *current)
+	}
+
+	slices.SortFunc(list, func(a, b ban) int {
+		return cmp.Or(a.Until.Compare(b.Until), cmp.Compare(a.Client, b.Client))
+	})
+
+	return list
+}
+
+// withBans turns away banned clients, and watches the rest for what would
+// get them banned. It goes outside withRateLimit so it sees its 429s, and
+// after the credentials are checked, so it knows who's asking.
+func withBans(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rateLimitExemptPaths[r.URL.Path] || isAdmin(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		client := rateLimitKey(r)
+		if bans.turnAway(w, client) {
+			return
+		}
+
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+
+		bans.observe(r, client, sw.statusCode(), time.Now())
+	})
+}
+
+// withIPBans turns away banned addresses before their credentials are
+// checked; withBans sees to the rest.
+func withIPBans(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rateLimitExemptPaths[r.URL.Path] || isAdmin(r) || !bans.turnAway(w, "ip:"+clientIP(r)) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// Responds 403 if client is banned, returning whether they were.
+func (b *banStruct) turnAway(w http.ResponseWriter, client string) bool {
+	now := time.Now()
+	current, ok := b.banned(client, now)
+	if !ok {
+		return false
+	}
+
+	bannedRequests.add(1)
+	w.Header().Set("Retry-After", ceilSeconds(current.Until.Sub(now)))
+	httpErrorCode(w, http.StatusForbidden, "banned",
+		fmt.Sprintf("Banned until %s for %s", current.Until.UTC().Format(time.RFC3339), current.Reason))
+	return true
+}
+
+// GET /admin/bans lists the bans in force, and DELETE lifts one (with
+// ?client=) or all of them. Admin only.
+func doBans(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		writeData(w, r, http.StatusOK, bans.list(time.Now()))
+	case http.MethodDelete:
+		client := r.URL.Query().Get("client")
+		n := bans.lift(client)
+		if client != "" && n == 0 {
+			http.Error(w, fmt.Sprintf("%s isn't banned", client), http.StatusNotFound)
+			return
+		}
+
+		slog.InfoContext(r.Context(), "Bans lifted", "banned", client, "count", n)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, DELETE")
+		http.Error(w, "Usage: curl [-X DELETE] -H 'Authorization: Bearer TOKEN' 'http://localhost:8080/admin/bans[?client=CLIENT]'",
+			http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// For small deployments that don't want to hand out tokens,
+// -basic-auth-users lets computations be authorized with HTTP Basic auth
+// instead, against bcrypt hashes (from htpasswd -nbB USER PASSWORD, say).
+// bcrypt is slow on purpose, so a password that's been right once is
+// remembered (hashed) until the users are reloaded, rather than checked
+// the slow way on every request.
+//
+// Checking bcrypt needs golang.org/x/crypto/bcrypt, which is only compiled
+// in with: go build -tags bcrypt
+
+var basicAuthUsersFlag = flag.String("basic-auth-users", "", "comma-separated USER:BCRYPT_HASH pairs; if set, computations can be authorized with Basic auth")
+
+// set by bcrypt.go when built with -tags bcrypt
+var compareBcrypt func(hash []byte, password []byte) error
+
+// how many good passwords are remembered
+const basicAuthVerifiedMax = 1000
+
+type basicAuthStruct struct {
+	users    map[string][]byte // bcrypt hashes, by user
+	anyHash  []byte            // checked for unknown users, so they take as long
+	verified map[[sha256.Size]byte]bool
+	mutex    sync.Mutex
+}
+
+// nil when Basic auth is off
+var basicAuth atomic.Pointer[basicAuthStruct]
+
+type basicAuthUserKey struct{}
+
+func init() {
+	registerReload(loadBasicAuth, "basic-auth-users")
+}
+
+func loadBasicAuth() error {
+	if *basicAuthUsersFlag == "" {
+		basicAuth.Store(nil)
+		return nil
+	}
+	if compareBcrypt == nil {
+		return errors.New("-basic-auth-users needs bcrypt; build with -tags bcrypt")
+	}
+
+	auth := &basicAuthStruct{users: map[string][]byte{}, verified: map[[sha256.Size]byte]bool{}}
+	for _, pair := range strings.Split(*basicAuthUsersFlag, ",") {
+		user, hash, found := strings.Cut(strings.TrimSpace(pair), ":")
+		if !found || user == "" || !strings.HasPrefix(hash, "$2") {
+			return fmt.Errorf("invalid -basic-auth-users entry for %q: expected USER:BCRYPT_HASH", user)
+		}
+		auth.users[user] = []byte(hash)
+		auth.anyHash = []byte(hash)
+	}
+
+	basicAuth.Store(auth)
+	return nil
+}
+
+// Whether password is user's.
+func (a *basicAuthStruct) check(user string, password string) bool {
+	hash, exists := a.users[user]
+	remembered := sha256.Sum256([]byte(user + "\x00" + password + "\x00" + string(hash)))
+
+	a.mutex.Lock()
+	ok := a.verified[remembered]
+	a.mutex.Unlock()
+	if ok {
+		return true
+	}
+
+	if !exists {
+		compareBcrypt(a.anyHash, []byte(password))
+		return false
+	}
+	if compareBcrypt(hash, []byte(password)) != nil {
+		return false
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if len(a.verified) >= basicAuthVerifiedMax {
+		clear(a.verified)
+	}
+	a.verified[remembered] = true
+
+	return true
+}
+
+// The user the request authenticated as with Basic auth, if it did
+func basicAuthUser(ctx context.Context) (string, bool) {
+	user, ok := ctx.Value(basicAuthUserKey{}).(string)
+	return user, ok
+}
+
+// withBasicAuth checks the request's Basic auth, when there are users, and
+// puts the user in the context for what comes after. Like withAPIKey, it
+// doesn't turn anyone away.
+func withBasicAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := basicAuth.Load()
+		user, password, found := r.BasicAuth()
+		if auth == nil || !found || !auth.check(user, password) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), basicAuthUserKey{}, user)))
+	})
+}
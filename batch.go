@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+)
+
+// POST /batch answers a list of independent questions synchronously; it's
+// the same request as POST /jobs, without the job. Asking for NDJSON
+// (Accept: application/x-ndjson, or format=ndjson) streams one answer per
+// line as it's computed, and the items are read from the request as they're
+// needed, so memory stays bounded however big the batch is.
+
+const batchFlushEvery = 100
+
+// answers one item, remembering it in client's history
+func answerItem(ctx context.Context, client string, item jobItem, fresh bool) jobResult {
+	var result jobResult
+
+	op := canonicalOp(item.Op)
+
+	answer, hit, err := getAnswer(ctx, op, item.X, item.Y, fresh)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	resp := newResponse(op, item.X, item.Y, answer, hit)
+	result.response = &resp
+
+	history.add(client, historyEntry{
+		Time:   time.Now(),
+		Action: op,
+		X:      item.X,
+		Y:      item.Y,
+		Answer: answer,
+		Cached: hit.cached,
+	})
+
+	return result
+}
+
+// batchReader hands out the items of a batch one at a time. The body is
+// either a {"items": [...]} object, or NDJSON with one item per line.
+type batchReader struct {
+	dec     *json.Decoder
+	ndjson  bool
+	started bool
+}
+
+func newBatchReader(r *http.Request) *batchReader {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	return &batchReader{
+		dec:    json.NewDecoder(bufio.NewReader(r.Body)),
+		ndjson: mediaType == "application/x-ndjson" || mediaType == "application/jsonl",
+	}
+}
+
+// skips ahead to the first element of the items array
+func (b *batchReader) start() error {
+	tok, err := b.dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != json.Delim('{') {
+		return errors.New("expected a JSON object")
+	}
+
+	for b.dec.More() {
+		key, err := b.dec.Token()
+		if err != nil {
+			return err
+		}
+
+		if key == "items" {
+			tok, err = b.dec.Token()
+			if err != nil {
+				return err
+			}
+			if tok != json.Delim('[') {
+				return errors.New("items must be an array")
+			}
+			return nil
+		}
+
+		// not interested in anything else
+		var skip json.RawMessage
+		err = b.dec.Decode(&skip)
+		if err != nil {
+			return err
+		}
+	}
+
+	return errors.New("no items in batch")
+}
+
+// returns the next item, or io.EOF when there are no more
+func (b *batchReader) next() (jobItem, error) {
+	var item jobItem
+
+	if !b.ndjson {
+		if !b.started {
+			b.started = true
+
+			err := b.start()
+			if err != nil {
+				return item, err
+			}
+		}
+
+		if !b.dec.More() {
+			return item, io.EOF
+		}
+	}
+
+	err := b.dec.Decode(&item)
+	return item, err
+}
+
+func doBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Usage: curl -X POST http://localhost:8080/batch "+
+			`-d '{"items": [{"op": OP, "x": X, "y": Y}, ...]}'`,
+			http.StatusMethodNotAllowed)
+		return
+	}
+
+	enc, err := negotiate(r)
+	if err == nil && enc.name == "ndjson" {
+		streamBatch(w, r)
+		return
+	}
+
+	client := clientID(r, nil)
+	fresh := wantsFresh(r)
+	batch := newBatchReader(r)
+
+	// all of them first, so the quota is spent for the whole batch or none
+	items := []jobItem{}
+	for {
+		item, err := batch.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			httpFail(w, fmt.Errorf("Invalid batch request: %w", err))
+			return
+		}
+
+		if len(items) == batchMaxRows {
+			httpFail(w, fmt.Errorf("Batch has too many items (max %d)", batchMaxRows))
+			return
+		}
+
+		items = append(items, item)
+	}
+
+	err = spendQuota(r.Context(), len(items))
+	if err != nil {
+		httpFail(w, err)
+		return
+	}
+
+	results := make([]jobResult, 0, len(items))
+	for _, item := range items {
+		if err := deadlineError(r); err != nil {
+			httpTimedOut(w, err)
+			return
+		}
+
+		results = append(results, answerItem(r.Context(), client, item, fresh))
+	}
+
+	writeData(w, r, http.StatusOK, results)
+}
+
+// Answers arrive one line at a time. The status is already sent by the time
+// a bad item turns up, so that ends the stream with an error line instead.
+func streamBatch(w http.ResponseWriter, r *http.Request) {
+	client := clientID(r, nil)
+	fresh := wantsFresh(r)
+	batch := newBatchReader(r)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Add("Vary", "Accept")
+
+	flusher, _ := w.(http.Flusher)
+	out := json.NewEncoder(w)
+
+	for n := 0; ; n++ {
+		item, err := batch.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			out.Encode(jobResult{Error: fmt.Sprintf("Invalid batch request: %v", err)})
+			break
+		}
+
+		if err := deadlineError(r); err != nil {
+			out.Encode(jobResult{Error: err.Error()})
+			break
+		}
+
+		err = spendQuota(r.Context(), 1)
+		if err != nil {
+			out.Encode(jobResult{Error: err.Error()})
+			break
+		}
+
+		err = out.Encode(answerItem(r.Context(), client, item, fresh))
+		if err != nil {
+			return // client went away
+		}
+
+		if flusher != nil && n%batchFlushEvery == batchFlushEvery-1 {
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bulk computation from a CSV file with op,x,y on each row. The answers come
+// back as CSV with op,x,y,answer,cached,error columns, in the same order.
+
+const batchMaxRows = 100000
+
+var csvHeader = []string{"op", "x", "y", "answer", "cached", "error"}
+
+// The CSV may be uploaded as the "file" field of a multipart form, or sent
+// as the request body itself with a text/csv content type.
+func csvUpload(r *http.Request) (io.ReadCloser, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	switch mediaType {
+	case "multipart/form-data":
+		err := r.ParseMultipartForm(*maxBatchBodyBytesFlag)
+		if err != nil {
+			return nil, err
+		}
+
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			return nil, errors.New("Missing CSV upload in the file field")
+		}
+
+		return file, nil
+	case "text/csv", "text/plain":
+		return r.Body, nil
+	}
+
+	return nil, errors.New("Upload a CSV as multipart/form-data or text/csv")
+}
+
+func doBatchCSV(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Usage: curl -F file=@questions.csv http://localhost:8080/batch/csv",
+			http.StatusMethodNotAllowed)
+		return
+	}
+
+	upload, err := csvUpload(r)
+	if err != nil {
+		httpFail(w, err)
+		return
+	}
+	defer upload.Close()
+
+	reader := csv.NewReader(upload)
+	reader.FieldsPerRecord = 3
+	reader.TrimLeadingSpace = true
+	reader.ReuseRecord = true
+
+	// Read everything up front, so a malformed file is rejected as a whole
+	// instead of failing halfway through a response we've already started.
+	var rows []jobItem
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			httpFail(w, err)
+			return
+		}
+
+		if line == 1 && strings.EqualFold(record[0], "op") {
+			continue // header row
+		}
+
+		x, err := parseOperand("x", record[1], nil)
+		if err != nil {
+			httpFail(w, fmt.Errorf("line %d: %v", line, err))
+			return
+		}
+
+		y, err := parseOperand("y", record[2], nil)
+		if err != nil {
+			httpFail(w, fmt.Errorf("line %d: %v", line, err))
+			return
+		}
+
+		rows = append(rows, jobItem{Op: canonicalOp(record[0]), X: x, Y: y})
+		if len(rows) > batchMaxRows {
+			httpFail(w, fmt.Errorf("Too many rows (max %d)", batchMaxRows))
+			return
+		}
+	}
+
+	err = spendQuota(r.Context(), len(rows))
+	if err != nil {
+		httpFail(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	if r.FormValue("download") != "" {
+		w.Header().Set("Content-Disposition", `attachment; filename="answers.csv"`)
+	}
+
+	client := clientID(r, nil)
+	fresh := wantsFresh(r)
+
+	out := csv.NewWriter(w)
+	out.Write(csvHeader)
+
+	for _, row := range rows {
+		x := strconv.FormatFloat(row.X, 'g', -1, 64)
+		y := strconv.FormatFloat(row.Y, 'g', -1, 64)
+
+		// the rest of the rows don't get answered
+		if err := deadlineError(r); err != nil {
+			out.Write([]string{row.Op, x, y, "", "", err.Error()})
+			break
+		}
+
+		answer, hit, err := getAnswer(r.Context(), row.Op, row.X, row.Y, fresh)
+		if err != nil {
+			out.Write([]string{row.Op, x, y, "", "", err.Error()})
+			continue
+		}
+
+		history.add(client, historyEntry{
+			Time:   time.Now(),
+			Action: row.Op,
+			X:      row.X,
+			Y:      row.Y,
+			Answer: answer,
+			Cached: hit.cached,
+		})
+
+		out.Write([]string{row.Op, x, y,
+			strconv.FormatFloat(answer, 'g', -1, 64), strconv.FormatBool(hit.cached), ""})
+	}
+
+	out.Flush()
+}
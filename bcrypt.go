@@ -0,0 +1,15 @@
+//go:build bcrypt
+
+package main
+
+// Basic auth against bcrypt hashes (-basic-auth-users) needs
+// golang.org/x/crypto/bcrypt, so this is only compiled in with:
+// go build -tags bcrypt
+
+import (
+	"golang.org/x/crypto/bcrypt"
+)
+
+func init() {
+	compareBcrypt = bcrypt.CompareHashAndPassword
+}
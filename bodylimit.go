@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+)
+
+// Request bodies are capped, so an absurd payload gets a 413 rather than
+// eating all our memory. The endpoints that take bulk uploads get a bigger
+// cap than everything else.
+
+var maxBodyBytesFlag = flag.Int64("max-body-bytes", 1<<20, "largest request body to accept, in bytes, outside of the bulk endpoints")
+var maxBatchBodyBytesFlag = flag.Int64("max-batch-body-bytes", 32<<20, "largest request body to accept for /batch, /batch/csv, /jobs and /cache/import, in bytes")
+
+// the bulk endpoints
+var batchBodyPaths = map[string]bool{
+	"/batch":        true,
+	"/batch/csv":    true,
+	"/jobs":         true,
+	"/cache/import": true,
+}
+
+func withBodyLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := *maxBodyBytesFlag
+		if batchBodyPaths[r.URL.Path] {
+			limit = *maxBatchBodyBytesFlag
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// JSON data for errors a client is expected to handle, with a code that
+// won't change when the message does
+type errorResponse struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+func httpErrorCode(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Error: message, Code: code})
+}
+
+// Responds 413 if err came from a body over its limit, returning whether it
+// did.
+func httpTooLarge(w http.ResponseWriter, err error) bool {
+	var tooLarge *http.MaxBytesError
+	if !errors.As(err, &tooLarge) {
+		return false
+	}
+
+	httpErrorCode(w, http.StatusRequestEntityTooLarge, "body_too_large",
+		fmt.Sprintf("Request body too large (max %d bytes)", tooLarge.Limit))
+	return true
+}
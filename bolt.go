@@ -0,0 +1,338 @@
+//go:build bolt
+
+package main
+
+// The bbolt cache needs go.etcd.io/bbolt, so it is only compiled in with:
+// go build -tags bolt
+//
+// Answers are kept in a single file on disk, so they survive restarts
+// without needing a Redis. TTLs always count from when an answer was
+// computed, whatever -cache-expiry says; sliding them would cost a disk write
+// per hit. TTLs are worked out when answers are read, so -cache-ttl-jitter
+// doesn't apply either.
+
+import (
+	"context"
+	"encoding/binary"
+	"flag"
+	"log/slog"
+	"math"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var boltPathFlag = flag.String("bolt-path", "http-math.db", "database file for -cache-backend=bolt")
+var boltCompactIntervalFlag = flag.Duration("bolt-compact-interval", time.Hour, "how often to rewrite the bolt database to give back space freed by expired answers (0 to never compact)")
+
+func init() {
+	cacheBackends["bolt"] = newBoltCache
+}
+
+var boltBucket = []byte("answers")
+
+// Each value is the answer's float64 bits, then when it was set in unix
+// nanoseconds, then the message if it's a cached error. Hits aren't
+// counted; that would take a disk write per hit.
+const boltValueSize = 16
+
+type boltCache struct {
+	db            *bolt.DB
+	path          string
+	opts          cacheOptions
+	mutex         sync.RWMutex // write locked while compaction swaps db out
+	stop          context.CancelFunc
+	tasks         sync.WaitGroup // the cleaner and compactor
+	hits          atomic.Uint64
+	misses        atomic.Uint64
+	sets          atomic.Uint64
+	expired       atomic.Uint64
+	expiredOnRead atomic.Uint64
+}
+
+func openBolt(path string) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+func newBoltCache(opts cacheOptions) (Cache, error) {
+	db, err := openBolt(*boltPathFlag)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &boltCache{db: db, path: *boltPathFlag, opts: opts}
+
+	ctx, stop := context.WithCancel(context.Background())
+	c.stop = stop
+
+	c.tasks.Add(1)
+	go c.every(ctx, c.opts.cleanupInterval, c.cleanup)
+
+	if *boltCompactIntervalFlag > 0 {
+		c.tasks.Add(1)
+		go c.every(ctx, *boltCompactIntervalFlag, func() {
+			err := c.compact()
+			if err != nil {
+				slog.Error("Error compacting cache file", "path", c.path, "err", err)
+			}
+		})
+	}
+
+	return c, nil
+}
+
+func encodeBoltValue(value cachedAnswer) []byte {
+	val := make([]byte, boltValueSize, boltValueSize+len(value.err))
+	binary.BigEndian.PutUint64(val, math.Float64bits(value.answer))
+	binary.BigEndian.PutUint64(val[8:], uint64(value.set.UnixNano()))
+	return append(val, value.err...)
+}
+
+func decodeBoltValue(val []byte) (cachedAnswer, bool) {
+	if len(val) < boltValueSize {
+		return cachedAnswer{}, false
+	}
+
+	value := cachedAnswer{
+		answer: math.Float64frombits(binary.BigEndian.Uint64(val)),
+		err:    string(val[boltValueSize:]),
+		set:    time.Unix(0, int64(binary.BigEndian.Uint64(val[8:]))),
+	}
+
+	return value, true
+}
+
+func (c *boltCache) isExpired(key string, value cachedAnswer, now time.Time) bool {
+	ttl := c.opts.ttlFor(key, value)
+	return ttl > 0 && now.Sub(value.set) > ttl
+}
+
+func (c *boltCache) Get(ctx context.Context, key string) (cachedAnswer, bool) {
+	// a miss is better than waiting out a compaction
+	if !c.mutex.TryRLock() {
+		c.misses.Add(1)
+		return cachedAnswer{}, false
+	}
+	defer c.mutex.RUnlock()
+
+	var value cachedAnswer
+	var exists bool
+
+	c.db.View(func(tx *bolt.Tx) error {
+		value, exists = decodeBoltValue(tx.Bucket(boltBucket).Get([]byte(key)))
+		if exists && c.isExpired(key, value, time.Now()) {
+			exists = false // the cleaner will get it
+			c.expired.Add(1)
+			c.expiredOnRead.Add(1)
+		}
+		return nil
+	})
+
+	if !exists {
+		c.misses.Add(1)
+		return cachedAnswer{}, false
+	}
+
+	c.hits.Add(1)
+	return value, true
+}
+
+func (c *boltCache) Set(ctx context.Context, key string, value cachedAnswer) {
+	if !c.mutex.TryRLock() {
+		return // compacting; it'll be recomputed next time
+	}
+	defer c.mutex.RUnlock()
+
+	// Batch, so concurrent sets share a disk sync
+	err := c.db.Batch(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put([]byte(key), encodeBoltValue(value))
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Cache file error", "err", err)
+		return
+	}
+
+	c.sets.Add(1)
+}
+
+func (c *boltCache) Delete(key string) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete([]byte(key))
+	})
+	if err != nil {
+		slog.Error("Cache file error", "err", err)
+	}
+}
+
+// The database file belongs to this replica alone.
+func (c *boltCache) invalidateLocal(key string) {
+	if key == "" {
+		c.Purge()
+	} else {
+		c.Delete(key)
+	}
+}
+
+func (c *boltCache) Purge() error {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.db.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket(boltBucket)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateBucket(boltBucket)
+		return err
+	})
+}
+
+func (c *boltCache) Stats() CacheStats {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	stats := CacheStats{
+		Hits:          c.hits.Load(),
+		Misses:        c.misses.Load(),
+		Sets:          c.sets.Load(),
+		Expired:       c.expired.Load(),
+		ExpiredOnRead: c.expiredOnRead.Load(),
+	}
+
+	c.db.View(func(tx *bolt.Tx) error {
+		stats.Entries = tx.Bucket(boltBucket).Stats().KeyN
+		stats.Bytes = tx.Size()
+		return nil
+	})
+
+	return stats
+}
+
+func (c *boltCache) Close() error {
+	c.stop()
+	c.tasks.Wait()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.db.Close()
+}
+
+func (c *boltCache) cleanup() {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	now := time.Now()
+	removed := 0
+
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+
+		// collected first; deleting under a cursor can make it skip keys
+		var expList [][]byte
+		bucket.ForEach(func(k, v []byte) error {
+			value, ok := decodeBoltValue(v)
+			if !ok || c.isExpired(string(k), value, now) {
+				expList = append(expList, k)
+			}
+			return nil
+		})
+
+		for _, k := range expList {
+			err := bucket.Delete(k)
+			if err != nil {
+				return err
+			}
+			removed++
+		}
+
+		return nil
+	})
+	if err != nil {
+		slog.Error("Cache file error", "err", err)
+	}
+
+	c.expired.Add(uint64(removed))
+	if removed > 0 {
+		slog.Debug("Expired answers", "count", removed, "path", c.path)
+	}
+}
+
+// Runs task every interval, in a separate goroutine until ctx is done.
+func (c *boltCache) every(ctx context.Context, interval time.Duration, task func()) {
+	defer c.tasks.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			task()
+		}
+	}
+}
+
+// bbolt never shrinks its file by itself, so this copies the live answers
+// into a fresh one and swaps it in.
+func (c *boltCache) compact() error {
+	tmpPath := c.path + ".compact"
+	os.Remove(tmpPath)
+
+	dst, err := bolt.Open(tmpPath, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	err = bolt.Compact(dst, c.db, 0)
+	dst.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	err = c.db.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpPath, c.path)
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+
+	// reopen whichever file is in place now
+	db, openErr := openBolt(c.path)
+	if openErr != nil {
+		fatal("Error reopening cache file", "path", c.path, "err", openErr)
+	}
+	c.db = db
+
+	return err
+}
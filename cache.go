@@ -0,0 +1,774 @@
+package main
+
+import (
+	"container/heap"
+	"container/list"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/maphash"
+	"log/slog"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Cache is what getAnswer needs from a cache of answers, keyed by question
+// string. cacheStruct is the in-memory one; others can be swapped in with
+// -cache-backend without getAnswer knowing the difference. ctx is the
+// request's, for what's logged along the way.
+type Cache interface {
+	Get(ctx context.Context, key string) (cachedAnswer, bool)
+	Set(ctx context.Context, key string, value cachedAnswer)
+	Delete(key string)
+	Purge() error // deletes everything
+	Stats() CacheStats
+	Close() error
+}
+
+// What's cached for a question: its answer, or the error it always gives
+// (like dividing by zero), so that isn't worked out again every time either.
+type cachedAnswer struct {
+	answer float64
+	err    string    // set for a cached error
+	set    time.Time // when it was worked out
+	hits   uint64    // filled in by Get, if the backend counts them
+	stale  bool      // filled in by Get; past its TTL, see -cache-stale-op
+}
+
+// Turns a cached error back into an error, or nil for an answer.
+func (v cachedAnswer) error() error {
+	if v.err == "" {
+		return nil
+	}
+
+	return domainError(v.err)
+}
+
+// Remote caches store values as strings: when it was set in unix
+// nanoseconds, a space, then the answer as a number, or an error as its
+// message after a "!". Hits aren't stored; counting them would take a write
+// per hit.
+func encodeCachedAnswer(v cachedAnswer) string {
+	set := strconv.FormatInt(v.set.UnixNano(), 10) + " "
+
+	if v.err != "" {
+		return set + "!" + v.err
+	}
+
+	return set + strconv.FormatFloat(v.answer, 'g', -1, 64)
+}
+
+func decodeCachedAnswer(s string) (cachedAnswer, error) {
+	var v cachedAnswer
+
+	set, s, found := strings.Cut(s, " ")
+	if !found {
+		return v, errors.New("malformed cached value")
+	}
+
+	nanos, err := strconv.ParseInt(set, 10, 64)
+	if err != nil {
+		return v, err
+	}
+	v.set = time.Unix(0, nanos)
+
+	if msg, isErr := strings.CutPrefix(s, "!"); isErr {
+		v.err = msg
+		return v, nil
+	}
+
+	v.answer, err = strconv.ParseFloat(s, 64)
+	return v, err
+}
+
+type CacheStats struct {
+	Entries          int     `json:"entries"`
+	Bytes            int64   `json:"bytes"` // approximate memory used
+	Hits             uint64  `json:"hits"`
+	StaleHits        uint64  `json:"stale_hits"` // of Hits, served stale while refreshing
+	Misses           uint64  `json:"misses"`
+	Sets             uint64  `json:"sets"`
+	Expired          uint64  `json:"expired"`
+	ExpiredOnRead    uint64  `json:"expired_on_read"` // of Expired, found by Get rather than the cleaner
+	Evictions        uint64  `json:"evictions"`
+	OldestAgeSeconds float64 `json:"oldest_age_seconds"` // since the least recently used entry was used, roughly; see Stats
+}
+
+var cacheBackendFlag = flag.String("cache-backend", "memory", "where answers are cached: memory, or none to disable caching (others may be compiled in, see cacheBackends)")
+var cacheTTLFlag = flag.Duration("cache-ttl", 60*time.Second, "how long an answer stays cached after it was last used (or set, see -cache-expiry)")
+var cacheExpiryFlag = flag.String("cache-expiry", "sliding", "when the TTL counts from: sliding (last used, so it's an idle timeout) or absolute (when it was worked out)")
+var cacheExpiryOpFlag = flag.String("cache-expiry-op", "", `per-operation -cache-expiry overrides, e.g. "divide=absolute"`)
+var cacheTTLJitterFlag = flag.Float64("cache-ttl-jitter", 0, "fraction of each answer's TTL to randomly add or take away when it's cached, so answers cached together don't all expire together (e.g. 0.1 for up to 10%)")
+var cacheCleanupIntervalFlag = flag.Duration("cache-cleanup-interval", 10*time.Second, "how often expired answers are swept out of the memory cache")
+var cacheNegativeTTLFlag = flag.Duration("cache-negative-ttl", 10*time.Second, "how long errors that always happen for a question (like dividing by zero) stay cached (0 to not cache them)")
+var cacheOpTTLFlag = flag.String("cache-ttl-op", "", `per-operation cache TTLs overriding -cache-ttl, e.g. "add=24h,divide=never"`)
+var cacheStaleOpFlag = flag.String("cache-stale-op", "", `per-operation grace periods past the TTL during which the memory cache still serves an answer while working out a fresh one in the background, e.g. "divide=30s"`)
+
+// whether errors like dividing by zero are cached; -cache-negative-ttl can
+// change on reload, so this is what's checked
+var negativeCaching atomic.Bool
+
+var cacheMaxBytesFlag = flag.Int64("cache-max-bytes", 0, "approximate memory budget for the memory cache, evicting the least recently used answers past it (0 for no limit)")
+var cacheShardsFlag = flag.Int("cache-shards", 16, "how many independently locked pieces to split the memory cache into")
+var cacheMaxEntriesFlag = flag.Int("cache-max-entries", 100000, "most answers to keep in the memory cache before evicting the least recently used (0 for no limit)")
+
+// Tunables for the caches, gathered from flags at startup
+type cacheOptions struct {
+	ttl             time.Duration
+	opTTL           map[string]time.Duration // by canonical operation; 0 means never expire
+	negativeTTL     time.Duration            // for cached errors
+	jitter          float64                  // fraction of the TTL, see jitterTTL
+	opStale         map[string]time.Duration // stale-while-revalidate grace periods by canonical operation
+	sliding         bool                     // from -cache-expiry
+	opSliding       map[string]bool          // by canonical operation
+	cleanupInterval time.Duration
+	maxEntries      int   // 0 means unlimited
+	maxBytes        int64 // 0 means unlimited
+	shards          int
+}
+
+func cacheOptionsFromFlags() (cacheOptions, error) {
+	opts := cacheOptions{
+		ttl:             *cacheTTLFlag,
+		cleanupInterval: *cacheCleanupIntervalFlag,
+		negativeTTL:     *cacheNegativeTTLFlag,
+		jitter:          *cacheTTLJitterFlag,
+		maxEntries:      *cacheMaxEntriesFlag,
+		maxBytes:        *cacheMaxBytesFlag,
+		shards:          *cacheShardsFlag,
+	}
+
+	if opts.ttl <= 0 {
+		return opts, fmt.Errorf("-cache-ttl must be positive, not %v", opts.ttl)
+	}
+	if opts.cleanupInterval <= 0 {
+		return opts, fmt.Errorf("-cache-cleanup-interval must be positive, not %v", opts.cleanupInterval)
+	}
+	if opts.negativeTTL < 0 {
+		return opts, errors.New("-cache-negative-ttl can't be negative")
+	}
+	if opts.jitter < 0 || opts.jitter >= 1 {
+		return opts, fmt.Errorf("-cache-ttl-jitter must be at least 0 and less than 1, not %v", opts.jitter)
+	}
+	if opts.maxEntries < 0 {
+		return opts, errors.New("-cache-max-entries can't be negative")
+	}
+	if opts.maxBytes < 0 {
+		return opts, errors.New("-cache-max-bytes can't be negative")
+	}
+	if opts.shards < 1 {
+		return opts, errors.New("-cache-shards must be at least 1")
+	}
+
+	var err error
+	opts.opTTL, err = parseOpDurations("-cache-ttl-op", *cacheOpTTLFlag, true)
+	if err != nil {
+		return opts, err
+	}
+
+	opts.opStale, err = parseOpDurations("-cache-stale-op", *cacheStaleOpFlag, false)
+	if err != nil {
+		return opts, err
+	}
+
+	opts.sliding, err = parseExpiry("-cache-expiry", *cacheExpiryFlag)
+	if err != nil {
+		return opts, err
+	}
+
+	opts.opSliding = map[string]bool{}
+	for _, pair := range strings.Split(*cacheExpiryOpFlag, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		op, policy, found := strings.Cut(pair, "=")
+		if !found {
+			return opts, fmt.Errorf("invalid -cache-expiry-op entry %q: expected op=policy", pair)
+		}
+
+		opts.opSliding[canonicalOp(op)], err = parseExpiry("-cache-expiry-op", policy)
+		if err != nil {
+			return opts, err
+		}
+	}
+
+	return opts, nil
+}
+
+// true for sliding, false for absolute
+func parseExpiry(flagName string, policy string) (bool, error) {
+	switch policy {
+	case "sliding":
+		return true, nil
+	case "absolute":
+		return false, nil
+	}
+
+	return false, fmt.Errorf("invalid %s policy %q: expected sliding or absolute", flagName, policy)
+}
+
+// parses a list of op=duration pairs for flagName, where the duration may be
+// "never" (as 0) if allowNever is set
+func parseOpDurations(flagName string, list string, allowNever bool) (map[string]time.Duration, error) {
+	durations := map[string]time.Duration{}
+
+	for _, pair := range strings.Split(list, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		op, strVal, found := strings.Cut(pair, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid %s entry %q: expected op=duration", flagName, pair)
+		}
+
+		var duration time.Duration
+		if strVal != "never" || !allowNever {
+			var err error
+			duration, err = time.ParseDuration(strVal)
+			if err != nil || duration <= 0 {
+				return nil, fmt.Errorf("invalid %s duration for %s: %q", flagName, op, strVal)
+			}
+		}
+
+		durations[canonicalOp(op)] = duration
+	}
+
+	return durations, nil
+}
+
+// The TTL for a cached value, from the operation at the start of its
+// question string. 0 means it never expires.
+func (opts cacheOptions) ttlFor(key string, value cachedAnswer) time.Duration {
+	if value.err != "" {
+		return opts.negativeTTL
+	}
+
+	op, _, _ := strings.Cut(key, ";")
+
+	ttl, exists := opts.opTTL[op]
+	if exists {
+		return ttl
+	}
+
+	return opts.ttl
+}
+
+// Randomly moves ttl up or down by as much as the -cache-ttl-jitter fraction
+// of it, to spread out when a burst of answers cached together expires.
+// Called when an answer is set; 0 (never) stays 0.
+func (opts cacheOptions) jitterTTL(ttl time.Duration) time.Duration {
+	if opts.jitter == 0 || ttl <= 0 {
+		return ttl
+	}
+
+	return max(ttl+time.Duration(float64(ttl)*opts.jitter*(2*rand.Float64()-1)), 1)
+}
+
+// Whether using a cached value should push its expiry back.
+func (opts cacheOptions) slidingFor(key string) bool {
+	op, _, _ := strings.Cut(key, ";")
+
+	sliding, exists := opts.opSliding[op]
+	if exists {
+		return sliding
+	}
+
+	return opts.sliding
+}
+
+// How long past its TTL a cached value may still be served while a fresh
+// one is worked out. Errors aren't worth the trouble.
+func (opts cacheOptions) staleFor(key string, value cachedAnswer) time.Duration {
+	if value.err != "" {
+		return 0
+	}
+
+	op, _, _ := strings.Cut(key, ";")
+	return opts.opStale[op]
+}
+
+var cache Cache
+
+// Constructors for each -cache-backend. Backends that need extra packages
+// live in their own files behind build tags, and add themselves here from
+// init when compiled in.
+var cacheBackends = map[string]func(opts cacheOptions) (Cache, error){
+	"memory": func(opts cacheOptions) (Cache, error) { return newCache(opts), nil },
+	"none":   func(opts cacheOptions) (Cache, error) { return noCache{}, nil },
+}
+
+func newCacheBackend(name string, opts cacheOptions) (Cache, error) {
+	newBackend, exists := cacheBackends[name]
+	if !exists {
+		return nil, fmt.Errorf("unknown -cache-backend: %s", name)
+	}
+
+	return newBackend(opts)
+}
+
+// noCache never remembers anything, so every answer is computed fresh
+type noCache struct{}
+
+func (noCache) Get(ctx context.Context, key string) (cachedAnswer, bool) {
+	return cachedAnswer{}, false
+}
+func (noCache) Set(ctx context.Context, key string, value cachedAnswer) {}
+func (noCache) Delete(key string)                                       {}
+func (noCache) Purge() error                                            { return nil }
+func (noCache) Stats() CacheStats                                       { return CacheStats{} }
+func (noCache) Close() error                                            { return nil }
+
+// Once an entry is in the cache, only used and touched change; everything
+// else is fixed, so Get can read it without a lock. Set replaces the whole
+// entry instead of changing its answer.
+type cacheEntry struct {
+	key     string
+	value   cachedAnswer
+	used    atomic.Int64 // unix nanoseconds it was set or last hit
+	touched atomic.Bool  // hit since it was last moved in the lru list
+	hits    atomic.Uint64
+	ttl     time.Duration // from the TTL policy at set time; 0 means never expire
+	stale   time.Duration // how long past ttl it may still be served, see staleFor
+	sliding bool          // whether hits update used, see slidingFor
+	element *list.Element // this entry's place in cacheShard.lru; guarded by its mutex
+	due     int64         // unix nanoseconds it's scheduled to expire in cacheShard.expiry
+	index   int           // its place in cacheShard.expiry, or -1; guarded by the mutex too
+	size    int64         // approximate memory used, see cacheEntrySize
+}
+
+func (c *cacheStruct) newEntry(key string, value cachedAnswer, used time.Time) *cacheEntry {
+	opts := c.opts.Load()
+	entry := &cacheEntry{
+		key:     key,
+		value:   value,
+		ttl:     opts.jitterTTL(opts.ttlFor(key, value)),
+		stale:   opts.staleFor(key, value),
+		sliding: opts.slidingFor(key),
+		index:   -1,
+		size:    cacheEntrySize(key) + int64(len(value.err)),
+	}
+	entry.used.Store(used.UnixNano())
+	entry.due = entry.expiresAt()
+
+	return entry
+}
+
+func (item *cacheEntry) lastUsed() time.Time {
+	return time.Unix(0, item.used.Load())
+}
+
+// past its TTL, but maybe still servable
+func (item *cacheEntry) isStale(now time.Time) bool {
+	return item.ttl > 0 && now.Sub(item.lastUsed()) > item.ttl
+}
+
+// past its TTL and any stale grace period
+func (item *cacheEntry) expired(now time.Time) bool {
+	return item.ttl > 0 && now.Sub(item.lastUsed()) > item.ttl+item.stale
+}
+
+// in unix nanoseconds, as of its last use
+func (item *cacheEntry) expiresAt() int64 {
+	return item.used.Load() + int64(item.ttl+item.stale)
+}
+
+// A min-heap of entries by when they're due to expire, for container/heap.
+// Hits push an entry's real expiry back without touching the heap (they
+// don't take the lock), so due is only ever early; the cleaner reschedules
+// entries that turn out not to be expired yet.
+type expiryHeap []*cacheEntry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].due < h[j].due }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x any) {
+	item := x.(*cacheEntry)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *expiryHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	item.index = -1
+	*h = old[:len(old)-1]
+	return item
+}
+
+// Roughly what an entry costs beyond its key: the cacheEntry itself, its
+// list.Element, and its share of the map's buckets.
+const cacheEntryOverhead = 160
+
+func cacheEntrySize(key string) int64 {
+	return int64(len(key)) + cacheEntryOverhead
+}
+
+// The memory cache is split into shards by a hash of the question string,
+// so writers to different questions don't queue on one mutex. Each shard has
+// its own LRU list and its share of the limits, so eviction is only least
+// recently used within a shard.
+//
+// Reads don't lock at all: hash is a sync.Map, which suits a cache that's
+// mostly hits. A hit can't move its entry in the lru list without the lock,
+// so it just marks it touched; eviction gives touched entries a second
+// chance at the front instead of evicting them (the CLOCK algorithm, which
+// is close enough to LRU).
+type cacheShard struct {
+	hash       sync.Map   // of *cacheEntry, keyed by question string
+	lru        *list.List // of *cacheEntry, most recently set at the front
+	expiry     expiryHeap // of the entries that expire, soonest first
+	count      int        // entries in hash, which sync.Map can't tell us
+	bytes      int64      // total size of all entries
+	maxEntries int        // this shard's share of -cache-max-entries
+	maxBytes   int64      // and of -cache-max-bytes
+	mutex      sync.Mutex // held to change anything but an entry's used time
+}
+
+type cacheStruct struct {
+	shards        []*cacheShard
+	seed          maphash.Seed
+	opts          atomic.Pointer[cacheOptions] // swapped by reload
+	hits          atomic.Uint64
+	staleHits     atomic.Uint64
+	misses        atomic.Uint64
+	sets          atomic.Uint64
+	expired       atomic.Uint64
+	expiredOnRead atomic.Uint64
+	evictions     atomic.Uint64
+
+	// for the cleaner goroutine
+	stop     context.CancelFunc
+	stopped  chan struct{}
+	interval chan time.Duration
+}
+
+// divides a limit between n shards, rounding up so none end up with 0
+// (which would mean unlimited)
+func shardLimit(limit int64, n int) int64 {
+	return (limit + int64(n) - 1) / int64(n)
+}
+
+func newCache(opts cacheOptions) *cacheStruct {
+	c := &cacheStruct{}
+	c.seed = maphash.MakeSeed()
+	c.opts.Store(&opts)
+
+	c.shards = make([]*cacheShard, opts.shards)
+	for i := range c.shards {
+		c.shards[i] = &cacheShard{
+			lru:        list.New(),
+			maxEntries: int(shardLimit(int64(opts.maxEntries), opts.shards)),
+			maxBytes:   shardLimit(opts.maxBytes, opts.shards),
+		}
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	c.stop = stop
+	c.stopped = make(chan struct{})
+	c.interval = make(chan time.Duration)
+
+	go c.cleaner(ctx)
+
+	return c
+}
+
+func (c *cacheStruct) shard(key string) *cacheShard {
+	return c.shards[maphash.String(c.seed, key)%uint64(len(c.shards))]
+}
+
+func (s *cacheShard) load(key string) (*cacheEntry, bool) {
+	value, exists := s.hash.Load(key)
+	if !exists {
+		return nil, false
+	}
+
+	return value.(*cacheEntry), true
+}
+
+func (c *cacheStruct) Get(ctx context.Context, key string) (cachedAnswer, bool) {
+	item, exists := c.shard(key).load(key)
+	if !exists {
+		c.misses.Add(1)
+		return cachedAnswer{}, false
+	}
+
+	now := time.Now()
+
+	if item.expired(now) {
+		// removing it would need the lock; leave it for the cleaner, or for
+		// Set to replace
+		c.misses.Add(1)
+		c.expired.Add(1)
+		c.expiredOnRead.Add(1)
+		slog.DebugContext(ctx, "Cache entry expired", "key", key)
+		return cachedAnswer{}, false
+	}
+
+	value := item.value
+	value.hits = item.hits.Add(1)
+	c.hits.Add(1)
+
+	if item.isStale(now) {
+		// Don't update the timestamp; it stays stale until getAnswer's fresh
+		// answer replaces it.
+		value.stale = true
+		c.staleHits.Add(1)
+		return value, true
+	}
+
+	// not expired; update timestamp, unless the TTL counts from when it
+	// was set
+	if item.sliding {
+		item.used.Store(now.UnixNano())
+	}
+	item.touched.Store(true)
+
+	return value, true
+}
+
+func (c *cacheStruct) Set(ctx context.Context, key string, value cachedAnswer) {
+	entry := c.newEntry(key, value, time.Now())
+
+	s := c.shard(key)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if old, exists := s.load(key); exists {
+		s.remove(old)
+	}
+
+	evicted := s.add(entry)
+	c.evictions.Add(uint64(evicted))
+	if evicted > 0 {
+		slog.DebugContext(ctx, "Evicted from cache to make room", "key", key, "evicted", evicted)
+	}
+	c.sets.Add(1)
+}
+
+// Adds a new entry at the front of the list, and makes room for it by
+// evicting from the back. Returns how many were evicted.
+//
+// must be called with the lock held
+func (s *cacheShard) add(entry *cacheEntry) int {
+	entry.element = s.lru.PushFront(entry)
+	if entry.ttl > 0 {
+		heap.Push(&s.expiry, entry)
+	}
+	s.hash.Store(entry.key, entry)
+	s.count++
+	s.bytes += entry.size
+
+	evicted := 0
+	for s.overLimit() {
+		back := s.lru.Back().Value.(*cacheEntry)
+
+		// second chance for anything hit since it was last moved
+		if back != entry && back.touched.Swap(false) {
+			s.lru.MoveToFront(back.element)
+			continue
+		}
+
+		s.remove(back)
+		evicted++
+	}
+
+	return evicted
+}
+
+// must be called with the lock held
+func (s *cacheShard) overLimit() bool {
+	if s.maxEntries > 0 && s.count > s.maxEntries {
+		return true
+	}
+
+	// always keep the newest entry, even if it alone is over budget
+	return s.maxBytes > 0 && s.bytes > s.maxBytes && s.lru.Len() > 1
+}
+
+// must be called with the lock held
+func (s *cacheShard) remove(item *cacheEntry) {
+	s.lru.Remove(item.element)
+	if item.index >= 0 {
+		heap.Remove(&s.expiry, item.index)
+	}
+	s.hash.Delete(item.key)
+	s.count--
+	s.bytes -= item.size
+}
+
+func (c *cacheStruct) Delete(key string) {
+	s := c.shard(key)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if item, exists := s.load(key); exists {
+		s.remove(item)
+	}
+}
+
+func (c *cacheStruct) Purge() error {
+	for _, s := range c.shards {
+		s.mutex.Lock()
+		s.hash.Clear()
+		s.lru.Init()
+		s.expiry = nil
+		s.count = 0
+		s.bytes = 0
+		s.mutex.Unlock()
+	}
+
+	return nil
+}
+
+// entries looked at per shard for OldestAgeSeconds
+const cacheStatsSample = 32
+
+func (c *cacheStruct) Stats() CacheStats {
+	stats := CacheStats{
+		Hits:          c.hits.Load(),
+		StaleHits:     c.staleHits.Load(),
+		Misses:        c.misses.Load(),
+		Sets:          c.sets.Load(),
+		Expired:       c.expired.Load(),
+		ExpiredOnRead: c.expiredOnRead.Load(),
+		Evictions:     c.evictions.Load(),
+	}
+
+	// The lru lists only know what was set last, not hit last, so the
+	// oldest is guessed from a few entries at the back of each; looking
+	// through everything would take too long on every scrape.
+	now := time.Now()
+	for _, s := range c.shards {
+		s.mutex.Lock()
+		stats.Entries += s.count
+		stats.Bytes += s.bytes
+
+		e := s.lru.Back()
+		for i := 0; e != nil && i < cacheStatsSample; i++ {
+			age := now.Sub(e.Value.(*cacheEntry).lastUsed()).Seconds()
+			if age > stats.OldestAgeSeconds {
+				stats.OldestAgeSeconds = age
+			}
+			e = e.Prev()
+		}
+		s.mutex.Unlock()
+	}
+
+	return stats
+}
+
+// How many entries there are, without the rest of Stats
+func (c *cacheStruct) entries() int {
+	n := 0
+	for _, s := range c.shards {
+		s.mutex.Lock()
+		n += s.count
+		s.mutex.Unlock()
+	}
+
+	return n
+}
+
+// Stops the cleaner, and waits for it if it's in the middle of a cleanup.
+func (c *cacheStruct) Close() error {
+	c.stop()
+	<-c.stopped
+
+	return nil
+}
+
+// Implemented by caches whose TTL policy can be changed while running
+type cacheReloader interface {
+	reload(opts cacheOptions)
+}
+
+// Entries set from now on get the TTL policy from opts; those already
+// cached keep theirs. The size limits can't change.
+func (c *cacheStruct) reload(opts cacheOptions) {
+	old := c.opts.Load()
+	opts.maxEntries, opts.maxBytes, opts.shards = old.maxEntries, old.maxBytes, old.shards
+	c.opts.Store(&opts)
+
+	if opts.cleanupInterval != old.cleanupInterval {
+		c.setCleanupInterval(opts.cleanupInterval)
+	}
+}
+
+// Changes how often the cleaner runs, from the next run on.
+func (c *cacheStruct) setCleanupInterval(interval time.Duration) {
+	select {
+	case c.interval <- interval:
+	case <-c.stopped:
+	}
+}
+
+// Removes the entries that are due to expire, returning how many there were.
+// An entry that was hit since it was scheduled isn't actually expired yet,
+// so it's rescheduled instead.
+func (s *cacheShard) cleanup(now time.Time) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	removed := 0
+	for s.expiry.Len() > 0 && s.expiry[0].due <= now.UnixNano() {
+		item := s.expiry[0]
+
+		if !item.expired(now) {
+			item.due = item.expiresAt()
+			heap.Fix(&s.expiry, 0)
+			continue
+		}
+
+		slog.Debug("Cache entry expired", "key", item.key)
+		s.remove(item)
+		removed++
+	}
+
+	return removed
+}
+
+func (c *cacheStruct) cleanup() {
+	now := time.Now()
+
+	slog.Debug("Cleaning up cache", "entries", c.entries())
+	for _, s := range c.shards {
+		c.expired.Add(uint64(s.cleanup(now)))
+	}
+}
+
+// Runs in a separate goroutine until ctx is done.
+func (c *cacheStruct) cleaner(ctx context.Context) {
+	defer close(c.stopped)
+
+	ticker := time.NewTicker(c.opts.Load().cleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case interval := <-c.interval:
+			ticker.Reset(interval)
+		case <-ticker.C:
+			c.cleanup()
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// True if the client asked for answers to be worked out again rather than
+// taken from the cache, with nocache=1 or Cache-Control: no-cache. Like
+// negotiate, this only looks in the body if it's already been parsed.
+func wantsFresh(r *http.Request) bool {
+	query := r.URL.Query()
+	if r.Form != nil {
+		query = r.Form
+	}
+
+	if query.Has("nocache") {
+		fresh, err := strconv.ParseBool(query.Get("nocache"))
+		return fresh || err != nil // a bare ?nocache counts
+	}
+
+	for _, directive := range strings.Split(r.Header.Get("Cache-Control"), ",") {
+		if strings.EqualFold(strings.TrimSpace(directive), "no-cache") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func init() {
+	registerMetrics(cacheMetrics)
+	registerReload(reloadCachePolicy, "cache-ttl", "cache-ttl-op", "cache-ttl-jitter", "cache-expiry", "cache-expiry-op",
+		"cache-stale-op", "cache-negative-ttl", "cache-cleanup-interval")
+}
+
+// Applies changed TTLs to answers cached from now on.
+func reloadCachePolicy() error {
+	opts, err := cacheOptionsFromFlags()
+	if err != nil {
+		return err
+	}
+
+	negativeCaching.Store(opts.negativeTTL > 0)
+
+	reloader, ok := baseCache(cache).(cacheReloader)
+	if !ok {
+		slog.Warn("Cache backend keeps its TTLs until restarted", "backend", *cacheBackendFlag)
+		return nil
+	}
+
+	reloader.reload(opts)
+	return nil
+}
+
+func cacheMetrics() []metricValue {
+	stats := cache.Stats()
+
+	hitRatio := 0.0
+	if stats.Hits+stats.Misses > 0 {
+		hitRatio = float64(stats.Hits) / float64(stats.Hits+stats.Misses)
+	}
+
+	return []metricValue{
+		{"http_math_cache_hits_total", "Answers found in the cache.", "counter", float64(stats.Hits)},
+		{"http_math_cache_stale_hits_total", "Answers served stale from the cache while a fresh one was worked out.", "counter", float64(stats.StaleHits)},
+		{"http_math_cache_misses_total", "Answers not found in the cache, including expired ones.", "counter", float64(stats.Misses)},
+		{"http_math_cache_hit_ratio", "Hits out of all cache lookups so far.", "gauge", hitRatio},
+		{"http_math_cache_sets_total", "Answers stored in the cache.", "counter", float64(stats.Sets)},
+		{"http_math_cache_expired_total", "Cache entries that expired.", "counter", float64(stats.Expired)},
+		{"http_math_cache_expired_on_read_total", "Cache entries found expired when asked for.", "counter", float64(stats.ExpiredOnRead)},
+		{"http_math_cache_evictions_total", "Cache entries evicted to stay within limits.", "counter", float64(stats.Evictions)},
+		{"http_math_cache_entries", "Entries in the cache.", "gauge", float64(stats.Entries)},
+		{"http_math_cache_bytes", "Approximate memory used by the cache.", "gauge", float64(stats.Bytes)},
+	}
+}
+
+// JSON data for /cache/stats
+type statsResponse struct {
+	CacheStats
+	Latency []opLatency `json:"latency"`
+}
+
+// GET /cache/stats shows how the answer cache is doing
+func doCacheStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Usage: curl http://localhost:8080/cache/stats", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeData(w, r, http.StatusOK, statsResponse{cache.Stats(), latencies.stats()})
+}
+
+// DELETE /cache empties the cache. Admin only.
+func doCachePurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", http.MethodDelete)
+		http.Error(w, "Usage: curl -X DELETE -H 'Authorization: Bearer TOKEN' http://localhost:8080/cache",
+			http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := cache.Purge()
+	if err != nil {
+		httpFail(w, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Cache purged")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DELETE /cache/{OP}/{X}/{Y} forgets one answer, and so does DELETE
+// /cache/{KEY} with a question string like "add;1;2". Admin only.
+func doCacheKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", http.MethodDelete)
+		http.Error(w, "Usage: curl -X DELETE -H 'Authorization: Bearer TOKEN' http://localhost:8080/cache/{OP}/{X}/{Y}",
+			http.StatusMethodNotAllowed)
+		return
+	}
+
+	segments := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/cache/"), "/")
+	for i, segment := range segments {
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil {
+			httpFail(w, err)
+			return
+		}
+		segments[i] = unescaped
+	}
+
+	key := segments[0]
+	if len(segments) > 1 || r.URL.RawQuery != "" {
+		x, y, err := getXY(r, nil, segments[1:])
+		if err != nil {
+			httpFail(w, err)
+			return
+		}
+
+		key = questionKey(segments[0], x, y)
+	}
+
+	if key == "" {
+		http.Error(w, "Missing cache key", http.StatusBadRequest)
+		return
+	}
+
+	cache.Delete(key)
+
+	slog.InfoContext(r.Context(), "Cache entry deleted", "key", key)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// The memory cache's entries, for /cache/export and /cache/import
+func cacheDumper() (cachePersister, error) {
+	persister, ok := baseCache(cache).(cachePersister)
+	if !ok {
+		return nil, fmt.Errorf("Export and import aren't supported by -cache-backend=%s", *cacheBackendFlag)
+	}
+
+	return persister, nil
+}
+
+// GET /cache/export dumps every cached answer as JSON, with how long each
+// has left, for /cache/import on another instance. Admin only.
+func doCacheExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Usage: curl -H 'Authorization: Bearer TOKEN' http://localhost:8080/cache/export",
+			http.StatusMethodNotAllowed)
+		return
+	}
+
+	persister, err := cacheDumper()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+
+	saved := persister.dump()
+	if saved == nil {
+		saved = []savedCacheEntry{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="http-math-cache.json"`)
+	json.NewEncoder(w).Encode(saved)
+
+	slog.InfoContext(r.Context(), "Cache exported", "entries", len(saved))
+}
+
+// POST /cache/import adds the answers from a /cache/export, keeping their
+// TTLs. Admin only.
+func doCacheImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Usage: curl -X POST -H 'Authorization: Bearer TOKEN' --data-binary @export.json http://localhost:8080/cache/import",
+			http.StatusMethodNotAllowed)
+		return
+	}
+
+	persister, err := cacheDumper()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+
+	var saved []savedCacheEntry
+	err = json.NewDecoder(r.Body).Decode(&saved)
+	if httpTooLarge(w, err) {
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid export: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	persister.restore(saved)
+
+	slog.InfoContext(r.Context(), "Cache imported", "entries", len(saved))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// With -cache-file, the memory cache is written out when the server shuts
+// down gracefully and read back in when it starts, so a restart doesn't
+// throw away a warm cache. Entries that expired in the meantime are dropped
+// on load.
+
+var cacheFileFlag = flag.String("cache-file", "", "file to save the memory cache to on shutdown and load it from on startup (disabled if empty)")
+
+// Implemented by caches that can be saved with -cache-file, or exported
+// and imported with /cache/export and /cache/import
+type cachePersister interface {
+	save(path string) error
+	load(path string) error
+	dump() []savedCacheEntry
+	restore(saved []savedCacheEntry)
+}
+
+// JSON data for one saved entry. The TTL isn't saved in -cache-file;
+// whatever policy is in effect at load time applies. Exports include what's
+// left of it, so an import keeps it.
+type savedCacheEntry struct {
+	Key    string    `json:"key"`
+	Answer float64   `json:"answer"`
+	Error  string    `json:"error,omitempty"`
+	Set    time.Time `json:"set"`
+	Time   time.Time `json:"time"`                  // last used
+	TTL    *float64  `json:"ttl_seconds,omitempty"` // left until it's stale; nil if it never is
+}
+
+// Every entry, most recently used first.
+func (c *cacheStruct) dump() []savedCacheEntry {
+	now := time.Now()
+
+	var saved []savedCacheEntry
+	for _, s := range c.shards {
+		s.mutex.Lock()
+		for e := s.lru.Front(); e != nil; e = e.Next() {
+			item := e.Value.(*cacheEntry)
+			entry := savedCacheEntry{Key: item.key, Answer: item.value.answer, Error: item.value.err,
+				Set: item.value.set, Time: item.lastUsed()}
+			if item.ttl > 0 {
+				left := max(item.ttl-now.Sub(item.lastUsed()), 0).Seconds()
+				entry.TTL = &left
+			}
+			saved = append(saved, entry)
+		}
+		s.mutex.Unlock()
+	}
+
+	// the lists are only roughly in order, and not between shards
+	sort.SliceStable(saved, func(a, b int) bool {
+		return saved[a].Time.After(saved[b].Time)
+	})
+
+	return saved
+}
+
+// Adds saved entries, replacing any with the same keys. Those with a TTL
+// keep it instead of getting the current policy's.
+func (c *cacheStruct) restore(saved []savedCacheEntry) {
+	now := time.Now()
+
+	// oldest first, so each one pushed to the front ends up in the right
+	// place, and the limits evict the oldest
+	for i := len(saved) - 1; i >= 0; i-- {
+		value := cachedAnswer{answer: saved[i].Answer, err: saved[i].Error, set: saved[i].Set}
+		entry := c.newEntry(saved[i].Key, value, saved[i].Time)
+		if saved[i].TTL != nil {
+			left := time.Duration(*saved[i].TTL * float64(time.Second))
+			entry.ttl = max(now.Sub(saved[i].Time)+left, 1) // 0 would be never
+			entry.due = entry.expiresAt()
+		}
+		if entry.expired(now) {
+			continue
+		}
+
+		s := c.shard(entry.key)
+		s.mutex.Lock()
+		if old, exists := s.load(entry.key); exists {
+			s.remove(old)
+		}
+		s.add(entry)
+		s.mutex.Unlock()
+	}
+}
+
+// Entries are saved most recently used first. The file is written next to
+// path and renamed over it, so a crash halfway doesn't leave half a cache.
+func (c *cacheStruct) save(path string) error {
+	saved := c.dump()
+	for i := range saved {
+		saved[i].TTL = nil // the policy at load time applies
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // fails harmlessly once renamed
+
+	err = json.NewEncoder(tmp).Encode(saved)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// Loads entries saved by save. A missing file isn't an error; there's just
+// nothing to load the first time.
+func (c *cacheStruct) load(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var saved []savedCacheEntry
+	err = json.NewDecoder(f).Decode(&saved)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	c.restore(saved)
+
+	return nil
+}
+
+// Loads the cache from -cache-file, if it's set.
+func loadCacheFile() error {
+	if *cacheFileFlag == "" {
+		return nil
+	}
+
+	persister, ok := baseCache(cache).(cachePersister)
+	if !ok {
+		return fmt.Errorf("-cache-file isn't supported by -cache-backend=%s", *cacheBackendFlag)
+	}
+
+	return persister.load(*cacheFileFlag)
+}
+
+// Saves the cache to -cache-file, if it's set.
+func saveCacheFile() error {
+	if *cacheFileFlag == "" {
+		return nil
+	}
+
+	persister, ok := baseCache(cache).(cachePersister)
+	if !ok {
+		return nil // already complained about at startup
+	}
+
+	return persister.save(*cacheFileFlag)
+}
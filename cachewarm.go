@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// With -cache-warm, questions listed in a JSON file are answered at startup,
+// before any requests are taken, so the first requests after a deploy don't
+// all miss. Each entry is an item like the ones for /batch; one with an
+// answer already in it is cached as it is instead of being worked out.
+//
+//	[{"op": "add", "x": 1, "y": 2}, {"op": "divide", "x": 1, "y": 3, "answer": 0.333}]
+
+var cacheWarmFlag = flag.String("cache-warm", "", "JSON file of questions to answer into the cache at startup (disabled if empty)")
+
+type warmItem struct {
+	jobItem
+	Answer *float64 `json:"answer"`
+}
+
+func warmCache(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var items []warmItem
+	err = json.Unmarshal(data, &items)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	failed := 0
+	for _, item := range items {
+		if item.Answer != nil {
+			cache.Set(context.Background(), questionKey(item.Op, item.X, item.Y), cachedAnswer{answer: *item.Answer})
+			continue
+		}
+
+		_, _, err = getAnswer(context.Background(), item.Op, item.X, item.Y, false)
+		if err != nil {
+			failed++
+		}
+	}
+
+	slog.Info("Warmed cache", "answers", len(items)-failed, "path", path, "failed", failed)
+
+	return nil
+}
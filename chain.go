@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// JSON data for a /chain request. Each step's answer becomes the x of the
+// next step, so only the first x is supplied by the client.
+type chainRequest struct {
+	X     float64     `json:"x"`
+	Steps []chainStep `json:"steps"`
+}
+
+type chainStep struct {
+	Op string  `json:"op"`
+	Y  float64 `json:"y"`
+}
+
+// JSON data for responding to a /chain request
+type chainResponse struct {
+	X      float64    `json:"x"`
+	Steps  []response `json:"steps"`
+	Answer float64    `json:"answer"`
+}
+
+const chainMaxSteps = 100
+
+func doChain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Usage: curl -X POST http://localhost:8080/chain "+
+			`-d '{"x": X, "steps": [{"op": OP, "y": Y}, ...]}'`,
+			http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req chainRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpFail(w, fmt.Errorf("Invalid chain request: %w", err))
+		return
+	}
+
+	if len(req.Steps) == 0 {
+		httpFail(w, errors.New("Chain has no steps"))
+		return
+	}
+	if len(req.Steps) > chainMaxSteps {
+		httpFail(w, fmt.Errorf("Chain has too many steps (max %d)", chainMaxSteps))
+		return
+	}
+
+	err = spendQuota(r.Context(), len(req.Steps))
+	if err != nil {
+		httpFail(w, err)
+		return
+	}
+
+	data := chainResponse{
+		X:     req.X,
+		Steps: make([]response, 0, len(req.Steps)),
+	}
+
+	client := clientID(r, nil)
+	fresh := wantsFresh(r)
+
+	x := req.X
+	for i, step := range req.Steps {
+		step.Op = canonicalOp(step.Op)
+
+		if err := deadlineError(r); err != nil {
+			httpTimedOut(w, err)
+			return
+		}
+
+		answer, hit, err := getAnswer(r.Context(), step.Op, x, step.Y, fresh)
+		if err != nil {
+			httpFail(w, fmt.Errorf("Step %d: %w", i+1, err))
+			return
+		}
+
+		data.Steps = append(data.Steps, newResponse(step.Op, x, step.Y, answer, hit))
+
+		history.add(client, historyEntry{
+			Time:   time.Now(),
+			Action: step.Op,
+			X:      x,
+			Y:      step.Y,
+			Answer: answer,
+			Cached: hit.cached,
+		})
+
+		x = answer
+	}
+	data.Answer = x
+
+	writeData(w, r, http.StatusOK, data)
+}
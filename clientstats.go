@@ -0,0 +1,165 @@
+package main
+
+import (
+	"cmp"
+	"container/list"
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Usage is counted per client (as clientID has them, without sessions):
+// requests, the ones that failed, and how many of their answers came from
+// the cache, so we can see who the noisy ones are at /stats/clients. Like
+// history, only so many clients are kept; the one seen longest ago makes
+// way for a new one.
+
+const clientStatsMaxClients = 10000
+
+// JSON data for one client's usage
+type clientUsage struct {
+	Client    string    `json:"client"`
+	Requests  uint64    `json:"requests"`
+	Errors    uint64    `json:"errors"` // 4xx and 5xx responses
+	Answers   uint64    `json:"answers"`
+	CacheHits uint64    `json:"cache_hits"`
+	HitRate   float64   `json:"cache_hit_rate"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+
+	element *list.Element // this client's place in clientStatsStruct.lru
+}
+
+type clientStatsStruct struct {
+	hash  map[string]*clientUsage
+	lru   *list.List // of *clientUsage, seen most recently at the front
+	mutex sync.Mutex
+}
+
+var clientStats = &clientStatsStruct{hash: map[string]*clientUsage{}, lru: list.New()}
+
+// Returns client's usage, as just seen. must hold the mutex
+func (s *clientStatsStruct) get(client string) *clientUsage {
+	usage, exists := s.hash[client]
+	if exists {
+		s.lru.MoveToFront(usage.element)
+		return usage
+	}
+
+	if len(s.hash) >= clientStatsMaxClients {
+		oldest := s.lru.Remove(s.lru.Back()).(*clientUsage)
+		delete(s.hash, oldest.Client)
+	}
+
+	now := time.Now()
+	usage = &clientUsage{Client: client, FirstSeen: now, LastSeen: now}
+	usage.element = s.lru.PushFront(usage)
+	s.hash[client] = usage
+
+	return usage
+}
+
+func (s *clientStatsStruct) requested(client string, status int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	usage := s.get(client)
+	usage.Requests++
+	if status >= 400 {
+		usage.Errors++
+	}
+	usage.LastSeen = time.Now()
+}
+
+func (s *clientStatsStruct) answered(client string, cached bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	usage := s.get(client)
+	usage.Answers++
+	if cached {
+		usage.CacheHits++
+	}
+	usage.LastSeen = time.Now()
+}
+
+// The busiest clients first, up to limit of them
+func (s *clientStatsStruct) top(limit int) []clientUsage {
+	s.mutex.Lock()
+	usages := make([]clientUsage, 0, len(s.hash))
+	for _, usage := range s.hash {
+		usages = append(usages, *usage)
+	}
+	s.mutex.Unlock()
+
+	slices.SortFunc(usages, func(a, b clientUsage) int {
+		return cmp.Or(cmp.Compare(b.Requests, a.Requests), cmp.Compare(b.Answers, a.Answers),
+			strings.Compare(a.Client, b.Client))
+	})
+
+	usages = usages[:min(limit, len(usages))]
+	for i := range usages {
+		if usages[i].Answers > 0 {
+			usages[i].HitRate = float64(usages[i].CacheHits) / float64(usages[i].Answers)
+		}
+	}
+
+	return usages
+}
+
+type clientKey struct{}
+
+// Says who's asking, in computations made for them (for the audit log and
+// usage statistics).
+func clientContext(ctx context.Context, client string) context.Context {
+	return context.WithValue(ctx, clientKey{}, client)
+}
+
+// who's asking; "internal" when it's us
+func requestClient(ctx context.Context) string {
+	client, ok := ctx.Value(clientKey{}).(string)
+	if !ok {
+		return "internal"
+	}
+	return client
+}
+
+// withClient works out who's asking, for what comes after, and counts the
+// request against them.
+func withClient(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := clientID(r, nil)
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(clientContext(r.Context(), client)))
+
+		clientStats.requested(client, sw.statusCode())
+	})
+}
+
+// GET /stats/clients lists the busiest clients, up to limit of them. Admin
+// only.
+func doClientStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Usage: curl -H 'Authorization: Bearer TOKEN' http://localhost:8080/stats/clients[?limit=N]",
+			http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := defaultPageLimit
+	if strVal := r.FormValue("limit"); strVal != "" {
+		val, err := strconv.Atoi(strVal)
+		if err != nil || val < 1 || val > maxPageLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxPageLimit), http.StatusBadRequest)
+			return
+		}
+		limit = val
+	}
+
+	writeData(w, r, http.StatusOK, clientStats.top(limit))
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"net/http"
+	"sync/atomic"
+)
+
+// With -max-in-flight, only so many requests are worked on at once; the
+// rest get a 503 straight away rather than piling up goroutines and memory
+// until everything's slow. Health checks, scrapes and log streams (which
+// stay open) don't count, and are never turned away.
+
+var maxInFlightFlag = flag.Int("max-in-flight", 0, "most requests to work on at once; more get a 503 (0 for no limit)")
+
+// the limit, or 0
+var maxInFlight atomic.Int64
+
+// requests holding a slot
+var slotsInUse atomic.Int64
+
+var overloaded = newCounterVec("http_math_overloaded_total",
+	"Requests turned away by -max-in-flight")
+
+var concurrencyExemptPaths = map[string]bool{
+	"/healthz":           true,
+	"/readyz":            true,
+	"/metrics":           true,
+	"/admin/logs/stream": true,
+}
+
+func init() {
+	registerReload(loadMaxInFlight, "max-in-flight")
+	registerMetrics(func() []metricValue {
+		return []metricValue{
+			{"http_math_in_flight_limit", "The -max-in-flight limit, or 0 for none.", "gauge", float64(maxInFlight.Load())},
+		}
+	})
+}
+
+func loadMaxInFlight() error {
+	if *maxInFlightFlag < 0 {
+		return errors.New("-max-in-flight can't be negative")
+	}
+
+	maxInFlight.Store(int64(*maxInFlightFlag))
+	return nil
+}
+
+func withConcurrencyLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := maxInFlight.Load()
+		if limit == 0 || concurrencyExemptPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		defer slotsInUse.Add(-1)
+		if slotsInUse.Add(1) > limit {
+			overloaded.add(1)
+			w.Header().Set("Retry-After", "1")
+			httpErrorCode(w, http.StatusServiceUnavailable, "overloaded", "Too busy; try again shortly")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Settings come from, in order of precedence:
+//
+//  1. the command line
+//  2. the environment, as HTTPMATH_ and the flag's name in upper case with
+//     dashes as underscores: -cache-ttl is HTTPMATH_CACHE_TTL
+//  3. the -config file (see configfile.go), which may itself be given in
+//     the environment as HTTPMATH_CONFIG
+//  4. the flags' defaults
+//
+// loadConfig merges them at startup, and reloadConfig again on reload (for
+// the settings that can change). The effective settings are logged at
+// startup, with secrets redacted; -print-config prints them all and exits.
+
+const envPrefix = "HTTPMATH_"
+
+var printConfigFlag = flag.Bool("print-config", false, "print every setting with where it came from, then exit")
+
+func init() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintf(flag.CommandLine.Output(), "\nEvery flag can also be set with an environment variable, e.g. %s for -cache-ttl.\n",
+			envName("cache-ttl"))
+	}
+}
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// A flag's value from somewhere other than the command line
+type flagSetting struct {
+	name   string
+	value  string
+	source string // where it came from, for errors
+}
+
+// the flags given on the command line, which nothing else overrides
+var commandLineFlags map[string]bool
+
+// where each flag that isn't at its default got its value
+var flagSources = map[string]string{}
+
+// Sets flags that weren't on the command line from the environment and
+// -config. Call it after flag.Parse.
+func loadConfig() error {
+	commandLineFlags = setFlagNames()
+	for name := range commandLineFlags {
+		flagSources[name] = "command line"
+	}
+
+	settings, err := layeredSettings()
+	if err != nil {
+		return err
+	}
+
+	return setFlags(settings, nil)
+}
+
+// Every setting from the environment and -config, by precedence, leaving out
+// those on the command line. Sorted by name.
+func layeredSettings() ([]flagSetting, error) {
+	env := envSettings()
+
+	path := *configFlag
+	for _, setting := range env {
+		if setting.name == "config" && !commandLineFlags["config"] {
+			path = setting.value
+		}
+	}
+
+	merged := map[string]flagSetting{}
+	if path != "" {
+		file, err := configFileSettings(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, setting := range file {
+			merged[setting.name] = setting
+		}
+	}
+	for _, setting := range env {
+		merged[setting.name] = setting
+	}
+
+	var settings []flagSetting
+	flag.VisitAll(func(f *flag.Flag) {
+		setting, exists := merged[f.Name]
+		if exists && !commandLineFlags[f.Name] {
+			settings = append(settings, setting)
+		}
+	})
+
+	return settings, nil
+}
+
+// The flags that have been set so far, one way or another
+func setFlagNames() map[string]bool {
+	names := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		names[f.Name] = true
+	})
+
+	return names
+}
+
+func envSettings() []flagSetting {
+	var settings []flagSetting
+	flag.VisitAll(func(f *flag.Flag) {
+		value, exists := os.LookupEnv(envName(f.Name))
+		if exists {
+			settings = append(settings, flagSetting{f.Name, value, envName(f.Name)})
+		}
+	})
+
+	return settings
+}
+
+// Sets each flag in settings, except those in skip.
+func setFlags(settings []flagSetting, skip map[string]bool) error {
+	for _, setting := range settings {
+		if skip[setting.name] {
+			continue
+		}
+
+		err := flag.Set(setting.name, setting.value)
+		if err != nil {
+			return fmt.Errorf("%s: invalid %s %q: %v", setting.source, setting.name, setting.value, err)
+		}
+
+		if setting.value == flag.Lookup(setting.name).DefValue {
+			delete(flagSources, setting.name)
+		} else {
+			flagSources[setting.name] = setting.source
+		}
+	}
+
+	return nil
+}
+
+// flags that hold secrets, which aren't shown
+var secretFlagWords = []string{"token", "secret", "password", "api-keys", "basic-auth-users", "hmac-keys"}
+
+// A flag's value, fit to show: secrets are redacted, and so are passwords
+// in URLs.
+func displayFlagValue(f *flag.Flag) string {
+	value := f.Value.String()
+	if value == "" {
+		return value
+	}
+
+	for _, word := range secretFlagWords {
+		if strings.Contains(f.Name, word) {
+			return "[redacted]"
+		}
+	}
+
+	if u, err := url.Parse(value); err == nil && u.User != nil {
+		return u.Redacted()
+	}
+
+	return value
+}
+
+// Logs every setting that isn't at its default.
+func logConfig() {
+	flag.VisitAll(func(f *flag.Flag) {
+		source, changed := flagSources[f.Name]
+		if changed {
+			slog.Info("Config", "name", f.Name, "value", displayFlagValue(f), "source", source)
+		}
+	})
+}
+
+// Writes out every setting, for -print-config.
+func printConfig(w io.Writer) {
+	flag.VisitAll(func(f *flag.Flag) {
+		source, changed := flagSources[f.Name]
+		if !changed {
+			source = "default"
+		}
+		fmt.Fprintf(w, "%s=%s (%s)\n", f.Name, displayFlagValue(f), source)
+	})
+}
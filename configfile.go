@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// -config reads settings from a YAML or TOML file (by its extension). Every
+// setting is a flag: sections are joined to the names inside them with
+// dashes, so
+//
+//	cache:
+//	  backend: memory
+//	  ttl: 60s
+//	  ttl-op:
+//	    add: 24h
+//	listen: [":8080", "unix:/run/http-math.sock"]
+//
+// or the same in TOML
+//
+//	listen = [":8080", "unix:/run/http-math.sock"]
+//	[cache]
+//	backend = "memory"
+//	ttl = "60s"
+//	[cache.ttl-op]
+//	add = "24h"
+//
+// is -cache-backend=memory -cache-ttl=60s -cache-ttl-op=add=24h
+// -listen=:8080,unix:/run/http-math.sock. Lists are joined with commas, and
+// the keys under a section named after an op=value flag become its ops.
+// Unknown settings and bad values are errors, with the line they're on.
+//
+// The command line and environment win over the file; see config.go. Some
+// settings can be changed without a restart; see reload.go.
+
+var configFlag = flag.String("config", "", "YAML (.yaml, .yml) or TOML (.toml) file to read settings from; see configfile.go")
+
+// One key from the file, with its path joined by dots
+type configSetting struct {
+	line   int
+	key    string
+	values []string // more than one for lists
+}
+
+// Reads path, returning the flags it sets.
+func configFileSettings(path string) ([]flagSetting, error) {
+	var settings []configSetting
+	var err error
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		settings, err = parseConfigFile(path, parseYAMLLine)
+	case ".toml":
+		settings, err = parseConfigFile(path, parseTOMLLine)
+	default:
+		return nil, fmt.Errorf("%s: unknown config format; use .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// gathered first, since op=value flags take several settings
+	var names []string
+	values := map[string][]string{}
+	lines := map[string]int{}
+
+	for _, setting := range settings {
+		name, prefix, err := configFlagName(setting.key)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, setting.line, err)
+		}
+
+		if _, seen := values[name]; !seen {
+			names = append(names, name)
+			lines[name] = setting.line
+		} else if prefix == "" {
+			return nil, fmt.Errorf("%s:%d: %s is set twice", path, setting.line, setting.key)
+		}
+
+		for _, value := range setting.values {
+			values[name] = append(values[name], prefix+value)
+		}
+	}
+
+	flagSettings := make([]flagSetting, 0, len(names))
+	for _, name := range names {
+		source := fmt.Sprintf("%s:%d", path, lines[name])
+		flagSettings = append(flagSettings, flagSetting{name, strings.Join(values[name], ","), source})
+	}
+
+	return flagSettings, nil
+}
+
+// The flag for a dotted key. Keys under an op=value flag's section are ops
+// of it, returned as prefix ("add=" for cache.ttl-op.add).
+func configFlagName(key string) (name string, prefix string, err error) {
+	segments := strings.Split(strings.ReplaceAll(key, "_", "-"), ".")
+
+	for i := len(segments); i > 0; i-- {
+		name = strings.Join(segments[:i], "-")
+		if flag.Lookup(name) == nil {
+			continue
+		}
+
+		if i < len(segments) {
+			prefix = strings.Join(segments[i:], ".") + "="
+		}
+		return name, prefix, nil
+	}
+
+	return "", "", fmt.Errorf("unknown setting %s", key)
+}
+
+// Keeps track of where a config file's parser is
+type configParser struct {
+	settings []configSetting
+	line     int
+	// YAML: the keys whose blocks we're in, innermost last. TOML: the table.
+	stack []configKey
+}
+
+type configKey struct {
+	indent int
+	path   string
+}
+
+func (p *configParser) add(key string, values []string) {
+	p.settings = append(p.settings, configSetting{p.line, key, values})
+}
+
+// Adds a YAML list item to the list's setting
+func (p *configParser) addItem(key string, value string) {
+	last := len(p.settings) - 1
+	if last >= 0 && p.settings[last].key == key {
+		p.settings[last].values = append(p.settings[last].values, value)
+		return
+	}
+
+	p.add(key, []string{value})
+}
+
+func parseConfigFile(path string, parseLine func(p *configParser, line string) error) ([]configSetting, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p := &configParser{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		p.line++
+
+		line := stripConfigComment(scanner.Text())
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		err := parseLine(p, line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, p.line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return p.settings, nil
+}
+
+// Drops a # comment, unless it's in quotes
+func stripConfigComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++ // an escaped quote isn't the end
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return strings.TrimRight(line[:i], " \t")
+		}
+	}
+
+	return line
+}
+
+// One YAML line: "key: value", "key:" starting a block, or "- item" in a
+// list. Only as much YAML as config needs is understood.
+func parseYAMLLine(p *configParser, line string) error {
+	if strings.ContainsRune(line, '\t') {
+		return fmt.Errorf("tabs aren't allowed in YAML; indent with spaces")
+	}
+
+	trimmed := strings.TrimLeft(line, " ")
+	indent := len(line) - len(trimmed)
+
+	if item, isItem := strings.CutPrefix(trimmed, "-"); isItem && (item == "" || item[0] == ' ') {
+		// a list may be indented as far as its key, or further
+		for len(p.stack) > 0 && p.stack[len(p.stack)-1].indent > indent {
+			p.stack = p.stack[:len(p.stack)-1]
+		}
+		if len(p.stack) == 0 {
+			return fmt.Errorf("list item outside of a setting")
+		}
+
+		value, err := parseConfigScalar(item)
+		if err != nil {
+			return err
+		}
+
+		p.addItem(p.stack[len(p.stack)-1].path, value)
+		return nil
+	}
+
+	for len(p.stack) > 0 && p.stack[len(p.stack)-1].indent >= indent {
+		p.stack = p.stack[:len(p.stack)-1]
+	}
+
+	key, rest, found := strings.Cut(trimmed, ":")
+	if !found || (rest != "" && rest[0] != ' ') {
+		return fmt.Errorf("expected key: value")
+	}
+
+	key = strings.TrimSpace(key)
+	if len(p.stack) > 0 {
+		key = p.stack[len(p.stack)-1].path + "." + key
+	}
+
+	rest = strings.TrimSpace(rest)
+	if rest == "" {
+		// a block follows
+		p.stack = append(p.stack, configKey{indent, key})
+		return nil
+	}
+
+	values, err := parseConfigValue(rest)
+	if err != nil {
+		return err
+	}
+
+	p.add(key, values)
+	return nil
+}
+
+// One TOML line: "[table]" or "key = value"
+func parseTOMLLine(p *configParser, line string) error {
+	line = strings.TrimSpace(line)
+
+	if strings.HasPrefix(line, "[") && !strings.HasPrefix(line, "[[") {
+		table, found := strings.CutSuffix(line[1:], "]")
+		table = strings.TrimSpace(table)
+		if !found || table == "" {
+			return fmt.Errorf("expected [table]")
+		}
+
+		p.stack = []configKey{{0, table}}
+		return nil
+	}
+
+	key, rest, found := strings.Cut(line, "=")
+	if !found {
+		return fmt.Errorf("expected key = value")
+	}
+
+	key = strings.TrimSpace(key)
+	if len(p.stack) > 0 {
+		key = p.stack[0].path + "." + key
+	}
+
+	values, err := parseConfigValue(strings.TrimSpace(rest))
+	if err != nil {
+		return err
+	}
+
+	p.add(key, values)
+	return nil
+}
+
+// A scalar, or a [list] of them on one line
+func parseConfigValue(value string) ([]string, error) {
+	inside, isList := strings.CutPrefix(value, "[")
+	if !isList {
+		scalar, err := parseConfigScalar(value)
+		return []string{scalar}, err
+	}
+
+	inside, found := strings.CutSuffix(inside, "]")
+	if !found {
+		return nil, fmt.Errorf("lists must be on one line: %s", value)
+	}
+
+	var values []string
+	var quote rune
+	start := 0
+	for i, c := range inside + "," {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			item := strings.TrimSpace(inside[start:min(i, len(inside))])
+			start = i + 1
+			if item == "" {
+				continue // trailing commas are fine
+			}
+
+			scalar, err := parseConfigScalar(item)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, scalar)
+		}
+	}
+
+	return values, nil
+}
+
+func parseConfigScalar(value string) (string, error) {
+	value = strings.TrimSpace(value)
+
+	switch {
+	case strings.HasPrefix(value, `"`):
+		unquoted, err := strconv.Unquote(value)
+		if err != nil {
+			return "", fmt.Errorf("bad quoted string %s", value)
+		}
+		return unquoted, nil
+	case strings.HasPrefix(value, "'"):
+		if len(value) < 2 || !strings.HasSuffix(value, "'") {
+			return "", fmt.Errorf("bad quoted string %s", value)
+		}
+		return value[1 : len(value)-1], nil
+	case strings.HasPrefix(value, "{"):
+		return "", fmt.Errorf("inline tables aren't supported; use a section")
+	}
+
+	return value, nil
+}
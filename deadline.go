@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Every request gets -handler-timeout to be answered. Answering one question
+// is quick, so it's the loops over many (batches, chains) that check for it,
+// between questions; they give up with a 503, or end a response that's
+// already streaming with an error.
+
+var handlerTimeoutFlag = flag.Duration("handler-timeout", 30*time.Second, "longest a request may take to answer, e.g. for a huge batch (0 for no limit)")
+
+func withDeadline(next http.Handler) http.Handler {
+	if *handlerTimeoutFlag <= 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), *handlerTimeoutFlag)
+		defer cancel()
+		ctx = context.WithValue(ctx, deadlineParentKey{}, r.Context())
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+type deadlineParentKey struct{}
+
+// For requests that go on for as long as the client wants, like streams: r
+// without the -handler-timeout deadline, and w without -write-timeout.
+func withoutDeadline(w http.ResponseWriter, r *http.Request) *http.Request {
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	if parent, ok := r.Context().Value(deadlineParentKey{}).(context.Context); ok {
+		return r.WithContext(parent)
+	}
+	return r
+}
+
+// An error if r has run out of time (or the client went away), nil if it
+// can go on.
+func deadlineError(r *http.Request) error {
+	switch r.Context().Err() {
+	case nil:
+		return nil
+	case context.DeadlineExceeded:
+		return fmt.Errorf("Request took longer than %v", *handlerTimeoutFlag)
+	}
+
+	return r.Context().Err()
+}
+
+func httpTimedOut(w http.ResponseWriter, err error) {
+	http.Error(w, err.Error(), http.StatusServiceUnavailable)
+}
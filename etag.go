@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// Answers are deterministic per question, so the question key, along with
+// the format it's written in, makes a good entity tag. It's weak because
+// the body also says whether the answer was cached, which can differ
+// between two otherwise identical responses.
+func etagFor(key string, format string) string {
+	sum := sha256.Sum256([]byte(key + "\n" + format))
+	return `W/"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// The format writeData will answer r in: the negotiated encoder's name, or
+// the JSONP callback. Empty if it'll be an error instead.
+func responseFormat(r *http.Request) string {
+	callback, err := jsonpCallback(r)
+	if err != nil {
+		return ""
+	}
+	if callback != "" {
+		return "jsonp:" + callback
+	}
+
+	enc, err := negotiate(r)
+	if err != nil {
+		return ""
+	}
+
+	return enc.name
+}
+
+// reports whether the request's If-None-Match header matches etag, using
+// the weak comparison RFC 9110 requires for If-None-Match
+func etagMatches(r *http.Request, etag string) bool {
+	header := r.Header.Get("If-None-Match")
+	if header == "" {
+		return false
+	}
+
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+
+		if strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"runtime"
+	"time"
+)
+
+// GET /debug/vars has the standard expvar variables (memstats), plus ours:
+// requests by operation, the cache's stats, goroutines and a summary of
+// garbage collection, for a quick look without a metrics stack.
+
+var requestsByOp = expvar.NewMap("requests_by_op")
+
+func init() {
+	expvar.Publish("cache", expvar.Func(func() any {
+		return cache.Stats()
+	}))
+	expvar.Publish("goroutines", expvar.Func(func() any {
+		return runtime.NumGoroutine()
+	}))
+	expvar.Publish("gc", expvar.Func(gcStats))
+}
+
+// JSON data for the gc variable
+type gcSummary struct {
+	NumGC        uint32  `json:"num_gc"`
+	PauseTotal   float64 `json:"pause_total_seconds"`
+	LastPause    float64 `json:"last_pause_seconds"`
+	LastGC       string  `json:"last_gc,omitempty"`
+	CPUFraction  float64 `json:"cpu_fraction"`
+	HeapAlloc    uint64  `json:"heap_alloc_bytes"`
+	NextGCTarget uint64  `json:"next_gc_bytes"`
+}
+
+func gcStats() any {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+
+	summary := gcSummary{
+		NumGC:        stats.NumGC,
+		PauseTotal:   time.Duration(stats.PauseTotalNs).Seconds(),
+		CPUFraction:  stats.GCCPUFraction,
+		HeapAlloc:    stats.HeapAlloc,
+		NextGCTarget: stats.NextGC,
+	}
+	if stats.NumGC > 0 {
+		summary.LastPause = time.Duration(stats.PauseNs[(stats.NumGC+255)%256]).Seconds()
+		summary.LastGC = time.Unix(0, int64(stats.LastGC)).UTC().Format(time.RFC3339Nano)
+	}
+
+	return summary
+}
+
+// Like expvar.Handler, but without cmdline, which could have -admin-token
+// and the like in it.
+func doExpvar(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Usage: curl http://localhost:8080/debug/vars", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	fmt.Fprintf(w, "{\n")
+	first := true
+	expvar.Do(func(kv expvar.KeyValue) {
+		if kv.Key == "cmdline" {
+			return
+		}
+
+		if !first {
+			fmt.Fprintf(w, ",\n")
+		}
+		first = false
+
+		fmt.Fprintf(w, "%q: %s", kv.Key, kv.Value)
+	})
+	fmt.Fprintf(w, "\n}\n")
+}
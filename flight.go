@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// A flightGroup makes sure only one of a set of identical computations runs
+// at a time. When a question isn't cached yet and lots of clients ask it at
+// once, the first one works it out and the rest wait for its answer.
+type flightGroup struct {
+	hash  map[string]*flightCall // by question string
+	mutex sync.Mutex
+}
+
+type flightCall struct {
+	done   chan struct{} // closed once answer and err are set
+	answer float64
+	err    error
+}
+
+var inFlight = newFlightGroup()
+
+func newFlightGroup() *flightGroup {
+	g := &flightGroup{}
+	g.hash = map[string]*flightCall{}
+
+	return g
+}
+
+// Runs fn, unless it's already running for key, in which case this waits
+// for that one and returns its result. If fn panics, the waiters get an
+// error and the panic carries on in the caller that ran it.
+func (g *flightGroup) do(key string, fn func() (float64, error)) (float64, error) {
+	g.mutex.Lock()
+	call, exists := g.hash[key]
+	if exists {
+		g.mutex.Unlock()
+
+		<-call.done
+		return call.answer, call.err
+	}
+
+	call = &flightCall{done: make(chan struct{})}
+	g.hash[key] = call
+	g.mutex.Unlock()
+
+	defer func() {
+		recovered := recover()
+		if recovered != nil {
+			call.err = fmt.Errorf("computation panicked: %v", recovered)
+		}
+
+		g.mutex.Lock()
+		delete(g.hash, key)
+		g.mutex.Unlock()
+
+		close(call.done)
+
+		if recovered != nil {
+			panic(recovered)
+		}
+	}()
+
+	call.answer, call.err = fn()
+	return call.answer, call.err
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// GET /healthz answers as long as the process is up, for liveness probes.
+// GET /readyz answers 200 only while we should be sent traffic: the cache
+// backend is reachable, and we're not shutting down (or anything else that
+// registered a readiness check objects). Otherwise it's 503, with what's
+// wrong.
+
+var shutdownDelayFlag = flag.Duration("shutdown-delay", 0, "how long to keep serving after a shutdown signal while /readyz fails, so load balancers stop sending traffic first")
+
+// One readiness check; it returns an error saying what's wrong, if anything.
+type readinessCheck struct {
+	name  string
+	check func() error
+}
+
+var readinessChecks []readinessCheck
+var readinessMutex sync.Mutex
+
+// set by stopOnSignal
+var shuttingDown atomic.Bool
+
+func registerReadiness(name string, check func() error) {
+	readinessMutex.Lock()
+	defer readinessMutex.Unlock()
+
+	readinessChecks = append(readinessChecks, readinessCheck{name, check})
+}
+
+// Implemented by cache backends that live somewhere that might be
+// unreachable
+type cachePinger interface {
+	ping() error
+}
+
+func init() {
+	registerReadiness("shutdown", func() error {
+		if shuttingDown.Load() {
+			return errShuttingDown
+		}
+		return nil
+	})
+
+	registerReadiness("cache", func() error {
+		pinger, ok := baseCache(cache).(cachePinger)
+		if !ok {
+			return nil
+		}
+		return pinger.ping()
+	})
+}
+
+var errShuttingDown = errors.New("Shutting down")
+
+// JSON data for /healthz and /readyz
+type healthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"` // failed ones, with why
+}
+
+func doHealthz(w http.ResponseWriter, r *http.Request) {
+	writeData(w, r, http.StatusOK, healthResponse{Status: "ok"})
+}
+
+func doReadyz(w http.ResponseWriter, r *http.Request) {
+	readinessMutex.Lock()
+	checks := readinessChecks
+	readinessMutex.Unlock()
+
+	failed := map[string]string{}
+	for _, c := range checks {
+		err := c.check()
+		if err != nil {
+			failed[c.name] = err.Error()
+		}
+	}
+
+	if len(failed) > 0 {
+		writeData(w, r, http.StatusServiceUnavailable, healthResponse{Status: "not ready", Checks: failed})
+		return
+	}
+
+	writeData(w, r, http.StatusOK, healthResponse{Status: "ready"})
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// JSON data for one remembered computation
+type historyEntry struct {
+	Seq    uint64    `json:"-"` // position in the client's history, for paging
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	X      float64   `json:"x"`
+	Y      float64   `json:"y"`
+	Answer float64   `json:"answer"`
+	Cached bool      `json:"cached"`
+}
+
+type clientHistory struct {
+	client  string
+	entries []historyEntry // ring buffer of the last historyMaxEntries
+	next    int            // where the next entry goes once the buffer is full
+	seq     uint64         // sequence number of the newest entry
+	element *list.Element  // its place in historyStruct.lru, for evicting idle clients
+}
+
+// The history store is kept separate from the answer cache: the cache is
+// keyed by question and shared by everyone, while history is per client.
+// Both dimensions are bounded so it can't grow without limit.
+type historyStruct struct {
+	hash  map[string]*clientHistory // keyed by client id
+	lru   *list.List                // of *clientHistory, most recently added to at the front
+	mutex sync.Mutex
+}
+
+const historyMaxEntries = 100
+const historyMaxClients = 10000
+
+var history *historyStruct
+
+func newHistoryStore() *historyStruct {
+	h := &historyStruct{}
+	h.hash = map[string]*clientHistory{}
+	h.lru = list.New()
+
+	return h
+}
+
+// Identifies who a computation belongs to: the session if there is one,
+// otherwise the client's certificate (with mutual TLS), otherwise the
+// subject of its JWT, otherwise its Basic auth user, otherwise the key it
+// signed with, otherwise its API key (by name), otherwise its address. An
+// X-API-Key that isn't one of ours says nothing about who's asking.
+func clientID(r *http.Request, sess *session) string {
+	if sess != nil {
+		return "session:" + sess.id
+	}
+
+	if subject := clientCertSubject(r); subject != "" {
+		return "cert:" + subject
+	}
+
+	if claims, ok := requestJWT(r.Context()); ok {
+		return "jwt:" + claims.Subject
+	}
+
+	if user, ok := basicAuthUser(r.Context()); ok {
+		return "user:" + user
+	}
+
+	if name, ok := signatureKeyName(r.Context()); ok {
+		return "hmac:" + name
+	}
+
+	if name, ok := apiKeyName(r.Context()); ok {
+		return "key:" + name
+	}
+
+	return "ip:" + clientIP(r)
+}
+
+func (h *historyStruct) add(client string, entry historyEntry) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	ch, exists := h.hash[client]
+	if exists {
+		h.lru.MoveToFront(ch.element)
+	} else {
+		if len(h.hash) >= historyMaxClients {
+			h.forget(h.lru.Back().Value.(*clientHistory))
+		}
+
+		ch = &clientHistory{client: client, entries: make([]historyEntry, 0, historyMaxEntries)}
+		ch.element = h.lru.PushFront(ch)
+		h.hash[client] = ch
+	}
+	ch.seq++
+	entry.Seq = ch.seq
+
+	if len(ch.entries) < historyMaxEntries {
+		ch.entries = append(ch.entries, entry)
+	} else {
+		ch.entries[ch.next] = entry
+		ch.next = (ch.next + 1) % historyMaxEntries
+	}
+}
+
+// Forgets client's history, like when their session ends, so whoever has
+// the session id next doesn't get it.
+func (h *historyStruct) remove(client string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if ch, exists := h.hash[client]; exists {
+		h.forget(ch)
+	}
+}
+
+// must be called with the mutex held
+func (h *historyStruct) forget(ch *clientHistory) {
+	h.lru.Remove(ch.element)
+	delete(h.hash, ch.client)
+}
+
+// Returns up to limit entries of a client's history that come after the
+// entry numbered after, oldest first. more says whether there are others
+// after those.
+func (h *historyStruct) get(client string, limit int, after uint64) ([]historyEntry, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	ret := []historyEntry{}
+
+	ch, exists := h.hash[client]
+	if !exists {
+		return ret, false
+	}
+
+	ordered := append(append([]historyEntry{}, ch.entries[ch.next:]...), ch.entries[:ch.next]...)
+	for _, entry := range ordered {
+		if entry.Seq <= after {
+			continue
+		}
+
+		if len(ret) == limit {
+			return ret, true
+		}
+		ret = append(ret, entry)
+	}
+
+	return ret, false
+}
+
+// JSON data for responding to /history
+type historyResponse struct {
+	Client  string         `json:"client"`
+	History []historyEntry `json:"history"`
+	Next    string         `json:"next,omitempty"`
+}
+
+// GET /history returns the caller's own history. ?session={ID} returns the
+// history of computations made within that session instead, if it's one of
+// the caller's. Long histories are paged; see pagination.go.
+func doHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var client string
+	if id := r.FormValue("session"); id != "" {
+		if !sessionIDPattern.MatchString(id) {
+			httpFail(w, errors.New("Invalid session id"))
+			return
+		}
+		_, err := sessions.get(id, clientID(r, nil), false)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		client = "session:" + id
+	} else {
+		client = clientID(r, nil)
+	}
+
+	limit, after, err := pageParams(r)
+	if err != nil {
+		httpFail(w, err)
+		return
+	}
+
+	entries, more := history.get(client, limit, after)
+
+	data := historyResponse{Client: client, History: entries}
+	if more {
+		data.Next = nextPageLink(r, entries[len(entries)-1].Seq)
+	}
+
+	writeData(w, r, http.StatusOK, data)
+}
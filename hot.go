@@ -0,0 +1,134 @@
+package main
+
+import (
+	"cmp"
+	"container/heap"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The questions asked most, for /stats/top: what's worth warming the cache
+// with, and how big it needs to be to hold what's asked often. There are
+// far too many questions to count them all, so only hotQuestionsTracked
+// counters are kept (the Space-Saving algorithm): a question that isn't
+// counted yet takes over the counter with the lowest count, and carries on
+// from there. Counts can be too high by up to the error given with them,
+// but a question asked more often than that is always there.
+
+const hotQuestionsTracked = 1000
+const defaultTopQuestions = 20
+
+// JSON data for one hot question
+type hotQuestion struct {
+	Question  string  `json:"question"`
+	Op        string  `json:"op"`
+	X         float64 `json:"x"`
+	Y         float64 `json:"y"`
+	Count     uint64  `json:"count"`
+	CacheHits uint64  `json:"cache_hits"`
+	Error     uint64  `json:"error"` // how much count could be over by
+	index     int     // in the heap
+}
+
+// a min-heap on count, so the counter to take over is on top
+type hotHeap []*hotQuestion
+
+func (h hotHeap) Len() int           { return len(h) }
+func (h hotHeap) Less(i, j int) bool { return h[i].Count < h[j].Count }
+func (h hotHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *hotHeap) Push(x any) {
+	q := x.(*hotQuestion)
+	q.index = len(*h)
+	*h = append(*h, q)
+}
+
+func (h *hotHeap) Pop() any {
+	old := *h
+	q := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return q
+}
+
+type hotQuestionsStruct struct {
+	hash  map[string]*hotQuestion // keyed by question
+	heap  hotHeap
+	mutex sync.Mutex
+}
+
+var hotQuestions = &hotQuestionsStruct{hash: map[string]*hotQuestion{}}
+
+// Counts a question being asked.
+func (h *hotQuestionsStruct) record(op string, x float64, y float64, cached bool) {
+	key := questionKey(op, x, y)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	q, exists := h.hash[key]
+	switch {
+	case exists:
+	case len(h.heap) < hotQuestionsTracked:
+		q = &hotQuestion{Question: key, Op: op, X: x, Y: y}
+		heap.Push(&h.heap, q)
+		h.hash[key] = q
+	default:
+		// take over the least asked one's counter
+		q = h.heap[0]
+		delete(h.hash, q.Question)
+		*q = hotQuestion{Question: key, Op: op, X: x, Y: y, Count: q.Count, Error: q.Count, index: q.index}
+		h.hash[key] = q
+	}
+
+	q.Count++
+	if cached {
+		q.CacheHits++
+	}
+	heap.Fix(&h.heap, q.index)
+}
+
+// The n most asked questions, most first
+func (h *hotQuestionsStruct) top(n int) []hotQuestion {
+	h.mutex.Lock()
+	questions := make([]hotQuestion, 0, len(h.heap))
+	for _, q := range h.heap {
+		questions = append(questions, *q)
+	}
+	h.mutex.Unlock()
+
+	slices.SortFunc(questions, func(a, b hotQuestion) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), strings.Compare(a.Question, b.Question))
+	})
+
+	return questions[:min(n, len(questions))]
+}
+
+// GET /stats/top?n=N lists the N questions asked most. It's an admin
+// endpoint, since the questions are other clients' operands.
+func doTopQuestions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Usage: curl http://localhost:8080/stats/top[?n=N]", http.StatusMethodNotAllowed)
+		return
+	}
+
+	n := defaultTopQuestions
+	if strVal := r.FormValue("n"); strVal != "" {
+		val, err := strconv.Atoi(strVal)
+		if err != nil || val < 1 || val > hotQuestionsTracked {
+			http.Error(w, fmt.Sprintf("n must be between 1 and %d", hotQuestionsTracked), http.StatusBadRequest)
+			return
+		}
+		n = val
+	}
+
+	writeData(w, r, http.StatusOK, hotQuestions.top(n))
+}
@@ -0,0 +1,55 @@
+//go:build http3
+
+package main
+
+// HTTP/3 needs quic-go, so it is only compiled in with: go build -tags http3
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+var http3Addr = flag.String("http3-addr", "", "UDP address for an HTTP/3 (QUIC) listener, e.g. :8443 (disabled if empty)")
+var http3Cert = flag.String("http3-cert", "", "TLS certificate file for the HTTP/3 listener")
+var http3Key = flag.String("http3-key", "", "TLS key file for the HTTP/3 listener")
+
+func init() {
+	startHTTP3 = serveHTTP3
+}
+
+// Serves handler over QUIC in the background, and returns a handler for the
+// TCP listeners that advertises the QUIC listener with Alt-Svc.
+func serveHTTP3(handler http.Handler) http.Handler {
+	if *http3Addr == "" {
+		return handler
+	}
+
+	if *http3Cert == "" || *http3Key == "" {
+		fatal("-http3-addr requires -http3-cert and -http3-key")
+	}
+
+	server := &http3.Server{
+		Addr:    *http3Addr,
+		Handler: handler,
+	}
+
+	onShutdown(func(ctx context.Context) {
+		server.Shutdown(ctx)
+	})
+
+	go func() {
+		slog.Info("Running HTTP/3 server", "addr", *http3Addr)
+
+		err := server.ListenAndServeTLS(*http3Cert, *http3Key)
+		slog.Error("HTTP/3 server stopped", "err", err)
+	}()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.SetQUICHeaders(w.Header())
+		handler.ServeHTTP(w, r)
+	})
+}
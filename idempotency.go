@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Clients with retry logic send the same Idempotency-Key on every attempt of
+// a POST. The first attempt is computed normally and its response recorded;
+// retries get the recorded response replayed instead of a fresh computation.
+// Keys belong to whoever sent them (as the rate limiter knows them), so one
+// client can't get another's response by guessing its key. Responses too
+// big to keep, or streamed as they're worked out, aren't recorded, and a
+// retry of one is computed again. Past idempotencyMaxKeys keys, or
+// idempotencyMaxClientKeys for one client, the oldest are forgotten.
+const idempotencyHeader = "Idempotency-Key"
+
+const idempotencyExpireSeconds = 24 * 60 * 60
+const idempotencyCleanupInterval = 60
+
+// the biggest response body that's recorded
+const idempotencyMaxBody = 1 << 20
+
+const idempotencyMaxKeys = 100000
+const idempotencyMaxClientKeys = 1000
+
+type idempotentResponse struct {
+	key           string
+	client        string
+	element       *list.Element     // its place in idempotencyStruct.order
+	clientElement *list.Element     // and in its client's
+	fingerprint   [sha256.Size]byte // method, path, query and body of the original request
+	done          bool              // false while the original request is still running
+	status        int
+	header        http.Header
+	body          []byte
+	time          time.Time
+}
+
+type idempotencyStruct struct {
+	hash    map[string]*idempotentResponse
+	order   *list.List            // of *idempotentResponse, newest at the front
+	clients map[string]*list.List // the same, for each client
+	mutex   sync.Mutex
+}
+
+var idempotency *idempotencyStruct
+
+func newIdempotencyStore() *idempotencyStruct {
+	s := &idempotencyStruct{}
+	s.hash = map[string]*idempotentResponse{}
+	s.order = list.New()
+	s.clients = map[string]*list.List{}
+
+	go s.cleaner()
+
+	return s
+}
+
+var errIdempotencyInFlight = errors.New("A request with this Idempotency-Key is still in progress")
+var errIdempotencyMismatch = errors.New("Idempotency-Key was already used for a different request")
+
+// begin claims client's key for a request with the given fingerprint. If
+// the key has already completed, the recorded response is returned so it
+// can be replayed.
+func (s *idempotencyStruct) begin(client string, key string, fingerprint [sha256.Size]byte) (*idempotentResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	item, exists := s.hash[key]
+	if exists {
+		if item.fingerprint != fingerprint {
+			return nil, errIdempotencyMismatch
+		}
+
+		if !item.done {
+			return nil, errIdempotencyInFlight
+		}
+
+		return item, nil
+	}
+
+	owned := s.clients[client]
+	if owned == nil {
+		owned = list.New()
+		s.clients[client] = owned
+	} else if owned.Len() >= idempotencyMaxClientKeys {
+		s.forget(owned.Back().Value.(*idempotentResponse))
+	}
+	if len(s.hash) >= idempotencyMaxKeys {
+		s.forget(s.order.Back().Value.(*idempotentResponse))
+	}
+
+	item = &idempotentResponse{key: key, client: client, fingerprint: fingerprint, time: time.Now()}
+	item.element = s.order.PushFront(item)
+	item.clientElement = owned.PushFront(item)
+	s.hash[key] = item
+
+	return nil, nil
+}
+
+// Must hold the mutex.
+func (s *idempotencyStruct) forget(item *idempotentResponse) {
+	s.order.Remove(item.element)
+	owned := s.clients[item.client]
+	owned.Remove(item.clientElement)
+	if owned.Len() == 0 {
+		delete(s.clients, item.client)
+	}
+	delete(s.hash, item.key)
+}
+
+func (s *idempotencyStruct) finish(key string, status int, header http.Header, body []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	item, exists := s.hash[key]
+	if !exists {
+		return
+	}
+
+	item.done = true
+	item.status = status
+	item.header = header
+	item.body = body
+	item.time = time.Now()
+}
+
+// Gives up key without recording a response, so it can be used again.
+func (s *idempotencyStruct) abandon(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	item, exists := s.hash[key]
+	if exists {
+		s.forget(item)
+	}
+}
+
+func (s *idempotencyStruct) cleanup() {
+	expireTime := time.Now().Add(time.Second * -idempotencyExpireSeconds)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, item := range s.hash {
+		// an in-flight entry this old belongs to a request that died without
+		// finishing, so it goes too
+		if item.time.Before(expireTime) {
+			s.forget(item)
+		}
+	}
+}
+
+// runs in a separate goroutine
+func (s *idempotencyStruct) cleaner() {
+	for {
+		time.Sleep(time.Second * idempotencyCleanupInterval)
+		s.cleanup()
+	}
+}
+
+// recordingWriter passes a response through to the client while keeping a
+// copy so it can be replayed later, unless it's too big or streamed.
+type recordingWriter struct {
+	http.ResponseWriter
+	status  int
+	body    bytes.Buffer
+	skipped bool // not recorded after all
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.start(status)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.start(http.StatusOK)
+	}
+	if !w.skipped && w.body.Len()+len(b) > idempotencyMaxBody {
+		w.skip()
+	}
+	if !w.skipped {
+		w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// streamed batches are skipped from the start, whether they're flushed or not
+func (w *recordingWriter) start(status int) {
+	w.status = status
+	if w.Header().Get("Content-Type") == "application/x-ndjson" {
+		w.skip()
+	}
+}
+
+func (w *recordingWriter) skip() {
+	w.skipped = true
+	w.body = bytes.Buffer{}
+}
+
+// a flush means the response is streamed, so it isn't recorded
+func (w *recordingWriter) Flush() {
+	if !w.skipped {
+		w.skip()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *recordingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func requestFingerprint(r *http.Request, body []byte) [sha256.Size]byte {
+	h := sha256.New()
+	io.WriteString(h, r.Method+"\n"+r.URL.Path+"\n"+r.URL.RawQuery+"\n")
+	h.Write(body)
+
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// withIdempotency honors the Idempotency-Key header on POST requests.
+// Requests without the header, or using other methods, pass straight through.
+func withIdempotency(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sent := r.Header.Get(idempotencyHeader)
+		if r.Method != http.MethodPost || sent == "" {
+			next(w, r)
+			return
+		}
+		client := rateLimitKey(r)
+		key := client + " " + sent
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			httpFail(w, err)
+			return
+		}
+		// put the body back so the handler can still parse it
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		saved, err := idempotency.begin(client, key, requestFingerprint(r, body))
+		switch err {
+		case nil:
+		case errIdempotencyInFlight:
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		default:
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+
+		if saved != nil {
+			slog.DebugContext(r.Context(), "Replaying response", "idempotency_key", sent)
+
+			for name, values := range saved.header {
+				// the request ID stays this request's
+				if name != http.CanonicalHeaderKey(requestIDHeader) {
+					w.Header()[name] = values
+				}
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(saved.status)
+			w.Write(saved.body)
+			return
+		}
+
+		// if next panics, the key mustn't stay in progress
+		finished := false
+		defer func() {
+			if !finished {
+				idempotency.abandon(key)
+			}
+		}()
+
+		rec := &recordingWriter{ResponseWriter: w}
+		next(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		if !rec.skipped {
+			idempotency.finish(key, rec.status, w.Header().Clone(), rec.body.Bytes())
+			finished = true
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Opaque bearer tokens (ones that aren't JWTs, or any, without
+// -jwt-issuer) can be checked with the authorization server's RFC 7662
+// introspection endpoint instead, with -introspection-url. We authenticate
+// to it with -introspection-client-id and -introspection-client-secret.
+// What it says about a token is remembered for -introspection-cache (or
+// until the token expires, if that's sooner), so it isn't asked on every
+// request. An active token's subject and scopes go in the context just
+// like a JWT's, so everything after treats them the same. If the endpoint
+// can't be reached, the token's request gets a 503 rather than a 401, and
+// the endpoint isn't asked about it again for introspectionRetry.
+
+var introspectionURLFlag = flag.String("introspection-url", "", "RFC 7662 endpoint to check opaque bearer tokens with (off if empty)")
+var introspectionClientIDFlag = flag.String("introspection-client-id", "", "client ID to authenticate to -introspection-url with")
+var introspectionClientSecretFlag = flag.String("introspection-client-secret", "", "client secret to authenticate to -introspection-url with")
+var introspectionCacheFlag = flag.Duration("introspection-cache", time.Minute, "how long to remember what -introspection-url said about a token")
+
+// past this many, the tokens asked about least recently are forgotten to
+// make room
+const introspectionCacheMax = 10000
+
+// how long a token the endpoint couldn't tell us about is left before
+// asking again, so an outage isn't made worse
+const introspectionRetry = 5 * time.Second
+
+// what the endpoint said about a token
+type introspectedToken struct {
+	hash    [sha256.Size]byte
+	claims  jwtClaims
+	err     error // why it isn't good, if it isn't
+	expires time.Time
+	element *list.Element // its place in introspectionStruct.lru
+}
+
+type introspectionStruct struct {
+	url          string
+	clientID     string
+	clientSecret string
+	ttl          time.Duration
+	client       *http.Client
+	tokens       map[[sha256.Size]byte]*introspectedToken // by the token's hash
+	lru          *list.List                               // of *introspectedToken, most recently asked about at the front
+	mutex        sync.Mutex
+}
+
+// nil when tokens aren't introspected
+var introspection *introspectionStruct
+
+// Reads the -introspection flags.
+func startIntrospection() error {
+	if *introspectionURLFlag == "" {
+		return nil
+	}
+	u, err := url.Parse(*introspectionURLFlag)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("invalid -introspection-url %q", *introspectionURLFlag)
+	}
+	if *introspectionCacheFlag < 0 {
+		return fmt.Errorf("invalid -introspection-cache %v", *introspectionCacheFlag)
+	}
+
+	introspection = &introspectionStruct{
+		url:          *introspectionURLFlag,
+		clientID:     *introspectionClientIDFlag,
+		clientSecret: *introspectionClientSecretFlag,
+		ttl:          *introspectionCacheFlag,
+		client:       &http.Client{Timeout: 10 * time.Second},
+		tokens:       map[[sha256.Size]byte]*introspectedToken{},
+		lru:          list.New(),
+	}
+
+	return nil
+}
+
+// Checks a token, with the endpoint if we don't remember it.
+func (in *introspectionStruct) check(ctx context.Context, token string) (jwtClaims, error) {
+	hash := sha256.Sum256([]byte(token))
+	now := time.Now()
+
+	in.mutex.Lock()
+	remembered, exists := in.tokens[hash]
+	if exists && now.Before(remembered.expires) {
+		in.lru.MoveToFront(remembered.element)
+		claims, err := remembered.claims, remembered.err
+		in.mutex.Unlock()
+		return claims, err
+	}
+	in.mutex.Unlock()
+
+	claims, expires, err := in.ask(ctx, token)
+
+	until := now.Add(in.ttl)
+	if !expires.IsZero() && expires.Before(until) {
+		until = expires
+	}
+	var unreachable *introspectionUnreachableError
+	if errors.As(err, &unreachable) {
+		// not the token's fault, so not for long
+		until = now.Add(introspectionRetry)
+	}
+
+	in.mutex.Lock()
+	defer in.mutex.Unlock()
+
+	remembered, exists = in.tokens[hash]
+	if exists {
+		in.lru.MoveToFront(remembered.element)
+	} else {
+		if len(in.tokens) >= introspectionCacheMax {
+			in.forget(in.lru.Back().Value.(*introspectedToken))
+		}
+
+		remembered = &introspectedToken{hash: hash}
+		remembered.element = in.lru.PushFront(remembered)
+		in.tokens[hash] = remembered
+	}
+	remembered.claims = claims
+	remembered.err = err
+	remembered.expires = until
+
+	return claims, err
+}
+
+// Must hold the mutex.
+func (in *introspectionStruct) forget(token *introspectedToken) {
+	in.lru.Remove(token.element)
+	delete(in.tokens, token.hash)
+}
+
+// The error for when the endpoint couldn't tell us about a token
+type introspectionUnreachableError struct {
+	err error
+}
+
+func (err *introspectionUnreachableError) Error() string {
+	return fmt.Sprintf("can't introspect: %v", err.err)
+}
+
+// Asks the endpoint about a token, returning its claims and when it
+// expires, if it's active.
+func (in *introspectionStruct) ask(ctx context.Context, token string) (jwtClaims, time.Time, error) {
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, in.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return jwtClaims{}, time.Time{}, &introspectionUnreachableError{err}
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if in.clientID != "" {
+		req.SetBasicAuth(url.QueryEscape(in.clientID), url.QueryEscape(in.clientSecret))
+	}
+
+	resp, err := in.client.Do(req)
+	if err != nil {
+		return jwtClaims{}, time.Time{}, &introspectionUnreachableError{err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return jwtClaims{}, time.Time{}, &introspectionUnreachableError{fmt.Errorf("%s said %s", in.url, resp.Status)}
+	}
+
+	var response struct {
+		Active   bool     `json:"active"`
+		Subject  string   `json:"sub"`
+		Username string   `json:"username"`
+		ClientID string   `json:"client_id"`
+		Scope    string   `json:"scope"`
+		Expires  *float64 `json:"exp"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&response)
+	if err != nil {
+		return jwtClaims{}, time.Time{}, &introspectionUnreachableError{fmt.Errorf("%s: %v", in.url, err)}
+	}
+
+	if !response.Active {
+		return jwtClaims{}, time.Time{}, errors.New("not active")
+	}
+
+	var expires time.Time
+	if response.Expires != nil {
+		expires = time.Unix(int64(*response.Expires), 0)
+		if !time.Now().Before(expires) {
+			return jwtClaims{}, time.Time{}, errors.New("expired")
+		}
+	}
+
+	// a token for a client, rather than a user, may only have client_id
+	subject := response.Subject
+	if subject == "" {
+		subject = response.Username
+	}
+	if subject == "" {
+		subject = response.ClientID
+	}
+	if subject == "" {
+		// or every such token would be the same client
+		return jwtClaims{}, time.Time{}, errors.New("no subject")
+	}
+
+	return jwtClaims{Subject: subject, Scopes: strings.Fields(response.Scope)}, expires, nil
+}
+
+// withIntrospection checks the request's bearer token with the endpoint,
+// when it's one withJWT left alone, and puts its claims in the context as
+// withJWT would (or what was wrong with it). The admin token is let by.
+func withIntrospection(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if introspection == nil || !found || token == "" || isAdmin(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if jwks != nil && strings.Count(token, ".") == 2 {
+			// a JWT, which withJWT has seen to
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		claims, err := introspection.check(r.Context(), token)
+		if err != nil {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), jwtErrorKey{}, err)))
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), jwtClaimsKey{}, claims)))
+	})
+}
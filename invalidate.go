@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+)
+
+// With -cache-invalidation, deleting or purging cache entries (like through
+// the admin endpoints) is broadcast to the other replicas, which drop their
+// own local copies too. Shared tiers like Redis don't need telling; only the
+// parts of a cache that live in each replica (see localInvalidator) do.
+//
+// Answers that are worked out again aren't broadcast; they're the same
+// answer, and broadcasting every cache miss would be a lot of chatter.
+
+var cacheInvalidationFlag = flag.String("cache-invalidation", "", "pub/sub to broadcast cache deletes and purges to other replicas over (disabled if empty; see invalidationBuses)")
+
+// A message on the invalidation bus. An empty Key means everything.
+type invalidation struct {
+	From string `json:"from"` // replicaID of the sender, so it can ignore its own
+	Key  string `json:"key,omitempty"`
+}
+
+// Something that carries invalidations between replicas
+type invalidationBus interface {
+	publish(payload []byte) error
+	// calls handle with each message, until Close
+	subscribe(handle func(payload []byte)) error
+	Close() error
+}
+
+// Constructors for each -cache-invalidation. Like cacheBackends, they add
+// themselves from init in files behind build tags.
+var invalidationBuses = map[string]func() (invalidationBus, error){}
+
+// Implemented by caches with a part that lives in this replica. key is ""
+// for everything.
+type localInvalidator interface {
+	invalidateLocal(key string)
+}
+
+func (c *cacheStruct) invalidateLocal(key string) {
+	if key == "" {
+		c.Purge()
+	} else {
+		c.Delete(key)
+	}
+}
+
+func (c *tieredCache) invalidateLocal(key string) {
+	c.local.invalidateLocal(key)
+}
+
+// identifies this process on the bus
+var replicaID = newReplicaID()
+
+func newReplicaID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Wraps a Cache so deletes and purges are broadcast, and ones broadcast by
+// others are applied.
+type invalidatingCache struct {
+	Cache
+	bus invalidationBus
+}
+
+func withInvalidation(c Cache, name string) (Cache, error) {
+	newBus, exists := invalidationBuses[name]
+	if !exists {
+		return nil, fmt.Errorf("unknown -cache-invalidation: %s", name)
+	}
+
+	bus, err := newBus()
+	if err != nil {
+		return nil, err
+	}
+
+	local, _ := c.(localInvalidator)
+
+	err = bus.subscribe(func(payload []byte) {
+		var msg invalidation
+		err := json.Unmarshal(payload, &msg)
+		if err != nil {
+			slog.Error("Invalid cache invalidation", "err", err)
+			return
+		}
+
+		if msg.From == replicaID || local == nil {
+			return
+		}
+
+		local.invalidateLocal(msg.Key)
+	})
+	if err != nil {
+		bus.Close()
+		return nil, err
+	}
+
+	return &invalidatingCache{Cache: c, bus: bus}, nil
+}
+
+func (c *invalidatingCache) broadcast(key string) {
+	payload, _ := json.Marshal(invalidation{From: replicaID, Key: key})
+
+	err := c.bus.publish(payload)
+	if err != nil {
+		slog.Error("Error broadcasting cache invalidation", "err", err)
+	}
+}
+
+func (c *invalidatingCache) Delete(key string) {
+	c.Cache.Delete(key)
+	c.broadcast(key)
+}
+
+func (c *invalidatingCache) Purge() error {
+	err := c.Cache.Purge()
+	c.broadcast("")
+	return err
+}
+
+func (c *invalidatingCache) Close() error {
+	c.bus.Close()
+	return c.Cache.Close()
+}
+
+func (c *invalidatingCache) unwrap() Cache {
+	return c.Cache
+}
+
+// Digs the backend itself out from under any wrappers like
+// invalidatingCache, for optional interfaces like cachePersister.
+func baseCache(c Cache) Cache {
+	for {
+		wrapper, ok := c.(interface{ unwrap() Cache })
+		if !ok {
+			return c
+		}
+		c = wrapper.unwrap()
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// The service can be locked to some networks without touching the
+// firewall. With -allow-ips, only clients in those networks are answered;
+// clients in -deny-ips never are, allowed or not. Both take CIDRs or bare
+// addresses, and can be reloaded. An admin can also add to either list
+// right away:
+//
+//	curl -X PUT 'http://localhost:8080/admin/ips/deny?cidr=203.0.113.0/24'
+//	curl -X DELETE 'http://localhost:8080/admin/ips/deny?cidr=203.0.113.0/24'
+//
+// which lasts until it's deleted, or a restart. Careful: an allow list that
+// leaves out the admin locks them out of this too. Clients are checked by
+// their real address (see -trusted-proxies); peers on unix sockets have
+// none, and are always answered. An address a proxy couldn't or wouldn't
+// tell us ("unknown", or obfuscated) isn't in any network, so with
+// -allow-ips it's turned away.
+
+var allowIPsFlag = flag.String("allow-ips", "", "comma-separated CIDRs to answer; if set, clients elsewhere get a 403")
+var denyIPsFlag = flag.String("deny-ips", "", "comma-separated CIDRs never to answer")
+
+type ipFilterStruct struct {
+	allow      []*net.IPNet // from the flags
+	deny       []*net.IPNet
+	addedAllow []*net.IPNet // by an admin
+	addedDeny  []*net.IPNet
+	mutex      sync.RWMutex
+}
+
+var ipFilter = &ipFilterStruct{}
+
+var ipsForbidden = newCounterVec("http_math_ip_forbidden_total",
+	"Requests turned away by -allow-ips or -deny-ips")
+
+func init() {
+	registerReload(loadIPFilter, "allow-ips", "deny-ips")
+}
+
+func loadIPFilter() error {
+	allow, err := parseNetworkList(*allowIPsFlag)
+	if err != nil {
+		return fmt.Errorf("invalid -allow-ips entry %v", err)
+	}
+
+	deny, err := parseNetworkList(*denyIPsFlag)
+	if err != nil {
+		return fmt.Errorf("invalid -deny-ips entry %v", err)
+	}
+
+	ipFilter.mutex.Lock()
+	defer ipFilter.mutex.Unlock()
+
+	ipFilter.allow = allow
+	ipFilter.deny = deny
+
+	return nil
+}
+
+func parseNetworkList(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		network, err := parseNetwork(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", entry, err)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+func inNetworks(ip net.IP, lists ...[]*net.IPNet) bool {
+	for _, networks := range lists {
+		for _, network := range networks {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Whether a client at ip can be answered.
+func (f *ipFilterStruct) allowed(ip net.IP) bool {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	if inNetworks(ip, f.deny, f.addedDeny) {
+		return false
+	}
+	if len(f.allow) == 0 && len(f.addedAllow) == 0 {
+		return true
+	}
+
+	return inNetworks(ip, f.allow, f.addedAllow)
+}
+
+// Whether a client whose address we don't know is answered: not if there's
+// an allow list, as it can't be on it.
+func (f *ipFilterStruct) allowsUnknown() bool {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	return len(f.allow) == 0 && len(f.addedAllow) == 0
+}
+
+// the list an admin adds to, by name; must hold the mutex
+func (f *ipFilterStruct) added(list string) *[]*net.IPNet {
+	if list == "allow" {
+		return &f.addedAllow
+	}
+	return &f.addedDeny
+}
+
+// Adds network to an admin's list, if it isn't there already.
+func (f *ipFilterStruct) add(list string, network *net.IPNet) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	networks := f.added(list)
+	if !slices.ContainsFunc(*networks, func(n *net.IPNet) bool { return n.String() == network.String() }) {
+		*networks = append(*networks, network)
+	}
+}
+
+// Takes network off an admin's list, returning whether it was there.
+func (f *ipFilterStruct) remove(list string, network *net.IPNet) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	networks := f.added(list)
+	before := len(*networks)
+	*networks = slices.DeleteFunc(*networks, func(n *net.IPNet) bool { return n.String() == network.String() })
+
+	return len(*networks) < before
+}
+
+// whether the request is from a peer on a unix socket itself, rather than
+// forwarded by one
+func isUnixPeer(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return net.ParseIP(host) == nil && (!trustUnixPeers || len(forwardedFor(r)) == 0)
+}
+
+func withIPFilter(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr := clientIP(r)
+		ip := net.ParseIP(addr)
+
+		var allowed bool
+		switch {
+		case ip != nil:
+			allowed = ipFilter.allowed(ip)
+		case isUnixPeer(r):
+			allowed = true
+		default:
+			allowed = ipFilter.allowsUnknown()
+		}
+		if allowed {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ipsForbidden.add(1)
+		httpErrorCode(w, http.StatusForbidden, "ip_forbidden", "Not answering requests from "+addr)
+	})
+}
+
+// JSON data for one network in GET /admin/ips
+type ipFilterEntry struct {
+	CIDR  string `json:"cidr"`
+	Added bool   `json:"added,omitempty"` // by an admin, rather than the flags
+}
+
+// JSON data for GET /admin/ips
+type ipFilterResponse struct {
+	Allow []ipFilterEntry `json:"allow"`
+	Deny  []ipFilterEntry `json:"deny"`
+}
+
+func ipFilterEntries(configured []*net.IPNet, added []*net.IPNet) []ipFilterEntry {
+	entries := []ipFilterEntry{}
+	for _, network := range configured {
+		entries = append(entries, ipFilterEntry{CIDR: network.String()})
+	}
+	for _, network := range added {
+		entries = append(entries, ipFilterEntry{CIDR: network.String(), Added: true})
+	}
+
+	return entries
+}
+
+// GET /admin/ips lists the allowed and denied networks. Admin only.
+func doIPFilter(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Usage: curl -H 'Authorization: Bearer TOKEN' http://localhost:8080/admin/ips",
+			http.StatusMethodNotAllowed)
+		return
+	}
+
+	ipFilter.mutex.RLock()
+	response := ipFilterResponse{
+		Allow: ipFilterEntries(ipFilter.allow, ipFilter.addedAllow),
+		Deny:  ipFilterEntries(ipFilter.deny, ipFilter.addedDeny),
+	}
+	ipFilter.mutex.RUnlock()
+
+	writeData(w, r, http.StatusOK, response)
+}
+
+// PUT /admin/ips/{allow|deny}?cidr=CIDR adds a network to a list, and
+// DELETE takes one an admin added off again. Admin only.
+func doIPFilterList(w http.ResponseWriter, r *http.Request) {
+	list := strings.TrimPrefix(r.URL.Path, "/admin/ips/")
+	if list != "allow" && list != "deny" {
+		http.Error(w, "Invalid list; expected allow or deny", http.StatusNotFound)
+		return
+	}
+
+	var network *net.IPNet
+	if r.Method == http.MethodPut || r.Method == http.MethodDelete {
+		var err error
+		network, err = parseNetwork(r.URL.Query().Get("cidr"))
+		if err != nil {
+			http.Error(w, "Invalid cidr; expected a CIDR or an address", http.StatusBadRequest)
+			return
+		}
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		ipFilter.add(list, network)
+		slog.InfoContext(r.Context(), "Network added", "list", list, "cidr", network.String())
+	case http.MethodDelete:
+		if !ipFilter.remove(list, network) {
+			http.Error(w, fmt.Sprintf("%s isn't on the %s list, or came from the flags", network, list), http.StatusNotFound)
+			return
+		}
+		slog.InfoContext(r.Context(), "Network removed", "list", list, "cidr", network.String())
+	default:
+		w.Header().Set("Allow", "PUT, DELETE")
+		http.Error(w, "Usage: curl -X PUT -H 'Authorization: Bearer TOKEN' 'http://localhost:8080/admin/ips/{allow|deny}?cidr=CIDR'",
+			http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
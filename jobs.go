@@ -0,0 +1,532 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JSON data for submitting a job to POST /jobs. Every item is computed
+// independently, in order. If CallbackURL is set, the finished job is POSTed
+// there so the client doesn't have to poll.
+type jobRequest struct {
+	Items       []jobItem `json:"items"`
+	CallbackURL string    `json:"callback_url"`
+}
+
+type jobItem struct {
+	Op string  `json:"op"`
+	X  float64 `json:"x"`
+	Y  float64 `json:"y"`
+}
+
+// One item's outcome: either the usual response, or the error it hit
+type jobResult struct {
+	*response
+	Error string `json:"error,omitempty"`
+}
+
+const (
+	jobQueued   = "queued"
+	jobRunning  = "running"
+	jobDone     = "done"
+	jobCanceled = "canceled"
+)
+
+type job struct {
+	id       string
+	seq      uint64 // order of submission, for paging
+	client   string // who submitted it; only they get to see it
+	items    []jobItem
+	callback string
+	fresh    bool // skip cached answers
+	status   string
+	created  time.Time
+	finished time.Time
+	results  []jobResult
+	cancel   context.CancelFunc
+	mutex    sync.Mutex
+}
+
+// JSON data for responding to /jobs requests. Results are left out of
+// listings.
+type jobResponse struct {
+	ID       string      `json:"id"`
+	Status   string      `json:"status"`
+	Created  time.Time   `json:"created"`
+	Finished *time.Time  `json:"finished,omitempty"`
+	Total    int         `json:"total"`
+	Done     int         `json:"done"`
+	Results  []jobResult `json:"results,omitempty"`
+}
+
+// a job waiting for a worker, with what it runs under
+type queuedJob struct {
+	ctx context.Context
+	job *job
+}
+
+type jobStruct struct {
+	hash       map[string]*job // keyed by job id
+	seq        uint64          // sequence number of the newest job
+	unfinished map[string]int  // queued or running jobs, by client
+	total      int             // of unfinished
+	stored     map[string]int  // jobs kept, finished or not, by client
+	items      int             // of all the jobs kept, which bounds their results
+	finished   []string        // ids of finished jobs, oldest first, to make room
+	mutex      sync.Mutex
+	queue      chan queuedJob // for the workers, who compute jobMaxRunning at once
+	runs       sync.WaitGroup // of unfinished jobs, for drain
+	drained    bool           // set by drain; new jobs are canceled straight away
+}
+
+const jobMaxItems = 100000
+const jobMaxRunning = 4
+const jobExpireSeconds = 60 * 60
+const jobCleanupInterval = 60
+
+// Past these, new jobs are turned away: a client with jobMaxClientQueued
+// unfinished or jobMaxClientStored kept gets a 429, and everyone gets a 503
+// when there are jobMaxQueued. Past jobMaxStored jobs, or jobMaxStoredItems
+// items in them, the oldest finished jobs are forgotten early to make room.
+const jobMaxClientQueued = 10
+const jobMaxClientStored = 1000
+const jobMaxQueued = 1000
+const jobMaxStored = 10000
+const jobMaxStoredItems = 10 * jobMaxItems
+
+var errTooManyJobs = fmt.Errorf("Too many jobs waiting (max %d); try again later", jobMaxQueued)
+var errTooManyClientJobs = fmt.Errorf("You have too many unfinished jobs (max %d); wait for some to finish", jobMaxClientQueued)
+var errTooManyClientStoredJobs = fmt.Errorf("You have too many jobs kept (max %d); delete finished ones, or wait for them to expire", jobMaxClientStored)
+
+var jobs *jobStruct
+
+func newJobStore() *jobStruct {
+	s := &jobStruct{}
+	s.hash = map[string]*job{}
+	s.unfinished = map[string]int{}
+	s.stored = map[string]int{}
+	s.queue = make(chan queuedJob, jobMaxQueued)
+
+	for i := 0; i < jobMaxRunning; i++ {
+		go s.worker()
+	}
+	go s.cleaner()
+
+	return s
+}
+
+func newJobID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// grant is what the submitter's credentials allow, which the job keeps to.
+// Returns errTooManyJobs, errTooManyClientJobs or errTooManyClientStoredJobs
+// if there's no room for it.
+func (s *jobStruct) submit(client string, grant *opGrant, req jobRequest, fresh bool) (*job, error) {
+	ctx, cancel := context.WithCancel(grantContext(context.Background(), grant))
+
+	j := &job{
+		id:       newJobID(),
+		client:   client,
+		items:    req.Items,
+		callback: req.CallbackURL,
+		fresh:    fresh,
+		status:   jobQueued,
+		created:  time.Now(),
+		results:  make([]jobResult, 0, len(req.Items)),
+		cancel:   cancel,
+	}
+
+	s.mutex.Lock()
+	if s.total >= jobMaxQueued {
+		s.mutex.Unlock()
+		cancel()
+		return nil, errTooManyJobs
+	}
+	if s.unfinished[client] >= jobMaxClientQueued {
+		s.mutex.Unlock()
+		cancel()
+		return nil, errTooManyClientJobs
+	}
+	if s.stored[client] >= jobMaxClientStored {
+		s.mutex.Unlock()
+		cancel()
+		return nil, errTooManyClientStoredJobs
+	}
+
+	for (len(s.hash) >= jobMaxStored || s.items+len(j.items) > jobMaxStoredItems) && len(s.finished) > 0 {
+		s.forget(s.finished[0])
+		s.finished = s.finished[1:]
+	}
+	if s.items+len(j.items) > jobMaxStoredItems {
+		// the unfinished ones are taking up all the room
+		s.mutex.Unlock()
+		cancel()
+		return nil, errTooManyJobs
+	}
+
+	s.seq++
+	j.seq = s.seq
+	s.hash[j.id] = j
+	s.stored[client]++
+	s.items += len(j.items)
+	draining := s.drained
+	if !draining {
+		s.runs.Add(1)
+		s.unfinished[client]++
+		s.total++
+	}
+	s.mutex.Unlock()
+
+	if draining {
+		cancel()
+		j.finish(jobCanceled)
+
+		s.mutex.Lock()
+		s.finished = append(s.finished, j.id)
+		s.mutex.Unlock()
+		return j, nil
+	}
+
+	// there's room, as there are no more than jobMaxQueued unfinished
+	s.queue <- queuedJob{ctx: ctx, job: j}
+
+	return j, nil
+}
+
+// Computes queued jobs, one at a time. runs in a separate goroutine
+func (s *jobStruct) worker() {
+	for queued := range s.queue {
+		s.run(queued.ctx, queued.job)
+
+		s.mutex.Lock()
+		s.unfinished[queued.job.client]--
+		if s.unfinished[queued.job.client] == 0 {
+			delete(s.unfinished, queued.job.client)
+		}
+		s.total--
+		s.finished = append(s.finished, queued.job.id)
+		s.mutex.Unlock()
+
+		s.runs.Done()
+	}
+}
+
+// Lets unfinished jobs run until ctx is done, then cancels what's left, and
+// waits for their webhooks. Jobs submitted from now on are canceled right
+// away.
+func (s *jobStruct) drain(ctx context.Context) {
+	s.mutex.Lock()
+	s.drained = true
+	s.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.runs.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.mutex.Lock()
+		for _, j := range s.hash {
+			j.cancel()
+		}
+		s.mutex.Unlock()
+
+		<-done
+	}
+
+	waitWebhooks(ctx)
+}
+
+func (s *jobStruct) run(ctx context.Context, j *job) {
+	defer j.cancel()
+
+	if ctx.Err() != nil {
+		j.finish(jobCanceled)
+		return
+	}
+
+	j.mutex.Lock()
+	j.status = jobRunning
+	j.mutex.Unlock()
+
+	for _, item := range j.items {
+		if ctx.Err() != nil {
+			j.finish(jobCanceled)
+			return
+		}
+
+		result := answerItem(ctx, j.client, item, j.fresh)
+
+		j.mutex.Lock()
+		j.results = append(j.results, result)
+		j.mutex.Unlock()
+	}
+
+	j.finish(jobDone)
+}
+
+func (j *job) finish(status string) {
+	j.mutex.Lock()
+	j.status = status
+	j.finished = time.Now()
+	j.mutex.Unlock()
+
+	slog.Info("Job finished", "job", j.id, "status", status)
+
+	if j.callback != "" {
+		startWebhook(j.callback, j.snapshot(true))
+	}
+}
+
+func (j *job) snapshot(withResults bool) jobResponse {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	data := jobResponse{
+		ID:      j.id,
+		Status:  j.status,
+		Created: j.created,
+		Total:   len(j.items),
+		Done:    len(j.results),
+	}
+
+	if !j.finished.IsZero() {
+		finished := j.finished
+		data.Finished = &finished
+	}
+
+	if withResults {
+		data.Results = append([]jobResult{}, j.results...)
+	}
+
+	return data
+}
+
+// returns the job only if it belongs to client
+func (s *jobStruct) get(id string, client string) (*job, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	j, exists := s.hash[id]
+	if !exists || j.client != client {
+		return nil, false
+	}
+
+	return j, true
+}
+
+func (s *jobStruct) remove(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.forget(id)
+}
+
+// Must hold the mutex.
+func (s *jobStruct) forget(id string) {
+	j, exists := s.hash[id]
+	if !exists {
+		return
+	}
+
+	delete(s.hash, id)
+	s.items -= len(j.items)
+	s.stored[j.client]--
+	if s.stored[j.client] == 0 {
+		delete(s.stored, j.client)
+	}
+}
+
+// Returns up to limit of client's jobs submitted after the job numbered
+// after, oldest first. more says whether there are others after those.
+func (s *jobStruct) list(client string, limit int, after uint64) ([]*job, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ret := []*job{}
+	for _, j := range s.hash {
+		if j.client == client && j.seq > after {
+			ret = append(ret, j)
+		}
+	}
+
+	sort.Slice(ret, func(a, b int) bool {
+		return ret[a].seq < ret[b].seq
+	})
+
+	if len(ret) > limit {
+		return ret[:limit], true
+	}
+
+	return ret, false
+}
+
+func (s *jobStruct) cleanup() {
+	expireTime := time.Now().Add(time.Second * -jobExpireSeconds)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for id, j := range s.hash {
+		j.mutex.Lock()
+		expired := !j.finished.IsZero() && j.finished.Before(expireTime)
+		j.mutex.Unlock()
+
+		if expired {
+			s.forget(id)
+		}
+	}
+
+	// forget the ones that are gone, one way or another
+	s.finished = slices.DeleteFunc(s.finished, func(id string) bool {
+		_, exists := s.hash[id]
+		return !exists
+	})
+}
+
+// runs in a separate goroutine
+func (s *jobStruct) cleaner() {
+	for {
+		time.Sleep(time.Second * jobCleanupInterval)
+		s.cleanup()
+	}
+}
+
+// Handles /jobs and everything under it:
+//
+//	POST /jobs          submits a job; responds 202 with its id
+//	GET /jobs           lists the caller's jobs, paged; see pagination.go
+//	GET /jobs/{id}      status and results so far
+//	DELETE /jobs/{id}   cancels a job, or forgets it if it already finished
+func doJobs(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/jobs"), "/")
+	client := clientID(r, nil)
+
+	if id == "" {
+		switch r.Method {
+		case http.MethodPost:
+			submitJob(w, r, client)
+		case http.MethodGet, http.MethodHead:
+			listJobs(w, r, client)
+		default:
+			w.Header().Set("Allow", "GET, HEAD, POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	j, exists := jobs.get(id, client)
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		writeData(w, r, http.StatusOK, j.snapshot(true))
+	case http.MethodDelete:
+		data := j.snapshot(false)
+		if data.Finished != nil {
+			jobs.remove(id)
+		} else {
+			j.cancel()
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// JSON data for responding to GET /jobs
+type jobListResponse struct {
+	Jobs []jobResponse `json:"jobs"`
+	Next string        `json:"next,omitempty"`
+}
+
+func listJobs(w http.ResponseWriter, r *http.Request, client string) {
+	limit, after, err := pageParams(r)
+	if err != nil {
+		httpFail(w, err)
+		return
+	}
+
+	list, more := jobs.list(client, limit, after)
+
+	data := jobListResponse{Jobs: []jobResponse{}}
+	for _, j := range list {
+		data.Jobs = append(data.Jobs, j.snapshot(false))
+	}
+
+	if more {
+		data.Next = nextPageLink(r, list[len(list)-1].seq)
+	}
+
+	writeData(w, r, http.StatusOK, data)
+}
+
+func submitJob(w http.ResponseWriter, r *http.Request, client string) {
+	var req jobRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpFail(w, fmt.Errorf("Invalid job request: %w", err))
+		return
+	}
+
+	if len(req.Items) == 0 {
+		httpFail(w, errors.New("Job has no items"))
+		return
+	}
+	if len(req.Items) > jobMaxItems {
+		httpFail(w, fmt.Errorf("Job has too many items (max %d)", jobMaxItems))
+		return
+	}
+
+	if req.CallbackURL != "" {
+		err = validateCallbackURL(req.CallbackURL)
+		if err != nil {
+			httpFail(w, err)
+			return
+		}
+	}
+
+	err = spendQuota(r.Context(), len(req.Items))
+	if err != nil {
+		httpFail(w, err)
+		return
+	}
+
+	j, err := jobs.submit(client, requestGrant(r.Context()), req, wantsFresh(r))
+	if err != nil {
+		refundQuota(r.Context(), len(req.Items))
+
+		status := http.StatusServiceUnavailable
+		if err == errTooManyClientJobs || err == errTooManyClientStoredJobs {
+			status = http.StatusTooManyRequests
+		}
+		w.Header().Set("Retry-After", "1")
+		httpErrorCode(w, status, "too_many_jobs", err.Error())
+		return
+	}
+	slog.InfoContext(r.Context(), "Job submitted", "job", j.id, "items", len(req.Items))
+
+	w.Header().Set("Location", "/jobs/"+j.id)
+	writeData(w, r, http.StatusAccepted, j.snapshot(false))
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"net/http"
+	"regexp"
+)
+
+// JSONP is only here for an old dashboard that loads answers with script
+// tags. It lets any site read our responses, so it's off unless asked for.
+var jsonpFlag = flag.Bool("jsonp", false, "allow JSONP responses via the callback parameter")
+
+// dotted JavaScript identifiers only, so the callback can't smuggle in code
+var jsonpCallbackPattern = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*(\.[A-Za-z_$][A-Za-z0-9_$]*)*$`)
+
+const jsonpMaxCallbackLength = 128
+
+var errJSONPDisabled = errors.New("JSONP is disabled")
+
+// returns the JSONP callback the request asked for, if any
+func jsonpCallback(r *http.Request) (string, error) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return "", nil
+	}
+
+	callback := r.URL.Query().Get("callback")
+	if callback == "" {
+		return "", nil
+	}
+
+	if !*jsonpFlag {
+		return "", errJSONPDisabled
+	}
+
+	if len(callback) > jsonpMaxCallbackLength || !jsonpCallbackPattern.MatchString(callback) {
+		return "", errors.New("Invalid callback name")
+	}
+
+	return callback, nil
+}
+
+func writeJSONP(w http.ResponseWriter, status int, callback string, data interface{}) {
+	ret, err := marshalJSON(data)
+	if err != nil {
+		httpFail(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+
+	// the leading comment defuses the Rosetta Flash style of attack
+	w.Write([]byte("/**/" + callback + "("))
+	w.Write(ret)
+	w.Write([]byte(");\n"))
+}
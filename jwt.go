@@ -0,0 +1,474 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With -jwt-issuer, computations can also be authorized with a JWT from
+// that issuer (an OIDC provider, say) as an Authorization: Bearer token.
+// It's checked against the issuer's keys, from -jwks-url or the issuer's
+// OpenID configuration, which are fetched again every -jwks-refresh, and
+// whenever a token is signed with a key we haven't seen. Its subject and
+// scopes (from scope or scp) go in the context, for the layers that
+// decide what a client may do.
+
+var jwtIssuerFlag = flag.String("jwt-issuer", "", "issuer whose JWTs (as Authorization: Bearer tokens) authorize computations (off if empty)")
+var jwtAudienceFlag = flag.String("jwt-audience", "", "audience JWTs must be for (any if empty)")
+var jwksURLFlag = flag.String("jwks-url", "", "where the issuer's signing keys are (found from its OpenID configuration if empty)")
+var jwksRefreshFlag = flag.Duration("jwks-refresh", time.Hour, "how often to fetch the issuer's signing keys again")
+
+// how far clocks may disagree about exp and nbf
+const jwtLeeway = time.Minute
+
+// the least time between fetches for unknown keys, so bad tokens can't
+// make us hammer the issuer
+const jwksMinRefresh = 30 * time.Second
+
+// What a valid token says about who's asking
+type jwtClaims struct {
+	Subject string
+	Scopes  []string
+}
+
+type jwtClaimsKey struct{}
+type jwtErrorKey struct{}
+
+type jwksStruct struct {
+	url       string
+	keys      map[string]crypto.PublicKey // by kid
+	fetched   time.Time
+	lastError error
+	client    *http.Client
+	mutex     sync.Mutex
+}
+
+// nil when JWTs aren't accepted
+var jwks *jwksStruct
+
+// Reads the -jwt flags and fetches the issuer's keys.
+func startJWT() error {
+	if *jwtIssuerFlag == "" {
+		return nil
+	}
+	if *jwksRefreshFlag < jwksMinRefresh {
+		return fmt.Errorf("invalid -jwks-refresh %v: must be at least %v", *jwksRefreshFlag, jwksMinRefresh)
+	}
+
+	jwks = &jwksStruct{
+		url:    *jwksURLFlag,
+		keys:   map[string]crypto.PublicKey{},
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+
+	// not fatal; tokens are turned away until the keys can be had
+	err := jwks.refresh()
+	if err != nil {
+		slog.Warn("Can't fetch JWT signing keys", "issuer", *jwtIssuerFlag, "err", err)
+	}
+
+	registerReadiness("jwks", func() error {
+		jwks.mutex.Lock()
+		defer jwks.mutex.Unlock()
+
+		if len(jwks.keys) == 0 {
+			return fmt.Errorf("no JWT signing keys: %v", jwks.lastError)
+		}
+		return nil
+	})
+
+	go func() {
+		for range time.Tick(*jwksRefreshFlag) {
+			err := jwks.refresh()
+			if err != nil {
+				slog.Warn("Can't fetch JWT signing keys", "issuer", *jwtIssuerFlag, "err", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Fetches the keys, keeping the old ones if that fails. Tokens are checked
+// with the old ones in the meantime.
+func (j *jwksStruct) refresh() error {
+	j.mutex.Lock()
+	j.fetched = time.Now()
+	url := j.url
+	j.mutex.Unlock()
+
+	keys, url, err := j.fetch(url)
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	j.lastError = err
+	if err != nil {
+		return err
+	}
+
+	j.url = url
+	j.keys = keys
+	return nil
+}
+
+// Fetches the keys from url, or from where the issuer says they are if
+// that's empty; returns where they were found too.
+func (j *jwksStruct) fetch(url string) (map[string]crypto.PublicKey, string, error) {
+	if url == "" {
+		var config struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		err := j.getJSON(strings.TrimSuffix(*jwtIssuerFlag, "/")+"/.well-known/openid-configuration", &config)
+		if err != nil {
+			return nil, "", err
+		}
+		if config.JWKSURI == "" {
+			return nil, "", errors.New("the issuer's OpenID configuration has no jwks_uri")
+		}
+		url = config.JWKSURI
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	err := j.getJSON(url, &set)
+	if err != nil {
+		return nil, "", err
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.publicKey()
+		if err != nil {
+			// one we don't understand needn't spoil the rest
+			slog.Debug("Skipping JWT signing key", "kid", k.Kid, "err", err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+
+	if len(keys) == 0 {
+		return nil, "", fmt.Errorf("no usable keys at %s", url)
+	}
+
+	return keys, url, nil
+}
+
+func (j *jwksStruct) getJSON(url string, v any) error {
+	resp, err := j.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// The key with kid, fetching the keys again if it's new to us (and we
+// haven't just done that).
+func (j *jwksStruct) key(kid string) (crypto.PublicKey, error) {
+	j.mutex.Lock()
+	key, exists := j.keys[kid]
+	stale := time.Since(j.fetched) >= jwksMinRefresh
+	j.mutex.Unlock()
+
+	if exists {
+		return key, nil
+	}
+	if stale {
+		err := j.refresh()
+		if err != nil {
+			slog.Warn("Can't fetch JWT signing keys", "issuer", *jwtIssuerFlag, "err", err)
+		}
+
+		j.mutex.Lock()
+		key, exists = j.keys[kid]
+		j.mutex.Unlock()
+		if exists {
+			return key, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// A JSON Web Key; only what's needed for the public keys we take
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return nil, errors.New("bad RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, exists := curves[k.Crv]
+		if !exists {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		if len(x) != size || len(y) != size {
+			return nil, errors.New("bad EC point")
+		}
+		return ecdsa.ParseUncompressedPublicKey(curve, slices.Concat([]byte{4}, x, y))
+
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("bad Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// the hashes for the algorithms we take; none and the HMAC ones aren't
+var jwtHashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"PS256": crypto.SHA256, "PS384": crypto.SHA384, "PS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+	"EdDSA": 0,
+}
+
+// Checks a token's signature and claims.
+func verifyJWT(token string) (jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return jwtClaims{}, errors.New("not a JWT")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err := decodeJWTPart(parts[0], &header)
+	if err != nil {
+		return jwtClaims{}, err
+	}
+
+	hash, supported := jwtHashes[header.Alg]
+	if !supported {
+		return jwtClaims{}, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+
+	key, err := jwks.key(header.Kid)
+	if err != nil {
+		return jwtClaims{}, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return jwtClaims{}, errors.New("malformed signature")
+	}
+
+	err = verifyJWTSignature(header.Alg, hash, key, []byte(parts[0]+"."+parts[1]), signature)
+	if err != nil {
+		return jwtClaims{}, err
+	}
+
+	var claims struct {
+		Issuer    string          `json:"iss"`
+		Subject   string          `json:"sub"`
+		Audience  json.RawMessage `json:"aud"`
+		Expires   *float64        `json:"exp"`
+		NotBefore *float64        `json:"nbf"`
+		Scope     string          `json:"scope"`
+		Scp       json.RawMessage `json:"scp"`
+	}
+	err = decodeJWTPart(parts[1], &claims)
+	if err != nil {
+		return jwtClaims{}, err
+	}
+
+	now := time.Now()
+	switch {
+	case claims.Issuer != *jwtIssuerFlag:
+		return jwtClaims{}, fmt.Errorf("wrong issuer %q", claims.Issuer)
+	case claims.Subject == "":
+		// or every such token would be the same client, "jwt:"
+		return jwtClaims{}, errors.New("no subject")
+	case claims.Expires == nil:
+		return jwtClaims{}, errors.New("no expiry")
+	case now.Add(-jwtLeeway).After(time.Unix(int64(*claims.Expires), 0)):
+		return jwtClaims{}, errors.New("expired")
+	case claims.NotBefore != nil && now.Add(jwtLeeway).Before(time.Unix(int64(*claims.NotBefore), 0)):
+		return jwtClaims{}, errors.New("not valid yet")
+	case *jwtAudienceFlag != "" && !slices.Contains(stringOrList(claims.Audience), *jwtAudienceFlag):
+		return jwtClaims{}, errors.New("wrong audience")
+	}
+
+	scopes := strings.Fields(claims.Scope)
+	for _, scp := range stringOrList(claims.Scp) {
+		scopes = append(scopes, strings.Fields(scp)...)
+	}
+
+	return jwtClaims{Subject: claims.Subject, Scopes: scopes}, nil
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err == nil {
+		err = json.Unmarshal(data, v)
+	}
+	if err != nil {
+		return errors.New("malformed token")
+	}
+	return nil
+}
+
+// Claims like aud can be a string or a list of them.
+func stringOrList(raw json.RawMessage) []string {
+	var list []string
+	if json.Unmarshal(raw, &list) == nil {
+		return list
+	}
+
+	var s string
+	if json.Unmarshal(raw, &s) == nil && s != "" {
+		return []string{s}
+	}
+
+	return nil
+}
+
+func verifyJWTSignature(alg string, hash crypto.Hash, key crypto.PublicKey, signed []byte, signature []byte) error {
+	var digest []byte
+	if hash != 0 {
+		h := hash.New()
+		h.Write(signed)
+		digest = h.Sum(nil)
+	}
+
+	bad := errors.New("bad signature")
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		var err error
+		switch alg[:2] {
+		case "RS":
+			err = rsa.VerifyPKCS1v15(key, hash, digest, signature)
+		case "PS":
+			err = rsa.VerifyPSS(key, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		default:
+			return fmt.Errorf("%s isn't for RSA keys", alg)
+		}
+		if err != nil {
+			return bad
+		}
+
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if alg[:2] != "ES" || len(signature) != 2*size {
+			return bad
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return bad
+		}
+
+	case ed25519.PublicKey:
+		if alg != "EdDSA" || !ed25519.Verify(key, signed, signature) {
+			return bad
+		}
+
+	default:
+		return bad
+	}
+
+	return nil
+}
+
+// The claims of the request's token, if it came with a good one
+func requestJWT(ctx context.Context) (jwtClaims, bool) {
+	claims, ok := ctx.Value(jwtClaimsKey{}).(jwtClaims)
+	return claims, ok
+}
+
+// withJWT checks the request's bearer token, when we take JWTs, and puts
+// its claims in the context for what comes after (or what was wrong with
+// it, for requireAuth to say). Like withAPIKey, it doesn't turn anyone
+// away; admin endpoints have bearer tokens of their own.
+func withJWT(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if jwks == nil || !found {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		claims, err := verifyJWT(token)
+		if err != nil {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), jwtErrorKey{}, err)))
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), jwtClaimsKey{}, claims)))
+	})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long answers take, by operation and whether they came from the cache,
+// so we can see which operations the cache actually helps. Every answer is
+// counted in a histogram for /metrics, and the latest few per operation are
+// kept for the percentiles in /cache/stats. A response's Server-Timing
+// header says how long its answer took.
+
+// recent answers kept per operation and cached or not
+const latencyWindowSize = 1024
+
+// answers take microseconds, far below the request buckets
+var answerLatencyBuckets = []float64{1e-6, 2.5e-6, 5e-6, 1e-5, 2.5e-5, 5e-5, 1e-4, 2.5e-4, 5e-4, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+
+var answerDuration = newHistogramVec("http_math_answer_duration_seconds",
+	"How long answers took to look up or work out, by operation and whether they were cached.", answerLatencyBuckets, "op", "cached")
+
+type latencyKey struct {
+	op     string
+	cached bool
+}
+
+// the latest samples, oldest overwritten first
+type latencyWindow struct {
+	samples []float64
+	next    int
+	count   uint64
+	sum     float64
+}
+
+type latencyStruct struct {
+	windows map[latencyKey]*latencyWindow
+	mutex   sync.Mutex
+}
+
+var latencies = &latencyStruct{windows: map[latencyKey]*latencyWindow{}}
+
+func (l *latencyStruct) record(op string, cached bool, d time.Duration) {
+	seconds := d.Seconds()
+	answerDuration.observe(seconds, op, strconv.FormatBool(cached))
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	key := latencyKey{op, cached}
+	w, exists := l.windows[key]
+	if !exists {
+		w = &latencyWindow{samples: make([]float64, 0, latencyWindowSize)}
+		l.windows[key] = w
+	}
+
+	if len(w.samples) < latencyWindowSize {
+		w.samples = append(w.samples, seconds)
+	} else {
+		w.samples[w.next] = seconds
+		w.next = (w.next + 1) % latencyWindowSize
+	}
+	w.count++
+	w.sum += seconds
+}
+
+// JSON data for one operation's latencies in /cache/stats; the percentiles
+// are over the latest answers only
+type opLatency struct {
+	Op     string  `json:"op"`
+	Cached bool    `json:"cached"`
+	Count  uint64  `json:"count"`
+	Mean   float64 `json:"mean_seconds"`
+	P50    float64 `json:"p50_seconds"`
+	P95    float64 `json:"p95_seconds"`
+	P99    float64 `json:"p99_seconds"`
+}
+
+func (l *latencyStruct) stats() []opLatency {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	stats := make([]opLatency, 0, len(l.windows))
+	for key, w := range l.windows {
+		sorted := slices.Clone(w.samples)
+		slices.Sort(sorted)
+
+		stats = append(stats, opLatency{
+			Op:     key.op,
+			Cached: key.cached,
+			Count:  w.count,
+			Mean:   w.sum / float64(w.count),
+			P50:    percentile(sorted, 50),
+			P95:    percentile(sorted, 95),
+			P99:    percentile(sorted, 99),
+		})
+	}
+
+	// uncached first
+	slices.SortFunc(stats, func(a, b opLatency) int {
+		return cmp.Or(strings.Compare(a.Op, b.Op), cmp.Compare(boolRank(a.Cached), boolRank(b.Cached)))
+	})
+
+	return stats
+}
+
+func boolRank(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// nearest rank; sorted mustn't be empty
+func percentile(sorted []float64, p int) float64 {
+	rank := (p*len(sorted) + 99) / 100
+	return sorted[max(rank, 1)-1]
+}
+
+// For the Server-Timing header
+func serverTiming(d time.Duration, cached bool) string {
+	desc := "computed"
+	if cached {
+		desc = "cached"
+	}
+
+	return fmt.Sprintf(`answer;dur=%.3f;desc="%s"`, float64(d)/float64(time.Millisecond), desc)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// -listen may be given more than once, or as a comma-separated list, to
+// serve on several addresses at once
+type listenList []string
+
+func (l *listenList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listenList) Set(value string) error {
+	for _, addr := range strings.Split(value, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr != "" {
+			*l = append(*l, addr)
+		}
+	}
+
+	return nil
+}
+
+var listenFlag listenList
+
+var addrFlag = flag.String("addr", "", "host or IP to listen on when -listen isn't given (all interfaces if empty)")
+var portFlag = flag.Int("port", 8080, "TCP port to listen on when -listen isn't given")
+
+func init() {
+	flag.Var(&listenFlag, "listen", "address to listen on: host:port, unix:/path/to.sock, or systemd:NAME for a socket from systemd; repeatable (default every socket from systemd, or else -addr:-port)")
+}
+
+// The addresses to serve on: -listen, or else every socket systemd passed
+// us, or else the one from -addr and -port
+func listenAddrs() ([]string, error) {
+	if len(listenFlag) > 0 {
+		return listenFlag, nil
+	}
+
+	inherited, err := systemdListeners()
+	if err != nil {
+		return nil, err
+	}
+	if len(inherited) > 0 {
+		addrs := make([]string, len(inherited))
+		for i := range inherited {
+			addrs[i] = "systemd:" + strconv.Itoa(i)
+		}
+		return addrs, nil
+	}
+
+	if *portFlag < 0 || *portFlag > 65535 {
+		return nil, fmt.Errorf("invalid -port %d", *portFlag)
+	}
+
+	return []string{net.JoinHostPort(*addrFlag, strconv.Itoa(*portFlag))}, nil
+}
+
+var socketModeFlag = flag.String("socket-mode", "0660", "permissions for a unix socket, in octal")
+var socketGroupFlag = flag.String("socket-group", "", "group to own a unix socket (defaults to ours)")
+
+// Sockets passed to us by systemd socket activation, in order, with the
+// names from their FileDescriptorName= (the socket unit's name by default)
+type inheritedListener struct {
+	name     string
+	listener net.Listener
+	used     bool
+}
+
+var inheritedListeners []*inheritedListener
+var inheritedOnce sync.Once
+var inheritedErr error
+
+// Picks up the sockets systemd passed in LISTEN_FDS, the first time it's
+// called. See sd_listen_fds(3).
+func systemdListeners() ([]*inheritedListener, error) {
+	inheritedOnce.Do(func() {
+		pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+		count, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+		// not for any children we start
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+
+		if pid != os.Getpid() {
+			return
+		}
+
+		// passed fds start after stdin, stdout and stderr
+		const firstFD = 3
+		for i := 0; i < count; i++ {
+			name := ""
+			if i < len(names) {
+				name = names[i]
+			}
+
+			f := os.NewFile(uintptr(firstFD+i), name)
+			l, err := net.FileListener(f)
+			f.Close() // FileListener made its own copy
+			if err != nil {
+				inheritedErr = fmt.Errorf("socket %d from systemd (%s): %v", i, name, err)
+				return
+			}
+
+			inheritedListeners = append(inheritedListeners, &inheritedListener{name: name, listener: l})
+		}
+	})
+
+	return inheritedListeners, inheritedErr
+}
+
+// The socket from systemd called name, or numbered by its position
+func inheritedListenerFor(name string) (net.Listener, error) {
+	inherited, err := systemdListeners()
+	if err != nil {
+		return nil, err
+	}
+	if len(inherited) == 0 {
+		return nil, errors.New("no sockets were passed by systemd")
+	}
+
+	for i, l := range inherited {
+		if !l.used && (l.name == name || strconv.Itoa(i) == name) {
+			l.used = true
+			return l.listener, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no socket called %q was passed by systemd", name)
+}
+
+// Opens the listener for addr. Addresses starting with "unix:" are unix
+// domain socket paths, and those starting with "systemd:" are sockets
+// passed by systemd; anything else is a TCP address.
+func listen(addr string) (net.Listener, error) {
+	if name, isSystemd := strings.CutPrefix(addr, "systemd:"); isSystemd {
+		return inheritedListenerFor(name)
+	}
+
+	path, isUnix := strings.CutPrefix(addr, "unix:")
+	if !isUnix {
+		return net.Listen("tcp", addr)
+	}
+
+	if path == "" {
+		return nil, errors.New("unix socket path is empty")
+	}
+
+	mode, err := strconv.ParseUint(*socketModeFlag, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -socket-mode %q: %v", *socketModeFlag, err)
+	}
+
+	// A socket left behind by an unclean exit would make Listen fail. Only
+	// remove it if it really is a socket, though.
+	info, err := os.Lstat(path)
+	if err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		os.Remove(path)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Chmod(path, os.FileMode(mode))
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	if *socketGroupFlag != "" {
+		group, err := user.LookupGroup(*socketGroupFlag)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+
+		gid, _ := strconv.Atoi(group.Gid)
+		err = os.Chown(path, -1, gid)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
+// Serves server on every address in addrs until one of them fails, then
+// closes them all. All listeners are opened before any is served, so a bad
+// address is caught before we start taking requests.
+func serveAll(server *http.Server, addrs []string) error {
+	listeners := make([]net.Listener, 0, len(addrs))
+
+	for _, addr := range addrs {
+		l, err := listen(addr)
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return fmt.Errorf("%s: %v", addr, err)
+		}
+
+		listeners = append(listeners, l)
+	}
+
+	errs := make(chan error, len(listeners))
+
+	for i, l := range listeners {
+		// see tls.go
+		_, isUnix := l.(*net.UnixListener)
+		useTLS := server.TLSConfig != nil && !isUnix
+
+		if useTLS {
+			slog.Info("Running web server", "addr", addrs[i], "tls", true)
+		} else {
+			slog.Info("Running web server", "addr", addrs[i])
+		}
+
+		// not ServeTLS; mixing it with Serve on one server breaks HTTP/2
+		if useTLS {
+			l = tls.NewListener(l, server.TLSConfig)
+		}
+
+		go func(addr string, l net.Listener) {
+			err := server.Serve(l)
+			errs <- fmt.Errorf("%s: %w", addr, err)
+		}(addrs[i], l)
+	}
+
+	// The first listener to stop takes the others down with it. If it was
+	// stopped by server.Shutdown, the others are already on their way.
+	err := <-errs
+	if !errors.Is(err, http.ErrServerClosed) {
+		server.Close()
+	}
+
+	return err
+}
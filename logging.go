@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+)
+
+// Logs go through log/slog, as text or JSON (-log-format) on stderr, from
+// -log-level up; the level can be changed on reload. What a line is about
+// goes in fields rather than the message. A request's context is its
+// logger: lines logged with it (slog.InfoContext and so on) carry its
+// request_id (the X-Request-ID it came with, or one made up for it, which
+// is sent back in the response), the client asking, and, from getAnswer on
+// down into the cache, the op being answered. So grep for a request_id to
+// see everything that happened to it.
+//
+// With -log-output syslog or journald, logs go there instead of stderr
+// (where the platform has them), each line at the priority its level maps
+// to. The time and level are left out of the line, since syslog and the
+// journal keep those themselves.
+
+var logFormatFlag = flag.String("log-format", "text", "log format: text or json")
+var logLevelFlag = flag.String("log-level", "info", "least severe log messages to write: debug, info, warn or error")
+
+var logOutputFlag = flag.String("log-output", "stderr", "where logs go: stderr, syslog or journald")
+var syslogAddrFlag = flag.String("syslog-addr", "", "syslog server for -log-output syslog, as udp://HOST:PORT or tcp://HOST:PORT (the local one if empty)")
+var syslogTagFlag = flag.String("syslog-tag", "http-math", "what logs are tagged with in syslog or the journal")
+
+var logLevel = new(slog.LevelVar)
+
+// Opens syslog or the journal (as named by -log-output), returning what
+// sends a line to it; nil where there are no such things.
+var openSystemLog func(output string) (func(level slog.Level, line []byte) error, error)
+
+const requestIDHeader = "X-Request-ID"
+
+// what we'll take from a client as a request ID
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+type requestIDKey struct{}
+type logOpKey struct{}
+
+func init() {
+	registerReload(reloadLogLevel, "log-level")
+}
+
+// Sets up the default logger from the flags. Call it after loadConfig.
+func setUpLogging() error {
+	err := reloadLogLevel()
+	if err != nil {
+		return err
+	}
+
+	opts := &slog.HandlerOptions{Level: logLevel}
+	var out io.Writer = os.Stderr
+	var leveled *leveledWriter
+
+	switch *logOutputFlag {
+	case "stderr":
+	case "syslog", "journald":
+		if openSystemLog == nil {
+			return fmt.Errorf("-log-output %s isn't supported on this platform", *logOutputFlag)
+		}
+
+		send, err := openSystemLog(*logOutputFlag)
+		if err != nil {
+			return fmt.Errorf("can't open %s: %v", *logOutputFlag, err)
+		}
+
+		leveled = &leveledWriter{send: send}
+		out = leveled
+		opts.ReplaceAttr = dropTimeAndLevel
+	default:
+		return fmt.Errorf("invalid -log-output %q: expected stderr, syslog or journald", *logOutputFlag)
+	}
+
+	var handler slog.Handler
+	switch *logFormatFlag {
+	case "text":
+		handler = slog.NewTextHandler(out, opts)
+	case "json":
+		handler = slog.NewJSONHandler(out, opts)
+	default:
+		return fmt.Errorf("invalid -log-format %q: expected text or json", *logFormatFlag)
+	}
+
+	if leveled != nil {
+		handler = leveledHandler{handler, leveled}
+	}
+	handler = newStreamHandler(handler)
+
+	// the log package's output (from libraries) goes here too
+	slog.SetDefault(slog.New(contextHandler{handler}))
+	return nil
+}
+
+func reloadLogLevel() error {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(*logLevelFlag))
+	if err != nil {
+		return fmt.Errorf("invalid -log-level %q: expected debug, info, warn or error", *logLevelFlag)
+	}
+
+	logLevel.Set(level)
+	return nil
+}
+
+// Logs an error and exits, like log.Fatal.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// for syslog and the journal, which keep their own
+func dropTimeAndLevel(groups []string, attr slog.Attr) slog.Attr {
+	if len(groups) == 0 && (attr.Key == slog.TimeKey || attr.Key == slog.LevelKey) {
+		return slog.Attr{}
+	}
+	return attr
+}
+
+// leveledWriter sends each line written to it on at the level of the record
+// being written, which leveledHandler sets.
+type leveledWriter struct {
+	send  func(level slog.Level, line []byte) error
+	level slog.Level
+	mutex sync.Mutex
+}
+
+func (w *leveledWriter) Write(p []byte) (int, error) {
+	err := w.send(w.level, bytes.TrimSuffix(p, []byte("\n")))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// leveledHandler passes each record's level to the leveledWriter its
+// handler writes to. The handlers write a line at a time, so holding the
+// lock around Handle is enough.
+type leveledHandler struct {
+	slog.Handler
+	out *leveledWriter
+}
+
+func (h leveledHandler) Handle(ctx context.Context, record slog.Record) error {
+	h.out.mutex.Lock()
+	defer h.out.mutex.Unlock()
+
+	h.out.level = record.Level
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h leveledHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return leveledHandler{h.Handler.WithAttrs(attrs), h.out}
+}
+
+func (h leveledHandler) WithGroup(name string) slog.Handler {
+	return leveledHandler{h.Handler.WithGroup(name), h.out}
+}
+
+// contextHandler adds what the context knows about the request to each line
+// logged with it.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	if client, ok := ctx.Value(clientKey{}).(string); ok {
+		record.AddAttrs(slog.String("client", client))
+	}
+	if op, ok := ctx.Value(logOpKey{}).(string); ok {
+		record.AddAttrs(slog.String("op", op))
+	}
+
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// The request's ID, or "" outside of one
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// ctx, with what's logged with it saying it's about op
+func logOp(ctx context.Context, op string) context.Context {
+	return context.WithValue(ctx, logOpKey{}, op)
+}
+
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			id = newRequestID()
+		}
+
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// GET /admin/logs/stream tails the log over Server-Sent Events, one JSON
+// line per event, from ?level= up (info by default; debug works even when
+// -log-level doesn't go that low). It's for a quick look at what's going
+// on without a shell on the host. A client that can't keep up misses
+// lines rather than holding up the log; it's told how many it missed.
+
+// lines a stream can fall behind by before they're dropped
+const logStreamBuffer = 256
+
+const logStreamKeepAlive = 15 * time.Second
+
+type logSubscriber struct {
+	level   slog.Level
+	lines   chan []byte
+	dropped atomic.Int64
+}
+
+type logStreamStruct struct {
+	subscribers map[*logSubscriber]bool
+	minLevel    atomic.Int64  // the lowest level anyone wants; MaxInt64 if no one's listening
+	stopped     chan struct{} // closed on shutdown, which would otherwise wait for streams to end
+	mutex       sync.Mutex
+}
+
+var logStream = newLogStream()
+
+func newLogStream() *logStreamStruct {
+	s := &logStreamStruct{subscribers: map[*logSubscriber]bool{}, stopped: make(chan struct{})}
+	s.minLevel.Store(math.MaxInt64)
+
+	return s
+}
+
+func init() {
+	onShutdown(func(ctx context.Context) {
+		close(logStream.stopped)
+	})
+}
+
+// whether anyone's listening for level
+func (s *logStreamStruct) wants(level slog.Level) bool {
+	return int64(level) >= s.minLevel.Load()
+}
+
+// must hold the mutex
+func (s *logStreamStruct) updateMinLevel() {
+	minLevel := int64(math.MaxInt64)
+	for sub := range s.subscribers {
+		minLevel = min(minLevel, int64(sub.level))
+	}
+	s.minLevel.Store(minLevel)
+}
+
+func (s *logStreamStruct) subscribe(level slog.Level) *logSubscriber {
+	sub := &logSubscriber{level: level, lines: make(chan []byte, logStreamBuffer)}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.subscribers[sub] = true
+	s.updateMinLevel()
+
+	return sub
+}
+
+func (s *logStreamStruct) unsubscribe(sub *logSubscriber) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.subscribers, sub)
+	s.updateMinLevel()
+}
+
+// Passes a line on to those who want its level.
+func (s *logStreamStruct) broadcast(level slog.Level, line []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for sub := range s.subscribers {
+		if level < sub.level {
+			continue
+		}
+
+		select {
+		case sub.lines <- append([]byte(nil), line...):
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+
+	return nil
+}
+
+// streamHandler sends records to logStream, as well as to the log itself
+// (at its own level).
+type streamHandler struct {
+	slog.Handler
+	stream slog.Handler // JSON, to logStream
+}
+
+func newStreamHandler(handler slog.Handler) streamHandler {
+	out := &leveledWriter{send: logStream.broadcast}
+	stream := slog.NewJSONHandler(out, &slog.HandlerOptions{Level: slog.Level(math.MinInt)})
+
+	return streamHandler{handler, leveledHandler{stream, out}}
+}
+
+func (h streamHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.Handler.Enabled(ctx, level) || logStream.wants(level)
+}
+
+func (h streamHandler) Handle(ctx context.Context, record slog.Record) error {
+	if logStream.wants(record.Level) {
+		h.stream.Handle(ctx, record)
+	}
+
+	if !h.Handler.Enabled(ctx, record.Level) {
+		return nil
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h streamHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return streamHandler{h.Handler.WithAttrs(attrs), h.stream.WithAttrs(attrs)}
+}
+
+func (h streamHandler) WithGroup(name string) slog.Handler {
+	return streamHandler{h.Handler.WithGroup(name), h.stream.WithGroup(name)}
+}
+
+// GET /admin/logs/stream[?level=LEVEL]. Admin only.
+func doLogStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Usage: curl -N -H 'Authorization: Bearer TOKEN' http://localhost:8080/admin/logs/stream[?level=debug|info|warn|error]",
+			http.StatusMethodNotAllowed)
+		return
+	}
+
+	level := slog.LevelInfo
+	if strVal := r.FormValue("level"); strVal != "" {
+		err := level.UnmarshalText([]byte(strVal))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid level %q: expected debug, info, warn or error", strVal), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// it goes on for as long as they're watching
+	r = withoutDeadline(w, r)
+
+	sub := logStream.subscribe(level)
+	defer logStream.unsubscribe(sub)
+
+	slog.InfoContext(r.Context(), "Log stream started", "min_level", level)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	controller := http.NewResponseController(w)
+	controller.Flush()
+
+	keepAlive := time.NewTicker(logStreamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		var err error
+
+		select {
+		case line := <-sub.lines:
+			if dropped := sub.dropped.Swap(0); dropped > 0 {
+				fmt.Fprintf(w, "event: dropped\ndata: %d\n\n", dropped)
+			}
+			_, err = fmt.Fprintf(w, "data: %s\n\n", line)
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		case <-logStream.stopped:
+			return
+		}
+
+		if err == nil {
+			err = controller.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -1,13 +1,19 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
 	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -18,248 +24,874 @@ type response struct {
 	Y      float64 `json:"y"`
 	Answer float64 `json:"answer"`
 	Cached bool    `json:"cached"`
-}
 
-type cacheEntry struct {
-	key    string
-	answer float64
-	time   time.Time
+	// only when Cached; HitCount only if the cache backend counts them
+	CacheAgeSeconds float64 `json:"cache_age_seconds,omitempty"`
+	HitCount        uint64  `json:"hit_count,omitempty"`
+	Stale           bool    `json:"stale,omitempty"`
 }
 
-// Must be a pointer to cacheEntry, or the cacheEntry will be unaddressable.
-// And if it's unaddressable, then the timestamp can't be updated without
-// assigning a new cacheEntry to the map's key.
-type cacheMap map[string]*cacheEntry
+func newResponse(op string, x float64, y float64, answer float64, hit cacheHit) response {
+	return response{
+		Action:          op,
+		X:               x,
+		Y:               y,
+		Answer:          answer,
+		Cached:          hit.cached,
+		CacheAgeSeconds: hit.age.Seconds(),
+		HitCount:        hit.hits,
+		Stale:           hit.stale,
+	}
+}
 
-type cacheStruct struct {
-	hash  cacheMap // used for quick lookups; key by question string
-	mutex sync.RWMutex
+func getFormFloat(r *http.Request, name string, sess *session) (float64, error) {
+	return parseOperand(name, r.FormValue(name), sess)
 }
 
-const cacheExpireSeconds = 60
-const cacheCleanupInterval = 10
+// sess may be nil; if it isn't, values written as $name are looked up in the
+// session's variables.
+func parseOperand(name string, strVal string, sess *session) (float64, error) {
+	if strVal == "" {
+		return 0, fmt.Errorf("%s is undefined", name)
+	}
 
-var cache *cacheStruct
+	if varName, isVar := strings.CutPrefix(strVal, "$"); isVar {
+		if sess == nil {
+			return 0, fmt.Errorf("%s: variables can only be used in a session", name)
+		}
 
-func newCache() *cacheStruct {
-	c := &cacheStruct{}
-	c.hash = cacheMap{}
+		val, exists := sess.getVar(varName)
+		if !exists {
+			return 0, fmt.Errorf("%s: undefined variable: %v", name, strVal)
+		}
 
-	go c.cleaner()
+		return val, nil
+	}
 
-	return c
+	val, err := strconv.ParseFloat(strVal, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s is not a number: %v", name, strVal)
+	}
+
+	return val, nil
 }
 
-func (c *cacheStruct) get(key string) (float64, bool) {
-	var val float64
+// Alternate spellings accepted for each operand's form value. a/b are what
+// clients of the service we're migrating from send.
+var operandAliases = map[string][]string{
+	"x": {"a", "lhs"},
+	"y": {"b", "rhs"},
+}
 
-	c.mutex.RLock()
-	defer c.mutex.RUnlock()
-	item, exists := c.hash[key]
+// Operands may be given positionally in the path (/add/3/4) instead of as
+// form values. The position of an operand is its index in positional.
+func getOperand(r *http.Request, name string, positional []string, index int, sess *session) (float64, error) {
+	var strVal, given string
 
-	if exists {
-		val = item.answer
-
-		now := time.Now()
-		expireTime := now.Add(time.Second * -cacheExpireSeconds)
+	for _, spelling := range append([]string{name}, operandAliases[name]...) {
+		val := r.FormValue(spelling)
+		if val == "" {
+			continue
+		}
 
-		log.Printf("Age: %fs\n", float32(now.Sub(item.time))/float32(time.Second))
+		if strVal != "" && val != strVal {
+			return 0, fmt.Errorf("%s is given as both %s=%s and %s=%s",
+				name, given, strVal, spelling, val)
+		}
 
-		if item.time.Before(expireTime) {
-			// expired
+		strVal = val
+		given = spelling
+	}
 
-			// We do not delete it from the cache now, because that would require
-			// a write lock, which would delay the return of this function and
-			// block all concurrent read access to the cache. Let the periodic
-			// cleaner do it.
-			return 0, false
+	if index < len(positional) {
+		if strVal != "" && strVal != positional[index] {
+			return 0, fmt.Errorf("%s is given both in the path and as a parameter", name)
 		}
 
-		// not expired; update timestamp
-		item.time = now
+		strVal = positional[index]
 	}
 
-	return val, exists
+	return parseOperand(name, strVal, sess)
 }
 
-func (c *cacheStruct) set(key string, value float64) {
-	now := time.Now()
+func getXY(r *http.Request, sess *session, positional []string) (float64, float64, error) {
+	if len(positional) > 2 {
+		return 0, 0, errors.New("Too many operands in path")
+	}
 
-	entry := &cacheEntry{key, value, now}
+	x, err := getOperand(r, "x", positional, 0, sess)
+	if err != nil {
+		return 0, 0, err
+	}
 
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
+	y, err := getOperand(r, "y", positional, 1, sess)
+	if err != nil {
+		return 0, 0, err
+	}
 
-	c.hash[key] = entry
+	return x, y, nil
 }
 
-func (c *cacheStruct) removeKeys(expList []string) {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
+// Other names clients use for the operations, mapped to the canonical name.
+// Symbols have to be URL-encoded in the path (%2B for +). There's no "/":
+// proxies and older ServeMux versions decode %2F and clean the path, so it
+// would never get here.
+var operationAliases = map[string]string{
+	"+":     "add",
+	"plus":  "add",
+	"sum":   "add",
+	"-":     "subtract",
+	"sub":   "subtract",
+	"minus": "subtract",
+	"*":     "multiply",
+	"mul":   "multiply",
+	"times": "multiply",
+	"div":   "divide",
+}
 
-	for _, key := range(expList) {
-		delete(c.hash, key)
+// returns the canonical name of op; unknown names are returned unchanged
+func canonicalOp(op string) string {
+	canonical, exists := operationAliases[op]
+	if exists {
+		return canonical
 	}
+
+	return op
 }
 
-func (c *cacheStruct) cleanup() {
-	now := time.Now()
-	expireTime := now.Add(time.Second * -cacheExpireSeconds)
+// Make a question string. This ensures that the map will have a unique
+// and hashable key for each question. Originally, I used r.URL as the
+// key, but it would make duplicate cache entries if x and y were swapped
+// in the query string, or if extra data was added to the query.
+//
+// For commutative operations the operands are put in order too, so 2+3 and
+// 3+2 share an entry. Operations past version 1 have it added on the end, so
+// answers cached before their implementation changed aren't used.
+func questionKey(op string, x float64, y float64) string {
+	op = canonicalOp(op)
+	impl := operations[op]
+
+	if impl.commutative && x > y {
+		x, y = y, x
+	}
+
+	if impl.version > 1 {
+		return fmt.Sprintf("%s;%v;%v;v%d", op, x, y, impl.version)
+	}
 
-	// list of things to delete
-	expList := make([]string, 5)
+	return fmt.Sprintf("%s;%v;%v", op, x, y)
+}
 
-	// only obtain a RLock for now
-	c.mutex.RLock()
-	defer c.mutex.RUnlock()
+// An error that will always happen for the same question, so it can be
+// cached like an answer.
+type domainError string
 
-	log.Printf("Cache size: %d\n", len(c.hash))
-	for key, value := range c.hash {
-		if value.time.Before(expireTime) {
-			log.Printf("Expired: %v\n", key)
-			expList = append(expList, key)
-		}
-	}
+func (err domainError) Error() string {
+	return string(err)
+}
 
-	if len(expList) > 1 {
-		// do actual cleanup in a separate goroutine while holding a write Lock.
-		go c.removeKeys(expList)
-	}
+type operation struct {
+	fn          func(x float64, y float64) (float64, error)
+	commutative bool // swapping x and y doesn't change the answer
+	// Bump this when a change to fn changes any answer (a bug fix, different
+	// precision), so the old ones drop out of the cache on deploy.
+	version int
 }
 
-// runs in a separate goroutine
-func (c *cacheStruct) cleaner() {
-	for {
-		time.Sleep(time.Second * cacheCleanupInterval)
-		c.cleanup()
-	}
+// The operations, by canonical name
+var operations = map[string]operation{
+	"add": {
+		fn:          func(x, y float64) (float64, error) { return x + y, nil },
+		commutative: true,
+		version:     1,
+	},
+	"subtract": {
+		fn:      func(x, y float64) (float64, error) { return x - y, nil },
+		version: 1,
+	},
+	"multiply": {
+		fn:          func(x, y float64) (float64, error) { return x * y, nil },
+		commutative: true,
+		version:     1,
+	},
+	"divide": {
+		fn:      divide,
+		version: 1,
+	},
 }
 
-func getFormFloat(r *http.Request, name string) (float64, error) {
-	strVal := r.FormValue(name)
-	if strVal == "" {
-		return 0, fmt.Errorf("%s is undefined", name)
+func divide(x float64, y float64) (float64, error) {
+	// Floating point division is not subject to divide-by-zero error,
+	// but JSON cannot handle Inf, so we check here to provide a nicer
+	// error message.
+	if y == 0 {
+		return 0, domainError("Cannot divide by zero")
 	}
 
-	val, err := strconv.ParseFloat(strVal, 64)
-	if err != nil {
-		return 0, fmt.Errorf("%s is not a number: %v", name, strVal)
+	return x / y, nil
+}
+
+// Works out an answer, without the cache.
+func compute(op string, x float64, y float64) (float64, error) {
+	// Note: invalid operations won't be passed to doMath
+	impl, exists := operations[op]
+	if !exists {
+		return 0, fmt.Errorf("Invalid operation: %s", op)
 	}
 
-	return val, nil
+	return impl.fn(x, y)
 }
 
-func getXY(r *http.Request) (float64, float64, error) {
-	x, err := getFormFloat(r, "x")
+// How an answer came from the cache; the zero value means it didn't
+type cacheHit struct {
+	cached bool
+	age    time.Duration // since it was worked out
+	hits   uint64        // times it's come from the cache, counting this one
+	stale  bool          // past its TTL; a fresh one is being worked out
+}
+
+// With fresh set, the answer is worked out even if it's cached (and the
+// cache gets the fresh one).
+func getAnswer(ctx context.Context, op string, x float64, y float64, fresh bool) (float64, cacheHit, error) {
+	return lookupAnswer(ctx, op, x, y, fresh, true)
+}
+
+// askPeers is false when answering for another peer, so the question isn't
+// passed around again if the two don't agree on who owns it.
+func lookupAnswer(ctx context.Context, op string, x float64, y float64, fresh bool, askPeers bool) (answer float64, hit cacheHit, err error) {
+	op = canonicalOp(op)
+	ctx = logOp(ctx, op)
+
+	start := time.Now()
+	ctx, span := startSpan(ctx, "getAnswer", spanAttr{"op", op}, spanAttr{"x", x}, spanAttr{"y", y}, spanAttr{"fresh", fresh})
+	defer func() {
+		span.setAttr("cached", hit.cached)
+		span.end(err)
+
+		if err == nil {
+			latencies.record(op, hit.cached, time.Since(start))
+			clientStats.answered(requestClient(ctx), hit.cached)
+			hotQuestions.record(op, x, y, hit.cached)
+		}
+		auditLog.record(ctx, op, x, y, answer, hit.cached, time.Since(start), err)
+	}()
+
+	err = checkOpEnabled(op)
 	if err != nil {
-		return 0, 0, err
+		return 0, cacheHit{}, err
 	}
 
-	y, err := getFormFloat(r, "y")
+	err = checkOpAllowed(ctx, op)
 	if err != nil {
-		return 0, 0, err
+		return 0, cacheHit{}, err
 	}
 
-	return x, y, nil
-}
+	reqString := questionKey(op, x, y)
 
-func getAnswer(op string, x float64, y float64) (float64, bool, error) {
-	// Make a question string. This ensures that the map will have a unique
-	// and hashable key for each question. Originally, I used r.URL as the
-	// key, but it would make duplicate cache entries if x and y were swapped
-	// in the query string, or if extra data was added to the query.
-	reqString := fmt.Sprintf("%s;%v;%v", op, x, y)
+	if !fresh {
+		_, cacheSpan := startSpan(ctx, "cache.Get", spanAttr{"key", reqString})
+		cacheStart := time.Now()
+		cached, exists := cache.Get(ctx, reqString)
+		addTiming(ctx, timingCache, time.Since(cacheStart))
+		cacheSpan.setAttr("hit", exists)
+		cacheSpan.end(nil)
 
-	var answer float64
+		if exists {
+			hit := cacheHit{cached: true, hits: cached.hits, stale: cached.stale}
+			if !cached.set.IsZero() {
+				hit.age = time.Since(cached.set)
+			}
 
-	cacheAnswer, exists := cache.get(reqString)
+			if cached.stale {
+				// serve it now, and have a fresh one ready for next time
+				go refreshAnswer(context.WithoutCancel(ctx), op, x, y, reqString, askPeers)
+			}
 
-	if exists {
-		answer = cacheAnswer
-	} else {
+			return cached.answer, hit, cached.error()
+		}
+	}
 
-		// Note: invalid operations won't be passed to doMath
-		switch op {
-		case "add":
-			answer = x + y
-		case "subtract":
-			answer = x - y
-		case "multiply":
-			answer = x * y
-		case "divide":
-			// Floating point division is not subject to divide-by-zero error,
-			// but JSON cannot handle Inf, so we check here to provide a nicer
-			// error message.
-			if y == 0 {
-				return 0, false, errors.New("Cannot divide by zero")
-			}
+	answer, err = refreshAnswer(ctx, op, x, y, reqString, askPeers)
+	return answer, cacheHit{}, err
+}
 
-			answer = x / y
-		default:
-			return 0, false, fmt.Errorf("Invalid operation: %s", op)
+// Works out an answer (or gets it from the peer that owns it) and caches it.
+//
+// Whoever asks first does the work for everyone waiting on it, so it
+// carries on if they go away; ctx is only used for tracing.
+func refreshAnswer(ctx context.Context, op string, x float64, y float64, reqString string, askPeers bool) (float64, error) {
+	ctx = context.WithoutCancel(ctx)
+
+	// if the same question is already being worked out, wait for that
+	// instead of working it out again
+	return inFlight.do(reqString, func() (float64, error) {
+		start := time.Now()
+		defer func() {
+			addTiming(ctx, timingCompute, time.Since(start))
+		}()
+
+		if askPeers && peers != nil {
+			answer, asked, err := peers.ask(ctx, op, x, y, reqString)
+			if asked {
+				cacheOutcome(ctx, reqString, answer, err)
+				return answer, err
+			}
 		}
 
-		cache.set(reqString, answer)
-	}
+		_, span := startSpan(ctx, "compute", spanAttr{"op", op})
+		answer, err := compute(op, x, y)
+		span.end(err)
 
-	return answer, exists, nil
+		cacheOutcome(ctx, reqString, answer, err)
+
+		return answer, err
+	})
+}
+
+// Caches an answer, or the error if it's one that will always happen.
+func cacheOutcome(ctx context.Context, reqString string, answer float64, err error) {
+	_, span := startSpan(ctx, "cache.Set", spanAttr{"key", reqString})
+	defer span.end(nil)
+
+	var domainErr domainError
+	if err == nil {
+		cache.Set(ctx, reqString, cachedAnswer{answer: answer, set: time.Now()})
+	} else if errors.As(err, &domainErr) && negativeCaching.Load() {
+		cache.Set(ctx, reqString, cachedAnswer{err: domainErr.Error(), set: time.Now()})
+	}
 }
 
 func doMath(w http.ResponseWriter, r *http.Request) {
-	op := r.URL.Path[1:]
+	// answerMath unescapes each segment itself
+	op := r.URL.EscapedPath()[1:]
 
 	if op == "" {
 		fmt.Fprintln(w, "Usage: curl http://localhost:8080/{OP}?x={X}&y={Y}\n"+
+			"       curl http://localhost:8080/{OP}/{X}/{Y}\n"+
 			"\n"+
 			"OP: operation (add, subtract, multiply, divide\n"+
-			"X, Y: parameters")
+			"    or an alias: + plus sum, - sub minus, * mul times, div)\n"+
+			"X, Y: parameters (also accepted as a, b or lhs, rhs)\n"+
+			"With -api-keys, send one in the X-API-Key header; with -jwt-issuer,\n"+
+			"a JWT from the issuer in Authorization: Bearer works too (or with\n"+
+			"-introspection-url, an opaque token the server says is active); with\n"+
+			"-basic-auth-users, so does Basic auth (curl -u USER:PASSWORD), and with\n"+
+			"-hmac-keys, signing requests (X-Signature-Key, X-Signature-Timestamp, X-Signature)\n"+
+			"Add nocache=1 (or send Cache-Control: no-cache) to skip cached answers\n"+
+			"Responses are JSON, or as asked for by the Accept header or\n"+
+			"format=json|xml|yaml|msgpack|text|ndjson\n"+
+			"\n"+
+			"Chained operations: curl -X POST http://localhost:8080/chain "+
+			`-d '{"x": X, "steps": [{"op": OP, "y": Y}, ...]}'`+"\n"+
+			"\n"+
+			"Sessions: curl http://localhost:8080/session/{ID}/set?name={NAME}&value={V}\n"+
+			"          curl http://localhost:8080/session/{ID}/{OP}?x=$NAME&y=$ans\n"+
+			"\n"+
+			"History: curl http://localhost:8080/history[?session={ID}]\n"+
+			"\n"+
+			"Jobs: curl -X POST http://localhost:8080/jobs "+
+			`-d '{"items": [{"op": OP, "x": X, "y": Y}, ...], "callback_url": URL}'`+"\n"+
+			"      curl [-X DELETE] http://localhost:8080/jobs/{JOB}\n"+
+			"\n"+
+			"Batch: curl -X POST http://localhost:8080/batch "+
+			`-d '{"items": [{"op": OP, "x": X, "y": Y}, ...]}'`+"\n"+
+			"       (add -H 'Accept: application/x-ndjson' to stream the answers)\n"+
+			"\n"+
+			"CSV batch: curl -F file=@questions.csv http://localhost:8080/batch/csv[?download=1]\n"+
+			"           (one op,x,y per row)\n"+
+			"\n"+
+			"Web UI: http://localhost:8080/ui/ (API explorer: /ui/explorer.html)\n"+
+			"Cache statistics: curl http://localhost:8080/cache/stats\n"+
+			"Metrics (Prometheus): curl http://localhost:8080/metrics\n"+
+			"Runtime statistics (expvar): curl http://localhost:8080/debug/vars\n"+
+			"Health: curl http://localhost:8080/healthz (up) or /readyz (ready for traffic)\n"+
+			"Version: curl http://localhost:8080/version\n"+
+			"Operations: curl http://localhost:8080/ops\n"+
+			"Quota left: curl http://localhost:8080/quota\n"+
+			"Admin endpoints need -admin-token; with -admin-listen, they're only on that listener\n"+
+			"Cache purge (admin): curl -X DELETE http://localhost:8080/cache[/{OP}/{X}/{Y}]\n"+
+			"Reload configuration (admin): curl -X POST http://localhost:8080/reload\n"+
+			"Enable/disable an operation (admin): curl -X PUT http://localhost:8080/ops/{OP}?enabled=true|false\n"+
+			"Maintenance mode (admin): curl -X PUT|DELETE http://localhost:8080/maintenance\n"+
+			"Usage by client (admin): curl http://localhost:8080/stats/clients[?limit=N]\n"+
+			"Questions asked most (admin): curl http://localhost:8080/stats/top[?n=N]\n"+
+			"Log stream (admin): curl -N http://localhost:8080/admin/logs/stream[?level=debug|info|warn|error]\n"+
+			"Allowed/denied networks (admin): curl http://localhost:8080/admin/ips\n"+
+			"                                 curl -X PUT|DELETE http://localhost:8080/admin/ips/{allow|deny}?cidr={CIDR}\n"+
+			"Bans (admin): curl [-X DELETE] http://localhost:8080/admin/bans[?client={CLIENT}]\n"+
+			"Cache export/import (admin): curl http://localhost:8080/cache/export > cache.json\n"+
+			"                             curl --data-binary @cache.json http://localhost:8080/cache/import")
 
 		return
 	}
 
-	x, y, err := getXY(r)
+	answerMath(w, r, op, nil)
+}
+
+// answers a single computation; sess is nil outside of a session. path is
+// the still-escaped operation, optionally followed by positional operands:
+// OP[/X[/Y]]
+func answerMath(w http.ResponseWriter, r *http.Request, path string, sess *session) {
+	start := time.Now()
+
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil {
+			httpFail(w, err)
+			return
+		}
+		segments[i] = unescaped
+	}
+
+	op := canonicalOp(segments[0])
+	positional := segments[1:]
+
+	parseStart := time.Now()
+	x, y, err := getXY(r, sess, positional)
+	addTiming(r.Context(), timingParse, time.Since(parseStart))
+	if err != nil {
+		httpFail(w, err)
+		return
+	}
+
+	err = spendQuota(r.Context(), 1)
 	if err != nil {
 		httpFail(w, err)
 		return
 	}
 
-	answer, cached, err := getAnswer(op, x, y)
+	answerStart := time.Now()
+	answer, hit, err := getAnswer(r.Context(), op, x, y, wantsFresh(r))
 	if err != nil {
+		refundQuota(r.Context(), 1)
 		httpFail(w, err)
 		return
 	}
+	w.Header().Set("Server-Timing", serverTiming(time.Since(answerStart), hit.cached))
+
+	slog.DebugContext(r.Context(), "Answered", "op", op, "x", x, "y", y, "cached", hit.cached,
+		"age", hit.age, "duration", time.Since(start))
+
+	if sess != nil {
+		sess.setVar(sessionAnsVariable, answer)
+	}
 
-	data := response{
+	history.add(clientID(r, sess), historyEntry{
+		Time:   time.Now(),
 		Action: op,
 		X:      x,
 		Y:      y,
 		Answer: answer,
-		Cached: cached,
+		Cached: hit.cached,
+	})
+
+	etag := etagFor(questionKey(op, x, y), responseFormat(r))
+	w.Header().Set("ETag", etag)
+
+	if (r.Method == http.MethodGet || r.Method == http.MethodHead) && etagMatches(r, etag) {
+		w.Header().Add("Vary", "Accept")
+		w.WriteHeader(http.StatusNotModified)
+		return
 	}
 
-	ret, err := json.Marshal(data)
+	data := newResponse(op, x, y, answer, hit)
+
+	writeData(w, r, http.StatusOK, data)
+}
+
+// writes data in the format negotiated with the client; see negotiate.go
+func writeData(w http.ResponseWriter, r *http.Request, status int, data interface{}) {
+	w.Header().Add("Vary", "Accept")
+
+	callback, err := jsonpCallback(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if callback != "" {
+		writeJSONP(w, status, callback, data)
+		return
+	}
+
+	enc, err := negotiate(r)
+	if err == errNotAcceptable {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+	if err != nil {
+		httpFail(w, err)
+		return
+	}
+
+	encodeStart := time.Now()
+	ret, err := enc.marshal(data)
+	addTiming(r.Context(), timingEncode, time.Since(encodeStart))
 	if err != nil {
 		httpFail(w, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Type", enc.contentType)
+	w.WriteHeader(status)
 
 	fmt.Fprintf(w, "%s", ret)
 }
 
 func httpFail(w http.ResponseWriter, err error) {
+	if httpTooLarge(w, err) || httpOpDisabled(w, err) || httpOpForbidden(w, err) || httpQuotaExceeded(w, err) {
+		return
+	}
+
 	http.Error(w, err.Error(), http.StatusInternalServerError)
-	log.Printf("Error: %v\n", err)
+	noteError(w, err)
+	slog.Error("Request failed", "request_id", w.Header().Get(requestIDHeader), "err", err)
+}
+
+var http2Flag = flag.Bool("http2", true, "allow HTTP/2 on TLS connections")
+var h2cFlag = flag.Bool("h2c", false, "allow cleartext HTTP/2 (h2c) from clients with prior knowledge")
+
+// So slow or idle clients can't hold connections open forever
+var readHeaderTimeoutFlag = flag.Duration("read-header-timeout", 10*time.Second, "how long a client gets to send a request's headers (0 for no limit)")
+var readTimeoutFlag = flag.Duration("read-timeout", 30*time.Second, "how long a client gets to send a whole request, body included (0 for no limit)")
+var writeTimeoutFlag = flag.Duration("write-timeout", 60*time.Second, "how long a response may take to write, from the end of the request's headers; this caps streamed batches too (0 for no limit)")
+var idleTimeoutFlag = flag.Duration("idle-timeout", 120*time.Second, "how long to keep an idle keep-alive connection open (0 for -read-timeout)")
+var maxHeaderBytesFlag = flag.Int("max-header-bytes", http.DefaultMaxHeaderBytes, "largest request headers to accept, in bytes")
+
+func serverProtocols() *http.Protocols {
+	protocols := &http.Protocols{}
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(*http2Flag)
+	protocols.SetUnencryptedHTTP2(*h2cFlag)
+
+	return protocols
 }
 
+var shutdownTimeoutFlag = flag.Duration("shutdown-timeout", 10*time.Second, "how long to let requests and jobs in flight finish when shutting down, before cutting them off")
+
+// Run alongside server.Shutdown by stopOnSignal, for whatever else has work
+// in flight. Each returns once it's finished, or ctx is done.
+var shutdownHooks []func(ctx context.Context)
+
+func onShutdown(hook func(ctx context.Context)) {
+	shutdownHooks = append(shutdownHooks, hook)
+}
+
+// Shuts server down gracefully on SIGINT or SIGTERM: the listeners close
+// straight away, idle connections are dropped, and requests and jobs in
+// flight get -shutdown-timeout to finish. The returned channel is closed
+// once they have (or were cut off). The cache is left to the caller.
+func stopOnSignal(server *http.Server) chan struct{} {
+	stopped := make(chan struct{})
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		slog.Info("Shutting down", "signal", sig)
+
+		// see health.go
+		shuttingDown.Store(true)
+		if *shutdownDelayFlag > 0 {
+			time.Sleep(*shutdownDelayFlag)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeoutFlag)
+		defer cancel()
+
+		var hooks sync.WaitGroup
+		for _, hook := range shutdownHooks {
+			hooks.Add(1)
+			go func() {
+				defer hooks.Done()
+				hook(ctx)
+			}()
+		}
+
+		err := server.Shutdown(ctx)
+		if err != nil {
+			slog.Warn("Requests still running, cutting them off", "after", *shutdownTimeoutFlag)
+			server.Close()
+		}
+
+		hooks.Wait()
+		close(stopped)
+	}()
+
+	return stopped
+}
+
+// The API's routes. Not http.DefaultServeMux, which net/http/pprof adds
+// itself to; profiles are only on -pprof-addr.
+var publicMux = http.NewServeMux()
+
+// set by http3.go when built with -tags http3; starts the QUIC listener and
+// returns the handler to use on the TCP listeners
+var startHTTP3 func(handler http.Handler) http.Handler
+
 func main() {
-	cache = newCache()
-	log.Println("Running web server on port 8080")
+	flag.Parse()
+
+	if *versionFlag {
+		fmt.Println(buildInfo())
+		return
+	}
+
+	err := loadConfig()
+	if err != nil {
+		fatal("Can't start", "err", err)
+	}
+
+	if *printConfigFlag {
+		printConfig(os.Stdout)
+		return
+	}
+
+	err = setUpLogging()
+	if err != nil {
+		fatal("Can't start", "err", err)
+	}
+	logConfig()
+
+	slowRequestThreshold.Store(int64(*slowRequestFlag))
+
+	err = openAccessLog()
+	if err != nil {
+		fatal("Can't start", "err", err)
+	}
+
+	err = openAuditLog()
+	if err != nil {
+		fatal("Can't start", "err", err)
+	}
+
+	err = loadAPIKeys()
+	if err != nil {
+		fatal("Can't start", "err", err)
+	}
+
+	err = loadBasicAuth()
+	if err != nil {
+		fatal("Can't start", "err", err)
+	}
+
+	err = loadRateLimit()
+	if err != nil {
+		fatal("Can't start", "err", err)
+	}
+
+	err = loadBans()
+	if err != nil {
+		fatal("Can't start", "err", err)
+	}
+
+	err = loadMaxInFlight()
+	if err != nil {
+		fatal("Can't start", "err", err)
+	}
+
+	err = loadHMACKeys()
+	if err != nil {
+		fatal("Can't start", "err", err)
+	}
+
+	err = loadQuotas()
+	if err != nil {
+		fatal("Can't start", "err", err)
+	}
+
+	err = loadQuotaFile()
+	if err != nil {
+		fatal("Can't start", "err", err)
+	}
+	go saveQuotasPeriodically()
+
+	err = loadOpPermissions()
+	if err != nil {
+		fatal("Can't start", "err", err)
+	}
+
+	err = loadOpSwitches()
+	if err != nil {
+		fatal("Can't start", "err", err)
+	}
+
+	err = parseTrustedProxies(*trustedProxiesFlag)
+	if err != nil {
+		fatal("Can't start", "err", err)
+	}
+
+	err = loadIPFilter()
+	if err != nil {
+		fatal("Can't start", "err", err)
+	}
+
+	err = loadSecurityHeaders()
+	if err != nil {
+		fatal("Can't start", "err", err)
+	}
+
+	cacheOpts, err := cacheOptionsFromFlags()
+	if err != nil {
+		fatal("Can't start", "err", err)
+	}
+
+	negativeCaching.Store(cacheOpts.negativeTTL > 0)
+
+	cache, err = newCacheBackend(*cacheBackendFlag, cacheOpts)
+	if err != nil {
+		fatal("Can't start", "err", err)
+	}
+
+	if *cacheInvalidationFlag != "" {
+		cache, err = withInvalidation(cache, *cacheInvalidationFlag)
+		if err != nil {
+			fatal("Can't start", "err", err)
+		}
+	}
+
+	err = loadCacheFile()
+	if err != nil {
+		fatal("Error loading cache", "err", err)
+	}
+
+	if *cacheWarmFlag != "" {
+		err = warmCache(*cacheWarmFlag)
+		if err != nil {
+			fatal("Error warming cache", "err", err)
+		}
+	}
+
+	if *peersFlag != "" {
+		peers, err = newPeerRing(*peersFlag, *peerSelfFlag)
+		if err != nil {
+			fatal("Can't start", "err", err)
+		}
+
+		publicMux.HandleFunc("/peer/answer", requireAuth(doPeerAnswer))
+	}
+
+	idempotency = newIdempotencyStore()
+	sessions = newSessionStore()
+	history = newHistoryStore()
+	jobs = newJobStore()
+	onShutdown(jobs.drain)
 
 	// Only allow valid operations to be sent to doMath
-	http.HandleFunc("/", doMath)
+	publicMux.HandleFunc("/", requireAuth(withMaintenance(withIdempotency(withQuota(doMath)))))
+	publicMux.HandleFunc("/chain", requireAuth(withMaintenance(withIdempotency(withQuota(doChain)))))
+	publicMux.HandleFunc("/session/", requireAuth(withMaintenance(withIdempotency(withQuota(doSession)))))
+	publicMux.HandleFunc("/history", requireAuth(doHistory))
+	publicMux.HandleFunc("/quota", requireAuth(doQuota))
+	publicMux.HandleFunc("/jobs", requireAuth(withMaintenance(withIdempotency(withQuota(doJobs)))))
+	publicMux.HandleFunc("/jobs/", requireAuth(doJobs))
+	publicMux.HandleFunc("/batch", requireAuth(withMaintenance(withIdempotency(withQuota(doBatch)))))
+	publicMux.HandleFunc("/batch/csv", requireAuth(withMaintenance(withIdempotency(withQuota(doBatchCSV)))))
+	handleAdmin("/cache", doCachePurge)
+	handleAdmin("/cache/", doCacheKey)
+	publicMux.HandleFunc("/cache/stats", doCacheStats)
+	handleAdmin("/cache/export", doCacheExport)
+	handleAdmin("/cache/import", doCacheImport)
+	publicMux.HandleFunc("/metrics", doMetrics)
+	publicMux.HandleFunc("/debug/vars", doExpvar)
+	handleAdmin("/reload", doReload)
+	publicMux.HandleFunc("/healthz", doHealthz)
+	publicMux.HandleFunc("/version", doVersion)
+	publicMux.HandleFunc("/readyz", doReadyz)
+	publicMux.HandleFunc("/ops", doOps)
+	handleAdmin("/ops/", doOpSwitch)
+	handleAdmin("/maintenance", doMaintenance)
+	publicMux.HandleFunc("/ui/", doAssets)
+	handleAdmin("/stats/clients", doClientStats)
+	handleAdmin("/stats/top", doTopQuestions)
+	handleAdmin("/admin/logs/stream", doLogStream)
+	handleAdmin("/admin/ips", doIPFilter)
+	handleAdmin("/admin/ips/", doIPFilterList)
+	handleAdmin("/admin/bans", doBans)
+
+	err = startSentry()
+	if err != nil {
+		fatal("Can't start", "err", err)
+	}
+
+	err = startJWT()
+	if err != nil {
+		fatal("Can't start", "err", err)
+	}
+
+	err = startIntrospection()
+	if err != nil {
+		fatal("Can't start", "err", err)
+	}
 
-	err := http.ListenAndServe(":8080", nil)
-	log.Printf("Error: %v", err)
+	err = startStatsd()
+	if err != nil {
+		fatal("Can't start", "err", err)
+	}
+
+	err = startPprof()
+	if err != nil {
+		fatal("Can't start", "err", err)
+	}
+
+	err = startAdminListener()
+	if err != nil {
+		fatal("Can't start", "err", err)
+	}
+
+	if *mqttBrokerFlag != "" {
+		go runMQTTBridge(*mqttBrokerFlag)
+	}
+
+	handler := withRequestID(withSecurityHeaders(withAccessLog(withMetrics(withConcurrencyLimit(withSlowLog(withSentry(withRealIP(withIPFilter(withIPBans(withIPRateLimit(withAPIKey(withJWT(withIntrospection(withBasicAuth(withSignature(withOpPermissions(withClient(withBans(withRateLimit(withCompression(withDeadline(withBodyLimit(publicMux)))))))))))))))))))))))
+	if startTracing != nil {
+		handler = startTracing(handler)
+	}
+	if startHTTP3 != nil {
+		handler = startHTTP3(handler)
+	}
+
+	server := &http.Server{
+		Handler:           handler,
+		Protocols:         serverProtocols(),
+		ReadHeaderTimeout: *readHeaderTimeoutFlag,
+		ReadTimeout:       *readTimeoutFlag,
+		WriteTimeout:      *writeTimeoutFlag,
+		IdleTimeout:       *idleTimeoutFlag,
+		MaxHeaderBytes:    *maxHeaderBytesFlag,
+	}
+
+	server.TLSConfig, err = tlsConfigFromFlags()
+	if err != nil {
+		fatal("Can't start", "err", err)
+	}
+
+	addrs, err := listenAddrs()
+	if err != nil {
+		fatal("Can't start", "err", err)
+	}
+
+	slog.Info("Starting", "version", buildInfo().String())
+
+	stopped := stopOnSignal(server)
+	reloadOnSignal()
+
+	err = serveAll(server, addrs)
+	if errors.Is(err, http.ErrServerClosed) {
+		<-stopped
+	} else {
+		slog.Error("Server stopped", "err", err)
+	}
+
+	err = saveCacheFile()
+	if err != nil {
+		slog.Error("Error saving cache", "err", err)
+	}
+
+	err = saveQuotaFile()
+	if err != nil {
+		slog.Error("Error saving quota usage", "err", err)
+	}
+	cache.Close()
 }
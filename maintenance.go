@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// In maintenance mode the endpoints that work answers out (/, /chain,
+// /session/, /batch, /batch/csv and POST /jobs) answer 503 with Retry-After
+// and the code "maintenance", while health, admin and everything else keeps
+// working, and /readyz fails. Jobs already running carry on. An admin turns
+// it on and off:
+//
+//	curl -X PUT 'http://localhost:8080/maintenance?retry_after=10m&message=Moving+the+cache'
+//	curl -X DELETE http://localhost:8080/maintenance
+
+var maintenanceRetryAfterFlag = flag.Duration("maintenance-retry-after", time.Minute, "Retry-After to send in maintenance mode, unless one is given when turning it on")
+
+type maintenanceState struct {
+	since      time.Time
+	retryAfter time.Duration
+	message    string
+}
+
+// nil when we're not in maintenance mode
+var maintenance atomic.Pointer[maintenanceState]
+
+var errMaintenance = errors.New("In maintenance mode")
+
+func init() {
+	registerReadiness("maintenance", func() error {
+		if maintenance.Load() != nil {
+			return errMaintenance
+		}
+		return nil
+	})
+}
+
+func withMaintenance(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		state := maintenance.Load()
+		if state == nil || (r.Method != http.MethodPost && r.URL.Path == "/jobs") {
+			handler(w, r)
+			return
+		}
+
+		message := state.message
+		if message == "" {
+			message = "Down for maintenance; try again later"
+		}
+
+		seconds := int(state.retryAfter.Round(time.Second).Seconds())
+		w.Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+		httpErrorCode(w, http.StatusServiceUnavailable, "maintenance", message)
+	}
+}
+
+// JSON data for GET /maintenance
+type maintenanceResponse struct {
+	Maintenance bool       `json:"maintenance"`
+	Since       *time.Time `json:"since,omitempty"`
+	RetryAfter  float64    `json:"retry_after_seconds,omitempty"`
+	Message     string     `json:"message,omitempty"`
+}
+
+// GET /maintenance says whether we're in maintenance mode, PUT turns it on
+// (with optional retry_after and message), and DELETE turns it off. Admin
+// only.
+func doMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		var data maintenanceResponse
+		if state := maintenance.Load(); state != nil {
+			data = maintenanceResponse{
+				Maintenance: true,
+				Since:       &state.since,
+				RetryAfter:  state.retryAfter.Seconds(),
+				Message:     state.message,
+			}
+		}
+
+		writeData(w, r, http.StatusOK, data)
+		return
+	case http.MethodPut:
+		query := r.URL.Query()
+		state := &maintenanceState{
+			since:      time.Now(),
+			retryAfter: *maintenanceRetryAfterFlag,
+			message:    query.Get("message"),
+		}
+
+		if query.Has("retry_after") {
+			retryAfter, err := time.ParseDuration(query.Get("retry_after"))
+			if err != nil || retryAfter < 0 {
+				http.Error(w, "Invalid retry_after; expected a duration like 10m", http.StatusBadRequest)
+				return
+			}
+			state.retryAfter = retryAfter
+		}
+
+		maintenance.Store(state)
+		slog.InfoContext(r.Context(), "Maintenance mode on")
+	case http.MethodDelete:
+		if maintenance.Swap(nil) != nil {
+			slog.InfoContext(r.Context(), "Maintenance mode off")
+		}
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		http.Error(w, "Usage: curl -X PUT|DELETE -H 'Authorization: Bearer TOKEN' http://localhost:8080/maintenance",
+			http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
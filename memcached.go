@@ -0,0 +1,239 @@
+//go:build memcached
+
+package main
+
+// The memcached cache needs gomemcache, so it is only compiled in with:
+// go build -tags memcached
+//
+// Keys are spread across -memcached-servers by gomemcache. A server that
+// can't be reached just means misses, and the answers get recomputed.
+//
+// memcached can't list keys, so Purge can't delete just ours. Instead each
+// key includes a generation number, kept in memcached itself, and Purge
+// increments it; the old generation's answers are never asked for again, and
+// expire or get evicted in their own time. Other replicas pick up the new
+// generation within -cache-cleanup-interval.
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+var memcachedServersFlag = flag.String("memcached-servers", "localhost:11211", "comma-separated memcached servers for -cache-backend=memcached")
+var memcachedPrefixFlag = flag.String("memcached-prefix", "http-math:", "prefix for cache keys in memcached, so it can be shared with other things")
+var memcachedTimeoutFlag = flag.Duration("memcached-timeout", 500*time.Millisecond, "how long to wait on a memcached server before giving up")
+var memcachedMaxIdleFlag = flag.Int("memcached-max-idle", 16, "idle connections to keep open per memcached server")
+
+func init() {
+	cacheBackends["memcached"] = newMemcachedCache
+}
+
+// memcached treats expirations over 30 days as a unix time instead
+const memcachedMaxRelativeExpiration = 30 * 24 * time.Hour
+
+type memcachedCache struct {
+	client  *memcache.Client
+	prefix  string
+	opts    cacheOptions
+	gen     atomic.Uint64 // see genKey
+	stop    context.CancelFunc
+	stopped chan struct{}
+	down    atomic.Bool // so outages are logged once, not on every request
+	hits    atomic.Uint64
+	misses  atomic.Uint64
+	sets    atomic.Uint64
+}
+
+func newMemcachedCache(opts cacheOptions) (Cache, error) {
+	var servers []string
+	for _, server := range strings.Split(*memcachedServersFlag, ",") {
+		server = strings.TrimSpace(server)
+		if server != "" {
+			servers = append(servers, server)
+		}
+	}
+
+	if len(servers) == 0 {
+		return nil, errors.New("-cache-backend=memcached requires -memcached-servers")
+	}
+
+	client := memcache.New(servers...)
+	client.Timeout = *memcachedTimeoutFlag
+	client.MaxIdleConns = *memcachedMaxIdleFlag
+
+	c := &memcachedCache{client: client, prefix: *memcachedPrefixFlag, opts: opts}
+	c.gen.Store(1)
+	c.loadGen()
+
+	ctx, stop := context.WithCancel(context.Background())
+	c.stop = stop
+	c.stopped = make(chan struct{})
+
+	go c.genWatcher(ctx)
+
+	return c, nil
+}
+
+func (c *memcachedCache) genKey() string {
+	return c.prefix + "generation"
+}
+
+// Fetches the current generation, creating it from ours if it isn't there
+// (the first time, or if memcached evicted it).
+func (c *memcachedCache) loadGen() {
+	item, err := c.client.Get(c.genKey())
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		err = c.client.Add(&memcache.Item{
+			Key:   c.genKey(),
+			Value: []byte(strconv.FormatUint(c.gen.Load(), 10)),
+		})
+		if c.failed(context.Background(), err) {
+			return
+		}
+
+		// someone else may have beaten us to it
+		item, err = c.client.Get(c.genKey())
+	}
+	if c.failed(context.Background(), err) || err != nil {
+		return
+	}
+
+	gen, err := strconv.ParseUint(strings.TrimSpace(string(item.Value)), 10, 64)
+	if err == nil {
+		c.gen.Store(gen)
+	}
+}
+
+// Runs in a separate goroutine until ctx is done.
+func (c *memcachedCache) genWatcher(ctx context.Context) {
+	defer close(c.stopped)
+
+	ticker := time.NewTicker(c.opts.cleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.loadGen()
+		}
+	}
+}
+
+func (c *memcachedCache) key(key string) string {
+	return c.prefix + strconv.FormatUint(c.gen.Load(), 36) + ":" + key
+}
+
+// Keeps track of whether memcached is up, and returns true if err means it
+// isn't.
+func (c *memcachedCache) failed(ctx context.Context, err error) bool {
+	if err == nil || errors.Is(err, memcache.ErrCacheMiss) || errors.Is(err, memcache.ErrNotStored) {
+		if c.down.Swap(false) {
+			slog.InfoContext(ctx, "memcached is back")
+		}
+		return false
+	}
+
+	if errors.Is(err, memcache.ErrMalformedKey) {
+		// too long, most likely; just don't cache that one
+		return true
+	}
+
+	if !c.down.Swap(true) {
+		slog.WarnContext(ctx, "memcached unavailable", "err", err)
+	}
+	return true
+}
+
+// memcached wants whole seconds, relative up to 30 days and absolute after
+func memcachedExpiration(ttl time.Duration) int32 {
+	if ttl <= 0 {
+		return 0 // never
+	}
+
+	if ttl > memcachedMaxRelativeExpiration {
+		return int32(time.Now().Add(ttl).Unix())
+	}
+
+	return int32((ttl + time.Second - 1) / time.Second)
+}
+
+func (c *memcachedCache) Get(ctx context.Context, key string) (cachedAnswer, bool) {
+	item, err := c.client.Get(c.key(key))
+	if c.failed(ctx, err) || err != nil {
+		c.misses.Add(1)
+		return cachedAnswer{}, false
+	}
+
+	value, err := decodeCachedAnswer(string(item.Value))
+	if err != nil {
+		c.misses.Add(1)
+		return cachedAnswer{}, false
+	}
+
+	// slide the TTL on use, like the memory cache
+	if c.opts.slidingFor(key) {
+		c.failed(ctx, c.client.Touch(c.key(key), memcachedExpiration(c.opts.ttlFor(key, value))))
+	}
+
+	c.hits.Add(1)
+	return value, true
+}
+
+func (c *memcachedCache) Set(ctx context.Context, key string, value cachedAnswer) {
+	err := c.client.Set(&memcache.Item{
+		Key:        c.key(key),
+		Value:      []byte(encodeCachedAnswer(value)),
+		Expiration: memcachedExpiration(c.opts.jitterTTL(c.opts.ttlFor(key, value))),
+	})
+	if !c.failed(ctx, err) {
+		c.sets.Add(1)
+	}
+}
+
+func (c *memcachedCache) ping() error {
+	return c.client.Ping()
+}
+
+func (c *memcachedCache) Delete(key string) {
+	c.failed(context.Background(), c.client.Delete(c.key(key)))
+}
+
+func (c *memcachedCache) Purge() error {
+	gen, err := c.client.Increment(c.genKey(), 1)
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		c.loadGen()
+		gen, err = c.client.Increment(c.genKey(), 1)
+	}
+	if err != nil {
+		return err
+	}
+
+	c.gen.Store(gen)
+	return nil
+}
+
+// memcached can't count just our keys, so only our own calls are known
+func (c *memcachedCache) Stats() CacheStats {
+	return CacheStats{
+		Hits:   c.hits.Load(),
+		Misses: c.misses.Load(),
+		Sets:   c.sets.Load(),
+	}
+}
+
+func (c *memcachedCache) Close() error {
+	c.stop()
+	<-c.stopped
+
+	return nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// GET /metrics reports counters and gauges in the Prometheus text format.
+// Each part of the server that has something to report registers a
+// collector, which is called on every scrape. Metrics with labels, and
+// histograms, are kept in a metricVec instead, which registers itself (and
+// passes them on to StatsD, if it's on).
+
+// One value for /metrics. kind is "counter" or "gauge".
+type metricValue struct {
+	name  string
+	help  string
+	kind  string
+	value float64
+}
+
+var metricsCollectors []func() []metricValue
+var metricVecs []*metricVec
+var metricsMutex sync.Mutex
+
+// the Prometheus client's defaults, in seconds
+var defaultLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+func registerMetrics(collect func() []metricValue) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	metricsCollectors = append(metricsCollectors, collect)
+}
+
+func doMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Usage: curl http://localhost:8080/metrics", http.StatusMethodNotAllowed)
+		return
+	}
+
+	metricsMutex.Lock()
+	collectors := metricsCollectors
+	vecs := metricVecs
+	metricsMutex.Unlock()
+
+	var buf bytes.Buffer
+	for _, collect := range collectors {
+		for _, m := range collect() {
+			fmt.Fprintf(&buf, "# HELP %s %s\n", m.name, m.help)
+			fmt.Fprintf(&buf, "# TYPE %s %s\n", m.name, m.kind)
+			fmt.Fprintf(&buf, "%s %s\n", m.name, formatMetric(m.value))
+		}
+	}
+	for _, vec := range vecs {
+		vec.write(&buf)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+func formatMetric(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// A counter, gauge or histogram with labels; each combination of label
+// values is a series of its own.
+type metricVec struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64 // upper bounds, for histograms
+	series  map[string]*metricSeries
+	mutex   sync.Mutex
+}
+
+type metricSeries struct {
+	labelValues []string
+	value       float64  // for histograms, the sum
+	count       uint64   // histograms only
+	buckets     []uint64 // histograms only, not cumulative
+}
+
+func newMetricVec(name string, help string, kind string, buckets []float64, labels []string) *metricVec {
+	vec := &metricVec{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  map[string]*metricSeries{},
+	}
+
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	metricVecs = append(metricVecs, vec)
+
+	return vec
+}
+
+func newCounterVec(name string, help string, labels ...string) *metricVec {
+	return newMetricVec(name, help, "counter", nil, labels)
+}
+
+func newGaugeVec(name string, help string, labels ...string) *metricVec {
+	return newMetricVec(name, help, "gauge", nil, labels)
+}
+
+func newHistogramVec(name string, help string, buckets []float64, labels ...string) *metricVec {
+	return newMetricVec(name, help, "histogram", buckets, labels)
+}
+
+// call with the mutex held
+func (vec *metricVec) get(labelValues []string) *metricSeries {
+	key := strings.Join(labelValues, "\x00")
+
+	s, exists := vec.series[key]
+	if !exists {
+		s = &metricSeries{labelValues: labelValues}
+		if vec.kind == "histogram" {
+			s.buckets = make([]uint64, len(vec.buckets))
+		}
+		vec.series[key] = s
+	}
+
+	return s
+}
+
+// Adds to a counter or gauge; give the label values in the order the
+// labels were.
+func (vec *metricVec) add(delta float64, labelValues ...string) {
+	if statsd != nil {
+		statsd.vecEvent(vec, delta, labelValues)
+	}
+
+	vec.mutex.Lock()
+	defer vec.mutex.Unlock()
+
+	vec.get(labelValues).value += delta
+}
+
+// Counts value into a histogram.
+func (vec *metricVec) observe(value float64, labelValues ...string) {
+	if statsd != nil {
+		statsd.vecEvent(vec, value, labelValues)
+	}
+
+	vec.mutex.Lock()
+	defer vec.mutex.Unlock()
+
+	s := vec.get(labelValues)
+	s.value += value
+	s.count++
+	for i, bound := range vec.buckets {
+		if value <= bound {
+			s.buckets[i]++
+			break
+		}
+	}
+}
+
+func (vec *metricVec) write(buf *bytes.Buffer) {
+	vec.mutex.Lock()
+	defer vec.mutex.Unlock()
+
+	fmt.Fprintf(buf, "# HELP %s %s\n", vec.name, vec.help)
+	fmt.Fprintf(buf, "# TYPE %s %s\n", vec.name, vec.kind)
+
+	keys := make([]string, 0, len(vec.series))
+	for key := range vec.series {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		s := vec.series[key]
+		labels := vec.formatLabels(s.labelValues)
+
+		if vec.kind != "histogram" {
+			fmt.Fprintf(buf, "%s%s %s\n", vec.name, wrapLabels(labels), formatMetric(s.value))
+			continue
+		}
+
+		var cumulative uint64
+		for i, bound := range vec.buckets {
+			cumulative += s.buckets[i]
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", vec.name, wrapLabels(labels, `le="`+formatMetric(bound)+`"`), cumulative)
+		}
+		fmt.Fprintf(buf, "%s_bucket%s %d\n", vec.name, wrapLabels(labels, `le="+Inf"`), s.count)
+		fmt.Fprintf(buf, "%s_sum%s %s\n", vec.name, wrapLabels(labels), formatMetric(s.value))
+		fmt.Fprintf(buf, "%s_count%s %d\n", vec.name, wrapLabels(labels), s.count)
+	}
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (vec *metricVec) formatLabels(values []string) []string {
+	pairs := make([]string, len(vec.labels))
+	for i, label := range vec.labels {
+		pairs[i] = label + `="` + labelValueEscaper.Replace(values[i]) + `"`
+	}
+
+	return pairs
+}
+
+func wrapLabels(pairs []string, more ...string) string {
+	pairs = append(pairs[:len(pairs):len(pairs)], more...)
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// The MQTT bridge lets devices that can't speak HTTP use the service through
+// a broker: questions published to the request topic are answered through
+// getAnswer like any other, and the answers published to the response topic.
+// It speaks just enough MQTT 3.1.1 for that (QoS 0 out, QoS 0 or 1 in).
+
+var mqttBrokerFlag = flag.String("mqtt-broker", "", "MQTT broker to bridge to, e.g. tcp://localhost:1883 or tls://host:8883 (disabled if empty)")
+var mqttRequestTopicFlag = flag.String("mqtt-request-topic", "httpmath/request", "MQTT topic to take questions from")
+var mqttResponseTopicFlag = flag.String("mqtt-response-topic", "httpmath/response", "MQTT topic to publish answers to, unless a question has its own reply_to")
+var mqttClientIDFlag = flag.String("mqtt-client-id", "http-math", "MQTT client identifier")
+var mqttUsernameFlag = flag.String("mqtt-username", "", "MQTT username")
+var mqttPasswordFlag = flag.String("mqtt-password", "", "MQTT password")
+
+const mqttKeepAlive = 30 * time.Second
+const mqttMaxReconnectDelay = time.Minute
+
+// JSON data for a question published to the request topic
+type mqttRequest struct {
+	ID      string  `json:"id"`
+	Op      string  `json:"op"`
+	X       float64 `json:"x"`
+	Y       float64 `json:"y"`
+	ReplyTo string  `json:"reply_to"`
+	NoCache bool    `json:"nocache"`
+}
+
+// JSON data published in answer; ID is copied from the question so devices
+// can match them up
+type mqttResponse struct {
+	ID string `json:"id,omitempty"`
+	*response
+	Error string `json:"error,omitempty"`
+}
+
+// MQTT control packet types, already shifted into the high nibble
+const (
+	mqttConnect    = 0x10
+	mqttConnack    = 0x20
+	mqttPublish    = 0x30
+	mqttPuback     = 0x40
+	mqttSubscribe  = 0x80
+	mqttSuback     = 0x90
+	mqttPingreq    = 0xc0
+	mqttPingresp   = 0xd0
+	mqttDisconnect = 0xe0
+)
+
+type mqttConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	mutex  sync.Mutex // writes come from both the reader and the pinger
+}
+
+func mqttString(s string) []byte {
+	b := make([]byte, 2, 2+len(s))
+	binary.BigEndian.PutUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func (c *mqttConn) writePacket(header byte, body []byte) error {
+	packet := []byte{header}
+
+	// remaining length, 7 bits at a time
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	packet = append(packet, body...)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	_, err := c.conn.Write(packet)
+	return err
+}
+
+func (c *mqttConn) readPacket() (byte, []byte, error) {
+	c.conn.SetReadDeadline(time.Now().Add(mqttKeepAlive * 3 / 2))
+
+	header, err := c.reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	n := 0
+	for shift := 0; ; shift += 7 {
+		if shift > 21 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+
+		b, err := c.reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		n |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	body := make([]byte, n)
+	_, err = io.ReadFull(c.reader, body)
+
+	return header, body, err
+}
+
+func mqttDial(broker string) (*mqttConn, error) {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn net.Conn
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		conn, err = net.DialTimeout("tcp", u.Host, 10*time.Second)
+	case "tls", "ssl", "mqtts":
+		dialer := &net.Dialer{Timeout: 10 * time.Second}
+		conn, err = tls.DialWithDialer(dialer, "tcp", u.Host, nil)
+	default:
+		return nil, fmt.Errorf("unsupported MQTT broker scheme: %s", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &mqttConn{conn: conn, reader: bufio.NewReader(conn)}
+
+	var flags byte = 0x02 // clean session
+	body := append(mqttString("MQTT"), 4, 0, 0, 0)
+	if *mqttUsernameFlag != "" {
+		flags |= 0x80
+	}
+	if *mqttPasswordFlag != "" {
+		flags |= 0x40
+	}
+	body[7] = flags
+	binary.BigEndian.PutUint16(body[8:], uint16(mqttKeepAlive/time.Second))
+
+	body = append(body, mqttString(*mqttClientIDFlag)...)
+	if *mqttUsernameFlag != "" {
+		body = append(body, mqttString(*mqttUsernameFlag)...)
+	}
+	if *mqttPasswordFlag != "" {
+		body = append(body, mqttString(*mqttPasswordFlag)...)
+	}
+
+	err = c.writePacket(mqttConnect, body)
+	if err == nil {
+		var header byte
+		var ack []byte
+		header, ack, err = c.readPacket()
+		if err == nil && (header&0xf0 != mqttConnack || len(ack) != 2) {
+			err = errors.New("broker did not acknowledge the connection")
+		} else if err == nil && ack[1] != 0 {
+			err = fmt.Errorf("broker refused the connection (code %d)", ack[1])
+		}
+	}
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *mqttConn) subscribe(topic string) error {
+	body := []byte{0, 1} // packet id
+	body = append(body, mqttString(topic)...)
+	body = append(body, 1) // up to QoS 1
+
+	return c.writePacket(mqttSubscribe|0x02, body)
+}
+
+func (c *mqttConn) publish(topic string, payload []byte) error {
+	body := append(mqttString(topic), payload...)
+	return c.writePacket(mqttPublish, body)
+}
+
+// answers one question published to the request topic
+func (c *mqttConn) handlePublish(header byte, body []byte) error {
+	if len(body) < 2 {
+		return errors.New("malformed PUBLISH")
+	}
+
+	topicLen := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+topicLen {
+		return errors.New("malformed PUBLISH")
+	}
+	rest := body[2+topicLen:]
+
+	qos := (header >> 1) & 0x03
+	if qos > 0 {
+		if len(rest) < 2 {
+			return errors.New("malformed PUBLISH")
+		}
+
+		// acknowledge before working on it; answers are cheap to recompute
+		// if the broker redelivers anyway
+		err := c.writePacket(mqttPuback, rest[:2])
+		if err != nil {
+			return err
+		}
+		rest = rest[2:]
+	}
+
+	var req mqttRequest
+	var resp mqttResponse
+
+	err := json.Unmarshal(rest, &req)
+	if err != nil {
+		resp.Error = fmt.Sprintf("Invalid request: %v", err)
+	} else {
+		resp.ID = req.ID
+		op := canonicalOp(req.Op)
+
+		answer, hit, err := getAnswer(clientContext(context.Background(), "mqtt"), op, req.X, req.Y, req.NoCache)
+		if err != nil {
+			resp.Error = err.Error()
+		} else {
+			data := newResponse(op, req.X, req.Y, answer, hit)
+			resp.response = &data
+		}
+	}
+
+	payload, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+
+	topic := *mqttResponseTopicFlag
+	if req.ReplyTo != "" {
+		topic = req.ReplyTo
+	}
+
+	return c.publish(topic, payload)
+}
+
+func (c *mqttConn) pinger(done chan struct{}) {
+	ticker := time.NewTicker(mqttKeepAlive / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if c.writePacket(mqttPingreq, nil) != nil {
+				return
+			}
+		}
+	}
+}
+
+// connects, subscribes and answers questions until the connection fails
+func runMQTTSession(broker string) error {
+	c, err := mqttDial(broker)
+	if err != nil {
+		return err
+	}
+	defer c.conn.Close()
+
+	err = c.subscribe(*mqttRequestTopicFlag)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("MQTT bridge connected", "broker", broker, "topic", *mqttRequestTopicFlag)
+
+	done := make(chan struct{})
+	defer close(done)
+	go c.pinger(done)
+
+	for {
+		header, body, err := c.readPacket()
+		if err != nil {
+			return err
+		}
+
+		switch header & 0xf0 {
+		case mqttPublish:
+			err = c.handlePublish(header, body)
+			if err != nil {
+				return err
+			}
+		case mqttSuback:
+			if len(body) == 3 && body[2] == 0x80 {
+				return fmt.Errorf("broker refused subscription to %s", *mqttRequestTopicFlag)
+			}
+		case mqttPingresp:
+		case mqttDisconnect:
+			return errors.New("broker disconnected")
+		}
+	}
+}
+
+// Keeps the bridge connected, backing off between attempts.
+//
+// runs in a separate goroutine
+func runMQTTBridge(broker string) {
+	delay := time.Second
+
+	for {
+		start := time.Now()
+		err := runMQTTSession(broker)
+		slog.Error("MQTT error", "err", err)
+
+		// a session that stayed up for a while resets the backoff
+		if time.Since(start) > mqttMaxReconnectDelay {
+			delay = time.Second
+		}
+
+		time.Sleep(delay)
+
+		delay *= 2
+		if delay > mqttMaxReconnectDelay {
+			delay = mqttMaxReconnectDelay
+		}
+	}
+}
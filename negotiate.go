@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// An encoder turns response data into one wire format. To add a format,
+// write its marshal function and add it to encoders; the format parameter
+// and Accept negotiation pick it up from there.
+type encoder struct {
+	name        string   // for format=
+	contentType string   // sent in Content-Type
+	mediaTypes  []string // matched against Accept, the first is canonical
+	marshal     func(interface{}) ([]byte, error)
+}
+
+// In order of preference, for when the client accepts anything
+var encoders = []encoder{
+	{"json", "application/json", []string{"application/json"}, marshalJSON},
+	{"xml", "application/xml", []string{"application/xml", "text/xml"}, marshalXML},
+	{"yaml", "application/yaml", []string{"application/yaml", "application/x-yaml", "text/yaml"}, marshalYAML},
+	{"msgpack", "application/msgpack", []string{"application/msgpack", "application/x-msgpack"}, marshalMsgpack},
+	{"text", "text/plain; charset=utf-8", []string{"text/plain"}, marshalText},
+	{"ndjson", "application/x-ndjson", []string{"application/x-ndjson", "application/jsonl"}, marshalNDJSON},
+}
+
+// like json.Marshal, but leaves &, < and > alone so links stay readable
+func marshalJSON(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+
+	err := enc.Encode(v)
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), err
+}
+
+// Newline-delimited JSON: a list has one element per line, anything else
+// is a single line. Handlers that can stream (like /batch) check for this
+// encoder and write lines as they go instead.
+func marshalNDJSON(v interface{}) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		ret, err := marshalJSON(v)
+		return append(ret, '\n'), err
+	}
+
+	var buf bytes.Buffer
+	for i := 0; i < rv.Len(); i++ {
+		line, err := marshalJSON(rv.Index(i).Interface())
+		if err != nil {
+			return nil, err
+		}
+
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	return buf.Bytes(), nil
+}
+
+var errNotAcceptable = errors.New("None of the requested formats are available")
+
+func encoderByName(name string) (*encoder, bool) {
+	for i := range encoders {
+		if encoders[i].name == name {
+			return &encoders[i], true
+		}
+	}
+
+	return nil, false
+}
+
+type acceptRange struct {
+	mediaType string
+	q         float64
+}
+
+// parses an Accept header into media ranges, most preferred first
+func parseAccept(header string) []acceptRange {
+	var ranges []acceptRange
+
+	for _, part := range strings.Split(header, ",") {
+		mediaType, params, _ := strings.Cut(part, ";")
+		mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+		if mediaType == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.TrimSpace(name) == "q" {
+				parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+				if err == nil {
+					q = parsed
+				}
+			}
+		}
+
+		ranges = append(ranges, acceptRange{mediaType, q})
+	}
+
+	// stable, so equally preferred ranges keep the client's order
+	sort.SliceStable(ranges, func(a, b int) bool {
+		return ranges[a].q > ranges[b].q
+	})
+
+	return ranges
+}
+
+func mediaTypeMatches(mediaRange string, mediaType string) bool {
+	if mediaRange == "*/*" || mediaRange == mediaType {
+		return true
+	}
+
+	prefix, isWildcard := strings.CutSuffix(mediaRange, "/*")
+	return isWildcard && strings.HasPrefix(mediaType, prefix+"/")
+}
+
+// whether enc's media types include one that matches mediaRange
+func (enc *encoder) matches(mediaRange string) bool {
+	for _, mediaType := range enc.mediaTypes {
+		if mediaTypeMatches(mediaRange, mediaType) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// How much a client wants JSON, for putting other formats up against it: its
+// q in the Accept header, or if the client takes */*, at least that of
+// anything it asked for that we don't have. Browsers ask for HTML first,
+// then XML a little ahead of */*; what they'd take in place of the HTML is
+// whatever we send for */*, which is JSON.
+func jsonQ(ranges []acceptRange) float64 {
+	var q float64
+	var wildcard bool
+	for _, accepted := range ranges {
+		if encoders[0].matches(accepted.mediaType) {
+			q = max(q, accepted.q)
+		}
+		if accepted.mediaType == "*/*" && accepted.q > 0 {
+			wildcard = true
+		}
+	}
+	if !wildcard {
+		return q
+	}
+
+	for _, accepted := range ranges {
+		if !slices.ContainsFunc(encoders, func(enc encoder) bool { return enc.matches(accepted.mediaType) }) {
+			q = max(q, accepted.q)
+		}
+	}
+
+	return q
+}
+
+// Picks the encoder for a response. A format parameter overrides the Accept
+// header; with neither, the answer is JSON, and other formats only win when
+// the client ranks them above JSON.
+func negotiate(r *http.Request) (*encoder, error) {
+	// Only look in the body if it has already been parsed as a form. Handlers
+	// that read JSON bodies may negotiate before reading, and FormValue would
+	// consume the body out from under them.
+	format := r.URL.Query().Get("format")
+	if r.Form != nil {
+		format = r.FormValue("format")
+	}
+
+	if format != "" {
+		enc, exists := encoderByName(format)
+		if !exists {
+			return nil, fmt.Errorf("Unknown format: %s", format)
+		}
+
+		return enc, nil
+	}
+
+	header := r.Header.Get("Accept")
+	if header == "" {
+		return &encoders[0], nil
+	}
+
+	ranges := parseAccept(header)
+	for _, accepted := range ranges {
+		if accepted.q <= 0 {
+			break
+		}
+
+		for i := range encoders {
+			if !encoders[i].matches(accepted.mediaType) {
+				continue
+			}
+			if i > 0 && accepted.q <= jsonQ(ranges) {
+				return &encoders[0], nil
+			}
+
+			return &encoders[i], nil
+		}
+	}
+
+	return nil, errNotAcceptable
+}
+
+// The formats other than JSON are all generated from the same tree:
+// orderedNode marshals v to JSON, then reads it back as nested orderedMaps,
+// []interface{} and scalars (string, json.Number, bool, nil). That way they
+// all follow the json tags on our response structs, and keep field order.
+
+type orderedPair struct {
+	key   string
+	value interface{}
+}
+
+type orderedMap []orderedPair
+
+func orderedNode(v interface{}) (interface{}, error) {
+	j, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(j))
+	dec.UseNumber()
+
+	return readJSONNode(dec)
+}
+
+// reads one JSON value, keeping objects as ordered orderedMaps
+func readJSONNode(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	delim, isDelim := tok.(json.Delim)
+	if !isDelim {
+		return tok, nil
+	}
+
+	switch delim {
+	case '{':
+		m := orderedMap{}
+		for dec.More() {
+			keyTok, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+
+			value, err := readJSONNode(dec)
+			if err != nil {
+				return nil, err
+			}
+
+			m = append(m, orderedPair{keyTok.(string), value})
+		}
+		_, err = dec.Token() // }
+		return m, err
+	case '[':
+		list := []interface{}{}
+		for dec.More() {
+			value, err := readJSONNode(dec)
+			if err != nil {
+				return nil, err
+			}
+
+			list = append(list, value)
+		}
+		_, err = dec.Token() // ]
+		return list, err
+	}
+
+	return nil, errors.New("unexpected JSON delimiter")
+}
+
+// XML: the whole thing is wrapped in <response>, object keys become element
+// names, and list entries become <item> elements.
+func marshalXML(v interface{}) ([]byte, error) {
+	node, err := orderedNode(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+
+	err = writeXMLNode(enc, "response", node)
+	if err != nil {
+		return nil, err
+	}
+
+	err = enc.Flush()
+	buf.WriteString("\n")
+
+	return buf.Bytes(), err
+}
+
+var xmlInvalidNameChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// keys like variable names are usually fine as they are, but not always
+func xmlName(key string) string {
+	name := xmlInvalidNameChars.ReplaceAllString(key, "_")
+	if name == "" || !(name[0] == '_' || (name[0]|0x20 >= 'a' && name[0]|0x20 <= 'z')) {
+		name = "_" + name
+	}
+
+	return name
+}
+
+func writeXMLNode(enc *xml.Encoder, name string, node interface{}) error {
+	start := xml.StartElement{Name: xml.Name{Local: name}}
+
+	err := enc.EncodeToken(start)
+	if err != nil {
+		return err
+	}
+
+	switch n := node.(type) {
+	case orderedMap:
+		for _, pair := range n {
+			err = writeXMLNode(enc, xmlName(pair.key), pair.value)
+			if err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, item := range n {
+			err = writeXMLNode(enc, "item", item)
+			if err != nil {
+				return err
+			}
+		}
+	case nil:
+	default:
+		err = enc.EncodeToken(xml.CharData(fmt.Sprint(n)))
+		if err != nil {
+			return err
+		}
+	}
+
+	return enc.EncodeToken(start.End())
+}
+
+// MessagePack, per https://github.com/msgpack/msgpack/blob/master/spec.md
+func marshalMsgpack(v interface{}) ([]byte, error) {
+	node, err := orderedNode(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	writeMsgpackNode(&buf, node)
+
+	return buf.Bytes(), nil
+}
+
+// writes a msgpack type byte and length for a str, array or map
+func writeMsgpackHeader(buf *bytes.Buffer, n int, fix byte, fixMax int, code16 byte, code32 byte) {
+	switch {
+	case n <= fixMax:
+		buf.WriteByte(fix | byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(code16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(code32)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+func writeMsgpackNode(buf *bytes.Buffer, node interface{}) {
+	switch n := node.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if n {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		if i, err := n.Int64(); err == nil {
+			switch {
+			case i >= 0 && i <= 127:
+				buf.WriteByte(byte(i)) // positive fixint
+			case i < 0 && i >= -32:
+				buf.WriteByte(byte(int8(i))) // negative fixint
+			default:
+				buf.WriteByte(0xd3)
+				binary.Write(buf, binary.BigEndian, i)
+			}
+			return
+		}
+
+		f, _ := n.Float64()
+		buf.WriteByte(0xcb)
+		binary.Write(buf, binary.BigEndian, f)
+	case string:
+		if len(n) <= math.MaxUint8 && len(n) > 31 {
+			buf.WriteByte(0xd9)
+			buf.WriteByte(byte(len(n)))
+		} else {
+			writeMsgpackHeader(buf, len(n), 0xa0, 31, 0xda, 0xdb)
+		}
+		buf.WriteString(n)
+	case []interface{}:
+		writeMsgpackHeader(buf, len(n), 0x90, 15, 0xdc, 0xdd)
+		for _, item := range n {
+			writeMsgpackNode(buf, item)
+		}
+	case orderedMap:
+		writeMsgpackHeader(buf, len(n), 0x80, 15, 0xde, 0xdf)
+		for _, pair := range n {
+			writeMsgpackNode(buf, pair.key)
+			writeMsgpackNode(buf, pair.value)
+		}
+	}
+}
+
+// Plain text: one "key: value" line per scalar, with nested keys and list
+// indexes joined by dots, e.g. "steps.0.answer: 4".
+func marshalText(v interface{}) ([]byte, error) {
+	node, err := orderedNode(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	writeTextNode(&buf, "", node)
+
+	return buf.Bytes(), nil
+}
+
+func writeTextNode(buf *bytes.Buffer, path string, node interface{}) {
+	join := func(key string) string {
+		if path == "" {
+			return key
+		}
+		return path + "." + key
+	}
+
+	switch n := node.(type) {
+	case orderedMap:
+		for _, pair := range n {
+			writeTextNode(buf, join(pair.key), pair.value)
+		}
+	case []interface{}:
+		for i, item := range n {
+			writeTextNode(buf, join(strconv.Itoa(i)), item)
+		}
+	default:
+		if path != "" {
+			buf.WriteString(path + ": ")
+		}
+
+		if n == nil {
+			buf.WriteString("null\n")
+		} else {
+			buf.WriteString(fmt.Sprint(n) + "\n")
+		}
+	}
+}
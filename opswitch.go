@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Operations can be turned off without a redeploy, say to shed an expensive
+// one during an incident. -enabled-ops lists the only ones allowed (all of
+// them if empty), and -disabled-ops takes some away; both can be reloaded.
+// An admin can also turn one on or off right away:
+//
+//	curl -X PUT 'http://localhost:8080/ops/divide?enabled=false'
+//	curl -X DELETE http://localhost:8080/ops/divide (back to what the flags say)
+//
+// which lasts until it's deleted, or a restart, whatever the flags say. Asking
+// for a disabled operation gets a 403 with the code "operation_disabled",
+// cached answer or not.
+
+var enabledOpsFlag = flag.String("enabled-ops", "", "comma-separated operations to allow (all of them if empty)")
+var disabledOpsFlag = flag.String("disabled-ops", "", "comma-separated operations to turn off")
+
+type opSwitchStruct struct {
+	allowed   map[string]bool // nil for all of them
+	disabled  map[string]bool
+	overrides map[string]bool // set by an admin
+	mutex     sync.RWMutex
+}
+
+var opSwitches = &opSwitchStruct{
+	disabled:  map[string]bool{},
+	overrides: map[string]bool{},
+}
+
+func init() {
+	registerReload(loadOpSwitches, "enabled-ops", "disabled-ops")
+}
+
+// The error for a question about an operation that's turned off
+type opDisabledError string
+
+func (err opDisabledError) Error() string {
+	return fmt.Sprintf("Operation %s is disabled", string(err))
+}
+
+// Reads -enabled-ops and -disabled-ops.
+func loadOpSwitches() error {
+	allowed, err := parseOpList(*enabledOpsFlag)
+	if err != nil {
+		return fmt.Errorf("invalid -enabled-ops: %v", err)
+	}
+	if *enabledOpsFlag == "" {
+		allowed = nil
+	}
+
+	disabled, err := parseOpList(*disabledOpsFlag)
+	if err != nil {
+		return fmt.Errorf("invalid -disabled-ops: %v", err)
+	}
+
+	opSwitches.mutex.Lock()
+	defer opSwitches.mutex.Unlock()
+
+	opSwitches.allowed = allowed
+	opSwitches.disabled = disabled
+
+	return nil
+}
+
+func parseOpList(list string) (map[string]bool, error) {
+	ops := map[string]bool{}
+	for _, op := range strings.Split(list, ",") {
+		op = strings.TrimSpace(op)
+		if op == "" {
+			continue
+		}
+
+		op = canonicalOp(op)
+		if _, exists := operations[op]; !exists {
+			return nil, fmt.Errorf("unknown operation %q", op)
+		}
+		ops[op] = true
+	}
+
+	return ops, nil
+}
+
+// op should be canonical already.
+func (s *opSwitchStruct) enabled(op string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	enabled, overridden := s.overrides[op]
+	if overridden {
+		return enabled
+	}
+
+	if s.allowed != nil && !s.allowed[op] {
+		return false
+	}
+
+	return !s.disabled[op]
+}
+
+// A nil enabled drops the override.
+func (s *opSwitchStruct) override(op string, enabled *bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if enabled == nil {
+		delete(s.overrides, op)
+	} else {
+		s.overrides[op] = *enabled
+	}
+}
+
+// Returns an opDisabledError if op is turned off.
+func checkOpEnabled(op string) error {
+	if !opSwitches.enabled(op) {
+		return opDisabledError(op)
+	}
+
+	return nil
+}
+
+// Responds 403 if err came from a disabled operation, returning whether it
+// did.
+func httpOpDisabled(w http.ResponseWriter, err error) bool {
+	var disabled opDisabledError
+	if !errors.As(err, &disabled) {
+		return false
+	}
+
+	httpErrorCode(w, http.StatusForbidden, "operation_disabled", err.Error())
+	return true
+}
+
+// JSON data for GET /ops
+type opStatus struct {
+	Op         string `json:"op"`
+	Enabled    bool   `json:"enabled"`
+	Overridden bool   `json:"overridden,omitempty"` // by an admin, rather than the flags
+}
+
+// GET /ops lists the operations and whether they're enabled.
+func doOps(w http.ResponseWriter, r *http.Request) {
+	names := make([]string, 0, len(operations))
+	for op := range operations {
+		names = append(names, op)
+	}
+	slices.Sort(names)
+
+	statuses := make([]opStatus, 0, len(names))
+	for _, op := range names {
+		opSwitches.mutex.RLock()
+		_, overridden := opSwitches.overrides[op]
+		opSwitches.mutex.RUnlock()
+
+		statuses = append(statuses, opStatus{Op: op, Enabled: opSwitches.enabled(op), Overridden: overridden})
+	}
+
+	writeData(w, r, http.StatusOK, statuses)
+}
+
+// PUT /ops/{OP}?enabled=true|false turns an operation on or off, and DELETE
+// /ops/{OP} goes back to the flags. Admin only.
+func doOpSwitch(w http.ResponseWriter, r *http.Request) {
+	op := canonicalOp(strings.TrimPrefix(r.URL.Path, "/ops/"))
+	if _, exists := operations[op]; !exists {
+		http.Error(w, fmt.Sprintf("Invalid operation: %s", op), http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+		if err != nil {
+			http.Error(w, "Invalid enabled; expected true or false", http.StatusBadRequest)
+			return
+		}
+
+		opSwitches.override(op, &enabled)
+		if enabled {
+			slog.InfoContext(r.Context(), "Operation enabled", "op", op)
+		} else {
+			slog.InfoContext(r.Context(), "Operation disabled", "op", op)
+		}
+	case http.MethodDelete:
+		opSwitches.override(op, nil)
+		slog.InfoContext(r.Context(), "Operation back to its configured setting", "op", op)
+	default:
+		w.Header().Set("Allow", "PUT, DELETE")
+		http.Error(w, "Usage: curl -X PUT -H 'Authorization: Bearer TOKEN' 'http://localhost:8080/ops/{OP}?enabled=true|false'",
+			http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,147 @@
+//go:build otel
+
+package main
+
+// Tracing needs the OpenTelemetry SDK, so it's only compiled in with:
+// go build -tags otel
+//
+// With -otel-endpoint (or the standard OTEL_EXPORTER_OTLP_ENDPOINT), spans
+// are sent there over OTLP/HTTP. A W3C traceparent header on a request is
+// honored, so our spans show up in the caller's trace, and it's passed on
+// to peers we ask.
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var otelEndpointFlag = flag.String("otel-endpoint", "", "OTLP/HTTP endpoint to send traces to, e.g. http://localhost:4318 (OTEL_EXPORTER_OTLP_ENDPOINT if empty; no tracing without either)")
+var otelServiceNameFlag = flag.String("otel-service-name", "http-math", "service.name to report spans under")
+var otelSampleRatioFlag = flag.Float64("otel-sample-ratio", 1, "fraction of new traces to record; traces a caller started follow its decision")
+
+func init() {
+	startTracing = setUpTracing
+}
+
+func setUpTracing(handler http.Handler) http.Handler {
+	var opts []otlptracehttp.Option
+	if *otelEndpointFlag != "" {
+		opts = append(opts, otlptracehttp.WithEndpointURL(*otelEndpointFlag))
+	} else if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return handler
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		fatal("Error setting up tracing", "err", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", *otelServiceNameFlag),
+		attribute.String("service.version", version),
+	))
+	if err != nil {
+		fatal("Error setting up tracing", "err", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(*otelSampleRatioFlag))),
+	)
+	onShutdown(func(ctx context.Context) {
+		provider.Shutdown(ctx)
+	})
+
+	propagator := propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagator)
+
+	tracer := provider.Tracer("http-math")
+
+	spanStarter = func(ctx context.Context, name string, attrs []spanAttr) (context.Context, span) {
+		ctx, s := tracer.Start(ctx, name, trace.WithAttributes(otelAttributes(attrs)...))
+		return ctx, otelSpan{s}
+	}
+	traceInjector = func(ctx context.Context, header http.Header) {
+		propagator.Inject(ctx, propagation.HeaderCarrier(header))
+	}
+
+	slog.Info("Tracing with OpenTelemetry")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, _ := requestRoute(r)
+
+		ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, s := tracer.Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("http.route", route),
+				attribute.String("url.path", r.URL.Path),
+				attribute.String("network.peer.address", r.RemoteAddr),
+			))
+		defer s.End()
+
+		sw := &statusWriter{ResponseWriter: w}
+		handler.ServeHTTP(sw, r.WithContext(ctx))
+
+		status := sw.statusCode()
+		s.SetAttributes(attribute.Int("http.response.status_code", status))
+		if status >= 500 {
+			s.SetStatus(codes.Error, http.StatusText(status))
+		}
+	})
+}
+
+type otelSpan struct {
+	trace.Span
+}
+
+func (s otelSpan) setAttr(key string, value any) {
+	s.SetAttributes(otelAttributes([]spanAttr{{key, value}})...)
+}
+
+func (s otelSpan) end(err error) {
+	if err != nil {
+		s.RecordError(err)
+		s.SetStatus(codes.Error, err.Error())
+	}
+
+	s.End()
+}
+
+func otelAttributes(attrs []spanAttr) []attribute.KeyValue {
+	kvs := make([]attribute.KeyValue, 0, len(attrs))
+	for _, a := range attrs {
+		switch v := a.value.(type) {
+		case string:
+			kvs = append(kvs, attribute.String(a.key, v))
+		case bool:
+			kvs = append(kvs, attribute.Bool(a.key, v))
+		case int:
+			kvs = append(kvs, attribute.Int(a.key, v))
+		case int64:
+			kvs = append(kvs, attribute.Int64(a.key, v))
+		case float64:
+			kvs = append(kvs, attribute.Float64(a.key, v))
+		default:
+			kvs = append(kvs, attribute.String(a.key, fmt.Sprint(v)))
+		}
+	}
+
+	return kvs
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// Listings are paged with limit and cursor parameters. A cursor is opaque
+// to clients; underneath it's the sequence number of the last item on the
+// previous page, so pages stay stable while new items are added.
+
+const defaultPageLimit = 50
+const maxPageLimit = 1000
+
+func encodeCursor(seq uint64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatUint(seq, 10)))
+}
+
+func decodeCursor(cursor string) (uint64, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err == nil {
+		var seq uint64
+		seq, err = strconv.ParseUint(string(b), 10, 64)
+		if err == nil {
+			return seq, nil
+		}
+	}
+
+	return 0, errors.New("Invalid cursor")
+}
+
+// returns the page size and the sequence number to start after
+func pageParams(r *http.Request) (int, uint64, error) {
+	limit := defaultPageLimit
+
+	if strVal := r.FormValue("limit"); strVal != "" {
+		val, err := strconv.Atoi(strVal)
+		if err != nil || val < 1 || val > maxPageLimit {
+			return 0, 0, fmt.Errorf("limit must be between 1 and %d", maxPageLimit)
+		}
+		limit = val
+	}
+
+	var after uint64
+	if cursor := r.FormValue("cursor"); cursor != "" {
+		var err error
+		after, err = decodeCursor(cursor)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return limit, after, nil
+}
+
+// the request's own URL, moved on to the page after seq
+func nextPageLink(r *http.Request, seq uint64) string {
+	u := *r.URL
+	query := u.Query()
+	query.Set("cursor", encodeCursor(seq))
+	u.RawQuery = query.Encode()
+
+	return u.RequestURI()
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// With -peers, replicas split the questions between them like groupcache
+// does: each question is owned by one peer, picked by consistent hashing, and
+// a replica that doesn't have an answer asks the owner for it before working
+// it out itself. So each answer is worked out about once across the group,
+// and adding or removing a peer only moves the questions next to it on the
+// ring.
+//
+// Answers from other peers are kept in the local cache too, so hot questions
+// don't all go to their owner. If the owner can't be reached, the answer is
+// worked out locally.
+//
+// Peers ask each other at /peer/answer, which is only there with -peers, and
+// only answers requests with -peer-token in the X-Peer-Token header. Every
+// replica needs the same one.
+
+var peersFlag = flag.String("peers", "", "comma-separated base URLs of every replica, this one included, to share answers between (disabled if empty)")
+var peerSelfFlag = flag.String("peer-self", "", "this replica's base URL, as it appears in -peers")
+var peerTimeoutFlag = flag.Duration("peer-timeout", 500*time.Millisecond, "how long to wait on another peer before working the answer out locally")
+var peerTokenFlag = flag.String("peer-token", "", "token peers send each other in X-Peer-Token, the same for all of them (required with -peers)")
+
+const peerTokenHeader = "X-Peer-Token"
+
+// points on the ring per peer, so questions are spread evenly
+const peerReplicas = 50
+
+type peerRing struct {
+	self   string
+	token  string
+	hashes []uint32          // sorted
+	owners map[uint32]string // hash -> peer
+	client *http.Client
+	down   atomic.Bool // so outages are logged once, not on every request
+}
+
+// nil unless -peers is set
+var peers *peerRing
+
+func newPeerRing(list string, self string) (*peerRing, error) {
+	self = strings.TrimRight(self, "/")
+	if self == "" {
+		return nil, errors.New("-peers requires -peer-self")
+	}
+	if *peerTokenFlag == "" {
+		return nil, errors.New("-peers requires -peer-token")
+	}
+
+	ring := &peerRing{
+		self:   self,
+		token:  *peerTokenFlag,
+		owners: make(map[uint32]string),
+		client: &http.Client{Timeout: *peerTimeoutFlag},
+	}
+
+	foundSelf := false
+	for _, peer := range strings.Split(list, ",") {
+		peer = strings.TrimRight(strings.TrimSpace(peer), "/")
+		if peer == "" {
+			continue
+		}
+		if peer == self {
+			foundSelf = true
+		}
+
+		for i := 0; i < peerReplicas; i++ {
+			hash := crc32.ChecksumIEEE([]byte(peer + "#" + strconv.Itoa(i)))
+			if _, exists := ring.owners[hash]; exists {
+				continue // a duplicate peer, or a (rare) collision
+			}
+			ring.owners[hash] = peer
+			ring.hashes = append(ring.hashes, hash)
+		}
+	}
+
+	if !foundSelf {
+		return nil, fmt.Errorf("-peer-self %s isn't in -peers", self)
+	}
+
+	sort.Slice(ring.hashes, func(a, b int) bool {
+		return ring.hashes[a] < ring.hashes[b]
+	})
+
+	return ring, nil
+}
+
+// The peer owning key: the first one clockwise from it on the ring
+func (p *peerRing) owner(key string) string {
+	hash := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(p.hashes), func(i int) bool {
+		return p.hashes[i] >= hash
+	})
+	if i == len(p.hashes) {
+		i = 0
+	}
+
+	return p.owners[p.hashes[i]]
+}
+
+// what /peer/answer sends back
+type peerAnswer struct {
+	Answer float64 `json:"answer"`
+	Error  string  `json:"error,omitempty"`
+	Domain bool    `json:"domain,omitempty"` // Error will always happen for this question
+}
+
+// Asks the owner of key for the answer. asked is false if we own it, or the
+// owner couldn't be reached, and it should be worked out here.
+func (p *peerRing) ask(ctx context.Context, op string, x float64, y float64, key string) (answer float64, asked bool, err error) {
+	owner := p.owner(key)
+	if owner == p.self {
+		return 0, false, nil
+	}
+
+	ctx, span := startSpan(ctx, "peer.ask", spanAttr{"peer", owner})
+	defer func() { span.end(err) }()
+
+	query := url.Values{}
+	query.Set("op", op)
+	query.Set("x", strconv.FormatFloat(x, 'g', -1, 64))
+	query.Set("y", strconv.FormatFloat(y, 'g', -1, 64))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, owner+"/peer/answer?"+query.Encode(), nil)
+	if err != nil {
+		return 0, false, nil
+	}
+	req.Header.Set(peerTokenHeader, p.token)
+	injectTrace(ctx, req.Header)
+
+	resp, err := p.client.Do(req)
+	if err == nil && resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		err = fmt.Errorf("%s", resp.Status)
+	}
+	if err != nil {
+		if !p.down.Swap(true) {
+			slog.WarnContext(ctx, "Peer unavailable, working answers out locally", "peer", owner, "err", err)
+		}
+		return 0, false, nil
+	}
+	defer resp.Body.Close()
+
+	var data peerAnswer
+	err = json.NewDecoder(resp.Body).Decode(&data)
+	if err != nil {
+		slog.ErrorContext(ctx, "Bad answer from peer", "peer", owner, "err", err)
+		return 0, false, nil
+	}
+
+	if p.down.Swap(false) {
+		slog.InfoContext(ctx, "Peers are back")
+	}
+
+	if data.Domain {
+		return 0, true, domainError(data.Error)
+	}
+	if data.Error != "" {
+		return 0, true, errors.New(data.Error)
+	}
+
+	return data.Answer, true, nil
+}
+
+// whether the request is from another peer
+func isPeer(r *http.Request) bool {
+	token := r.Header.Get(peerTokenHeader)
+	return peers != nil && token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(peers.token)) == 1
+}
+
+// Answers a question from another peer. It's never passed on again, even if
+// we don't think we own it (while the peers' lists disagree).
+func doPeerAnswer(w http.ResponseWriter, r *http.Request) {
+	if !isPeer(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+
+	x, err := strconv.ParseFloat(query.Get("x"), 64)
+	if err != nil {
+		http.Error(w, "Invalid x", http.StatusBadRequest)
+		return
+	}
+
+	y, err := strconv.ParseFloat(query.Get("y"), 64)
+	if err != nil {
+		http.Error(w, "Invalid y", http.StatusBadRequest)
+		return
+	}
+
+	var data peerAnswer
+	answer, _, err := lookupAnswer(r.Context(), query.Get("op"), x, y, false, false)
+	if err != nil {
+		var domainErr domainError
+		data.Error = err.Error()
+		data.Domain = errors.As(err, &domainErr)
+	}
+	data.Answer = answer
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// Credentials can be limited to some operations with -op-permissions, a
+// comma-separated list of WHO=OPS, where WHO is an API key (key:NAME), a
+// Basic auth user (user:NAME), a signing key (hmac:NAME) or a JWT scope
+// (scope:SCOPE), and OPS are |-separated operations, or * for all of them:
+//
+//	-op-permissions 'key:public=add|subtract,key:internal=*,scope:math.read=add'
+//
+// A request can use the operations any of its credentials (or its token's
+// scopes) allow. Credentials that aren't listed get what * is given, or
+// everything if it isn't. Requests without credentials, and our own, aren't
+// limited; requireAuth is what turns those away. Asking for an operation
+// that isn't allowed gets a 403 problem (RFC 9457) with the code
+// "operation_forbidden", cached answer or not.
+
+var opPermissionsFlag = flag.String("op-permissions", "", "comma-separated WHO=OP|OP... limiting credentials to some operations; WHO is key:NAME, user:NAME, hmac:NAME, scope:SCOPE or *")
+
+// operations by who they're allowed for; a nil set is all of them
+type opPermissionMap map[string]map[string]bool
+
+// nil when nobody is limited
+var opPermissions atomic.Pointer[opPermissionMap]
+
+func init() {
+	registerReload(loadOpPermissions, "op-permissions")
+}
+
+func loadOpPermissions() error {
+	if *opPermissionsFlag == "" {
+		opPermissions.Store(nil)
+		return nil
+	}
+
+	permissions := opPermissionMap{}
+	for _, entry := range strings.Split(*opPermissionsFlag, ",") {
+		who, ops, found := strings.Cut(strings.TrimSpace(entry), "=")
+		kind, name, _ := strings.Cut(who, ":")
+		if !found || (who != "*" && (name == "" || (kind != "key" && kind != "user" && kind != "hmac" && kind != "scope"))) {
+			return fmt.Errorf("invalid -op-permissions entry %q: expected key:NAME, user:NAME, hmac:NAME, scope:SCOPE or *, then =OPS", entry)
+		}
+
+		if strings.TrimSpace(ops) == "*" {
+			permissions[who] = nil
+			continue
+		}
+
+		allowed, err := parseOpList(strings.ReplaceAll(ops, "|", ","))
+		if err != nil {
+			return fmt.Errorf("invalid -op-permissions entry for %s: %v", who, err)
+		}
+		permissions[who] = allowed
+	}
+
+	opPermissions.Store(&permissions)
+	return nil
+}
+
+// The operations a request may use; nil if it isn't limited
+type opGrant struct {
+	ops map[string]bool
+}
+
+type opGrantKey struct{}
+
+// Works out what the request's credentials allow.
+func grantFor(ctx context.Context) *opGrant {
+	permissions := opPermissions.Load()
+	if permissions == nil {
+		return nil
+	}
+
+	var whos []string
+	if name, ok := apiKeyName(ctx); ok {
+		whos = append(whos, "key:"+name)
+	}
+	if user, ok := basicAuthUser(ctx); ok {
+		whos = append(whos, "user:"+user)
+	}
+	if name, ok := signatureKeyName(ctx); ok {
+		whos = append(whos, "hmac:"+name)
+	}
+	claims, hasJWT := requestJWT(ctx)
+	for _, scope := range claims.Scopes {
+		whos = append(whos, "scope:"+scope)
+	}
+	if whos == nil && !hasJWT {
+		return nil
+	}
+
+	grant := &opGrant{ops: map[string]bool{}}
+	listed := false
+	for _, who := range whos {
+		ops, exists := (*permissions)[who]
+		if !exists {
+			continue
+		}
+		if ops == nil {
+			return nil
+		}
+
+		listed = true
+		for op := range ops {
+			grant.ops[op] = true
+		}
+	}
+
+	if !listed {
+		ops, exists := (*permissions)["*"]
+		if !exists || ops == nil {
+			return nil
+		}
+		grant.ops = ops
+	}
+
+	return grant
+}
+
+// Says what a computation may use, for ones that outlive their request.
+func grantContext(ctx context.Context, grant *opGrant) context.Context {
+	return context.WithValue(ctx, opGrantKey{}, grant)
+}
+
+func requestGrant(ctx context.Context) *opGrant {
+	grant, _ := ctx.Value(opGrantKey{}).(*opGrant)
+	return grant
+}
+
+// withOpPermissions works out what the request's credentials allow, for
+// lookupAnswer to check.
+func withOpPermissions(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		grant := grantFor(r.Context())
+		if grant == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(grantContext(r.Context(), grant)))
+	})
+}
+
+// The error for a question about an operation the credentials don't allow
+type opForbiddenError string
+
+func (err opForbiddenError) Error() string {
+	return fmt.Sprintf("Not allowed to use operation %s", string(err))
+}
+
+// Returns an opForbiddenError if the request can't use op, which should be
+// canonical already.
+func checkOpAllowed(ctx context.Context, op string) error {
+	grant := requestGrant(ctx)
+	if grant != nil && !grant.ops[op] {
+		return opForbiddenError(op)
+	}
+
+	return nil
+}
+
+// JSON data for an RFC 9457 problem
+type problemResponse struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Code   string `json:"code"` // as in errorResponse
+}
+
+func httpProblem(w http.ResponseWriter, status int, code string, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(problemResponse{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Code:   code,
+	})
+}
+
+// Responds 403 if err came from an operation the credentials don't allow,
+// returning whether it did.
+func httpOpForbidden(w http.ResponseWriter, err error) bool {
+	var forbidden opForbiddenError
+	if !errors.As(err, &forbidden) {
+		return false
+	}
+
+	httpProblem(w, http.StatusForbidden, "operation_forbidden", err.Error())
+	return true
+}
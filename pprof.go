@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"flag"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+)
+
+// With -pprof-addr, CPU, heap, goroutine and the other runtime profiles are
+// served at /debug/pprof/ on a listener of their own, kept off the public
+// one. Bind it to localhost or a unix socket, or set -pprof-token, which it
+// takes as a bearer token or as the basic auth password, so that
+//
+//	go tool pprof http://:TOKEN@localhost:6060/debug/pprof/heap
+//
+// works.
+
+var pprofAddrFlag = flag.String("pprof-addr", "", "address for a separate listener serving profiles at /debug/pprof/, e.g. localhost:6060 (off if empty)")
+var pprofTokenFlag = flag.String("pprof-token", "", "token the -pprof-addr listener requires, as a bearer token or basic auth password (none if empty)")
+
+func startPprof() error {
+	if *pprofAddrFlag == "" {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	handlePprof(mux)
+
+	l, err := listen(*pprofAddrFlag)
+	if err != nil {
+		return err
+	}
+
+	// no write timeout: a CPU profile takes as long as it was asked to
+	server := &http.Server{
+		Handler:           withTokenAuth(mux, *pprofTokenFlag, "http-math pprof"),
+		ReadHeaderTimeout: *readHeaderTimeoutFlag,
+	}
+	onShutdown(func(ctx context.Context) {
+		server.Shutdown(ctx)
+	})
+
+	go func() {
+		slog.Info("Running pprof server", "addr", *pprofAddrFlag)
+
+		err := server.Serve(l)
+		if !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("pprof server stopped", "err", err)
+		}
+	}()
+
+	return nil
+}
+
+// Serves the profiles on mux, at /debug/pprof/. Not cmdline, which could
+// have -admin-token and the rest of the secrets on it.
+func handlePprof(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+// Requires token of everything on a listener of its own, as a bearer token
+// or as the basic auth password (which is what pprof can send). An empty
+// token lets everyone in.
+func withTokenAuth(next http.Handler, token string, realm string) http.Handler {
+	if token == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found {
+			_, sent, found = r.BasicAuth()
+		}
+
+		if !found || subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Beyond -rate-limit, credentials can have a budget of computations a day
+// or a month (UTC), with -quotas: a comma-separated list of WHO=N/day or
+// WHO=N/month, where WHO is key:NAME, user:NAME, hmac:NAME, jwt:SUBJECT or
+// * for each of the rest:
+//
+//	-quotas 'key:public=1000/day,key:public=20000/month,*=100000/month'
+//
+// Batches, chains and jobs spend one for each item or step in them; only
+// computations that run are charged, not usage pages, bad requests or
+// idempotent replays. Once it's spent, computations get a 429 with the code
+// "quota_exceeded" until the day or month is over; a batch, chain or job
+// that needs more than is left is turned away whole, except for a streamed
+// batch, which stops where it runs out. Clients can check theirs at /quota.
+// Requests without credentials don't have a quota. With -quota-file, what's
+// been spent is saved every minute and on shutdown, and read back in on
+// startup, so a restart doesn't hand out a fresh budget.
+
+var quotasFlag = flag.String("quotas", "", "comma-separated WHO=N/day or WHO=N/month computation budgets (a batch item, chain step or job item is one each); WHO is key:NAME, user:NAME, hmac:NAME, jwt:SUBJECT or *")
+var quotaFileFlag = flag.String("quota-file", "", "file to keep quota usage in across restarts (disabled if empty)")
+
+// how often usage is saved to -quota-file
+const quotaSaveInterval = time.Minute
+
+// 0 is no limit
+type quotaLimits struct {
+	daily   uint64
+	monthly uint64
+}
+
+// What one client has spent; also JSON data for -quota-file
+type quotaUsage struct {
+	Day     string `json:"day"` // 2006-01-02
+	Daily   uint64 `json:"daily"`
+	Month   string `json:"month"` // 2006-01
+	Monthly uint64 `json:"monthly"`
+}
+
+type quotaStruct struct {
+	limits map[string]quotaLimits // by who
+	usage  map[string]*quotaUsage
+	dirty  bool // changed since it was saved
+	mutex  sync.Mutex
+}
+
+var quotas = &quotaStruct{limits: map[string]quotaLimits{}, usage: map[string]*quotaUsage{}}
+
+var quotaExceeded = newCounterVec("http_math_quota_exceeded_total",
+	"Computations turned away by -quotas, by period", "period")
+
+func init() {
+	registerReload(loadQuotas, "quotas")
+}
+
+func loadQuotas() error {
+	limits := map[string]quotaLimits{}
+	for _, entry := range strings.Split(*quotasFlag, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		who, budget, found := strings.Cut(entry, "=")
+		kind, name, _ := strings.Cut(who, ":")
+		if !found || (who != "*" && (name == "" || (kind != "key" && kind != "user" && kind != "hmac" && kind != "jwt"))) {
+			return fmt.Errorf("invalid -quotas entry %q: expected key:NAME, user:NAME, hmac:NAME, jwt:SUBJECT or *, then =N/day or =N/month", entry)
+		}
+
+		count, period, _ := strings.Cut(budget, "/")
+		n, err := strconv.ParseUint(count, 10, 64)
+		if err != nil || n == 0 {
+			return fmt.Errorf("invalid -quotas entry %q: expected a positive number of computations", entry)
+		}
+
+		l := limits[who]
+		switch period {
+		case "day":
+			l.daily = n
+		case "month":
+			l.monthly = n
+		default:
+			return fmt.Errorf("invalid -quotas entry %q: expected /day or /month", entry)
+		}
+		limits[who] = l
+	}
+
+	quotas.mutex.Lock()
+	defer quotas.mutex.Unlock()
+
+	quotas.limits = limits
+
+	return nil
+}
+
+// Who a request's quota belongs to, if it has credentials
+func quotaWho(ctx context.Context) (string, bool) {
+	if name, ok := apiKeyName(ctx); ok {
+		return "key:" + name, true
+	}
+	if user, ok := basicAuthUser(ctx); ok {
+		return "user:" + user, true
+	}
+	if name, ok := signatureKeyName(ctx); ok {
+		return "hmac:" + name, true
+	}
+	if claims, ok := requestJWT(ctx); ok {
+		return "jwt:" + claims.Subject, true
+	}
+
+	return "", false
+}
+
+// Starts of the current and next periods, in UTC
+func quotaPeriods(now time.Time) (day string, nextDay time.Time, month string, nextMonth time.Time) {
+	now = now.UTC()
+	year, mon, date := now.Date()
+	nextDay = time.Date(year, mon, date+1, 0, 0, 0, 0, time.UTC)
+	nextMonth = time.Date(year, mon+1, 1, 0, 0, 0, 0, time.UTC)
+
+	return now.Format(time.DateOnly), nextDay, now.Format("2006-01"), nextMonth
+}
+
+// must hold the mutex
+func (q *quotaStruct) limitsFor(who string) (quotaLimits, bool) {
+	l, exists := q.limits[who]
+	if !exists {
+		l, exists = q.limits["*"]
+	}
+
+	return l, exists
+}
+
+// What who has spent this day and month; must hold the mutex.
+func (q *quotaStruct) current(who string, now time.Time) *quotaUsage {
+	day, _, month, _ := quotaPeriods(now)
+
+	usage, exists := q.usage[who]
+	if !exists {
+		usage = &quotaUsage{}
+		q.usage[who] = usage
+	}
+	if usage.Day != day {
+		usage.Day, usage.Daily = day, 0
+	}
+	if usage.Month != month {
+		usage.Month, usage.Monthly = month, 0
+	}
+
+	return usage
+}
+
+// Spends n of who's computations if there are that many left, or with n
+// 0, only checks there's one left. If not, returns the period that's spent
+// and when it's over.
+func (q *quotaStruct) spend(who string, n uint64, now time.Time) (ok bool, period string, reset time.Time) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	l, exists := q.limitsFor(who)
+	if !exists {
+		return true, "", time.Time{}
+	}
+
+	usage := q.current(who, now)
+	_, nextDay, _, nextMonth := quotaPeriods(now)
+	if l.monthly > 0 && usage.Monthly+max(n, 1) > l.monthly {
+		return false, "month", nextMonth
+	}
+	if l.daily > 0 && usage.Daily+max(n, 1) > l.daily {
+		return false, "day", nextDay
+	}
+
+	if n > 0 {
+		usage.Daily += n
+		usage.Monthly += n
+		q.dirty = true
+	}
+
+	return true, "", time.Time{}
+}
+
+// Gives back n of who's computations.
+func (q *quotaStruct) refund(who string, n uint64, now time.Time) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if _, exists := q.limitsFor(who); !exists {
+		return
+	}
+
+	usage := q.current(who, now)
+	usage.Daily -= min(n, usage.Daily)
+	usage.Monthly -= min(n, usage.Monthly)
+	q.dirty = true
+}
+
+// The error for computations beyond what's left of the quota
+type quotaExceededError struct {
+	period string
+	reset  time.Time
+}
+
+func (err *quotaExceededError) Error() string {
+	return fmt.Sprintf("Quota for the %s is spent; it resets at %s", err.period, err.reset.Format(time.RFC3339))
+}
+
+// Spends n of the request's computations, returning a *quotaExceededError
+// if there aren't that many left. Requests without a quota always can. With
+// n 0, only checks there's one left.
+func spendQuota(ctx context.Context, n int) error {
+	who, ok := quotaWho(ctx)
+	if !ok || n < 0 {
+		return nil
+	}
+
+	ok, period, reset := quotas.spend(who, uint64(n), time.Now())
+	if !ok {
+		quotaExceeded.add(1, period)
+		return &quotaExceededError{period: period, reset: reset}
+	}
+
+	return nil
+}
+
+// Gives back n of the request's computations, when they weren't done after
+// all.
+func refundQuota(ctx context.Context, n int) {
+	who, ok := quotaWho(ctx)
+	if ok && n > 0 {
+		quotas.refund(who, uint64(n), time.Now())
+	}
+}
+
+// Responds 429 if err came from a spent quota, returning whether it did.
+func httpQuotaExceeded(w http.ResponseWriter, err error) bool {
+	var exceeded *quotaExceededError
+	if !errors.As(err, &exceeded) {
+		return false
+	}
+
+	w.Header().Set("Retry-After", ceilSeconds(time.Until(exceeded.reset)))
+	httpErrorCode(w, http.StatusTooManyRequests, "quota_exceeded", exceeded.Error())
+	return true
+}
+
+// withQuota turns away computations once the client's quota is spent. It
+// doesn't spend any: the handlers do, once they know how many computations
+// there are, so usage pages, bad requests and the like are free. Like
+// withMaintenance, it lets job listings by.
+func withQuota(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.URL.Path == "/jobs" {
+			handler(w, r)
+			return
+		}
+
+		err := spendQuota(r.Context(), 0)
+		if err != nil {
+			httpQuotaExceeded(w, err)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// JSON data for one period in GET /quota
+type quotaPeriodResponse struct {
+	Limit     uint64    `json:"limit"`
+	Used      uint64    `json:"used"`
+	Remaining uint64    `json:"remaining"`
+	Resets    time.Time `json:"resets"`
+}
+
+// JSON data for GET /quota; periods without a limit are left out
+type quotaResponse struct {
+	Client  string               `json:"client"`
+	Daily   *quotaPeriodResponse `json:"daily,omitempty"`
+	Monthly *quotaPeriodResponse `json:"monthly,omitempty"`
+}
+
+func newQuotaPeriodResponse(limit uint64, used uint64, resets time.Time) *quotaPeriodResponse {
+	return &quotaPeriodResponse{Limit: limit, Used: used, Remaining: limit - min(used, limit), Resets: resets}
+}
+
+// GET /quota says how much of its quota the client has left.
+func doQuota(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Usage: curl -H 'X-API-Key: KEY' http://localhost:8080/quota", http.StatusMethodNotAllowed)
+		return
+	}
+
+	who, ok := quotaWho(r.Context())
+	if !ok {
+		writeData(w, r, http.StatusOK, quotaResponse{Client: requestClient(r.Context())})
+		return
+	}
+
+	now := time.Now()
+	_, nextDay, _, nextMonth := quotaPeriods(now)
+	response := quotaResponse{Client: who}
+
+	quotas.mutex.Lock()
+	l, exists := quotas.limitsFor(who)
+	if exists {
+		usage := quotas.current(who, now)
+		if l.daily > 0 {
+			response.Daily = newQuotaPeriodResponse(l.daily, usage.Daily, nextDay)
+		}
+		if l.monthly > 0 {
+			response.Monthly = newQuotaPeriodResponse(l.monthly, usage.Monthly, nextMonth)
+		}
+	}
+	quotas.mutex.Unlock()
+
+	writeData(w, r, http.StatusOK, response)
+}
+
+// Loads usage from -quota-file, if it's set. A missing file isn't an error;
+// nothing's been spent yet.
+func loadQuotaFile() error {
+	if *quotaFileFlag == "" {
+		return nil
+	}
+
+	f, err := os.Open(*quotaFileFlag)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	usage := map[string]*quotaUsage{}
+	err = json.NewDecoder(f).Decode(&usage)
+	if err != nil {
+		return fmt.Errorf("%s: %v", *quotaFileFlag, err)
+	}
+
+	quotas.mutex.Lock()
+	defer quotas.mutex.Unlock()
+
+	quotas.usage = usage
+
+	return nil
+}
+
+// Saves usage to -quota-file, if it's set and anything changed. Like the
+// cache file, it's written next to it and renamed over it.
+func saveQuotaFile() error {
+	if *quotaFileFlag == "" {
+		return nil
+	}
+
+	quotas.mutex.Lock()
+	if !quotas.dirty {
+		quotas.mutex.Unlock()
+		return nil
+	}
+	// last month's usage won't count again
+	_, _, month, _ := quotaPeriods(time.Now())
+	for who, usage := range quotas.usage {
+		if usage.Month != month {
+			delete(quotas.usage, who)
+		}
+	}
+	data, err := json.Marshal(quotas.usage)
+	quotas.dirty = false
+	quotas.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			quotas.mutex.Lock()
+			quotas.dirty = true
+			quotas.mutex.Unlock()
+		}
+	}()
+
+	tmp, err := os.CreateTemp(filepath.Dir(*quotaFileFlag), filepath.Base(*quotaFileFlag)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // fails harmlessly once renamed
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), *quotaFileFlag)
+	return err
+}
+
+// Saves usage every quotaSaveInterval, so a crash loses at most that much.
+func saveQuotasPeriodically() {
+	if *quotaFileFlag == "" {
+		return
+	}
+
+	for range time.Tick(quotaSaveInterval) {
+		err := saveQuotaFile()
+		if err != nil {
+			slog.Error("Error saving quota usage", "err", err)
+		}
+	}
+}
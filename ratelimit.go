@@ -0,0 +1,222 @@
+package main
+
+import (
+	"container/list"
+	"flag"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// With -rate-limit, each client gets a token bucket: it fills at that many
+// requests a second, up to -rate-limit-burst, and a request that finds it
+// empty gets a 429 instead of a turn. Clients are known by their API key
+// (or JWT subject, Basic auth user or signing key) where they have one, and
+// by address otherwise, so one script can't starve everyone else. Responses
+// say how the client stands with the RateLimit-* headers.
+
+var rateLimitFlag = flag.Float64("rate-limit", 0, "requests per second to allow each client (0 for no limit)")
+var rateLimitBurstFlag = flag.Int("rate-limit-burst", 0, "requests a client can make at once, above -rate-limit (default: one second's worth)")
+
+// Checking credentials can cost something (a bcrypt comparison, a trip to
+// the introspection endpoint, reading the body to check a signature), so
+// -ip-rate-limit limits each address before they're looked at, and banned
+// addresses are turned away then too. Set it well above -rate-limit if many
+// clients share an address.
+var ipRateLimitFlag = flag.Float64("ip-rate-limit", 0, "requests per second to allow each address, before credentials are checked (0 for no limit)")
+var ipRateLimitBurstFlag = flag.Int("ip-rate-limit-burst", 0, "requests an address can make at once, above -ip-rate-limit (default: one second's worth)")
+
+// how many clients' buckets are kept; the least recently seen are dropped
+// first, since theirs have had the longest to fill back up
+const rateLimitMaxClients = 10000
+
+// health checks and scrapes aren't limited
+var rateLimitExemptPaths = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+	"/metrics": true,
+}
+
+var rateLimited = newCounterVec("http_math_rate_limited_total",
+	"Requests turned away by -rate-limit")
+
+type tokenBucket struct {
+	client  string
+	tokens  float64
+	updated time.Time
+	element *list.Element // its place in rateLimitStruct.lru
+}
+
+type rateLimitStruct struct {
+	rate    float64 // tokens a second
+	burst   float64
+	buckets map[string]*tokenBucket
+	lru     *list.List // of *tokenBucket, most recently seen at the front
+	mutex   sync.Mutex
+}
+
+// nil when there's no limit
+var rateLimit atomic.Pointer[rateLimitStruct]
+var ipRateLimit atomic.Pointer[rateLimitStruct]
+
+func init() {
+	registerReload(loadRateLimit, "rate-limit", "rate-limit-burst", "ip-rate-limit", "ip-rate-limit-burst")
+}
+
+func loadRateLimit() error {
+	err := loadLimit(&rateLimit, "-rate-limit", *rateLimitFlag, *rateLimitBurstFlag)
+	if err != nil {
+		return err
+	}
+
+	return loadLimit(&ipRateLimit, "-ip-rate-limit", *ipRateLimitFlag, *ipRateLimitBurstFlag)
+}
+
+// Sets limit to rate a second, with burst (or a second's worth).
+func loadLimit(limit *atomic.Pointer[rateLimitStruct], name string, rate float64, burstFlag int) error {
+	if !(rate >= 0) || math.IsInf(rate, 0) {
+		return fmt.Errorf("invalid %s: expected requests per second, or 0", name)
+	}
+	if burstFlag < 0 {
+		return fmt.Errorf("%s-burst can't be negative", name)
+	}
+	if rate == 0 {
+		limit.Store(nil)
+		return nil
+	}
+
+	burst := float64(burstFlag)
+	if burst == 0 {
+		burst = max(math.Ceil(rate), 1)
+	}
+
+	// a reload for other flags mustn't fill everyone's bucket back up
+	old := limit.Load()
+	if old != nil && old.rate == rate && old.burst == burst {
+		return nil
+	}
+
+	limit.Store(&rateLimitStruct{rate: rate, burst: burst, buckets: map[string]*tokenBucket{}, lru: list.New()})
+	return nil
+}
+
+// Takes a token from client's bucket if there is one. Either way, returns
+// what's left and how long until the bucket's full again, or until there's
+// a token, if there wasn't.
+func (l *rateLimitStruct) take(client string, now time.Time) (ok bool, remaining float64, wait time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	bucket, exists := l.buckets[client]
+	if exists {
+		l.lru.MoveToFront(bucket.element)
+	} else {
+		if len(l.buckets) >= rateLimitMaxClients {
+			l.forget(l.lru.Back().Value.(*tokenBucket))
+		}
+
+		bucket = &tokenBucket{client: client, tokens: l.burst, updated: now}
+		bucket.element = l.lru.PushFront(bucket)
+		l.buckets[client] = bucket
+	}
+
+	bucket.tokens = min(bucket.tokens+now.Sub(bucket.updated).Seconds()*l.rate, l.burst)
+	bucket.updated = now
+
+	if bucket.tokens < 1 {
+		return false, 0, l.until(1 - bucket.tokens)
+	}
+
+	bucket.tokens--
+	return true, bucket.tokens, l.until(l.burst - bucket.tokens)
+}
+
+// how long it takes to get so many tokens
+func (l *rateLimitStruct) until(tokens float64) time.Duration {
+	return time.Duration(tokens / l.rate * float64(time.Second))
+}
+
+// Must hold the mutex.
+func (l *rateLimitStruct) forget(bucket *tokenBucket) {
+	l.lru.Remove(bucket.element)
+	delete(l.buckets, bucket.client)
+}
+
+// Who a request counts against: its credentials if it has any, otherwise
+// its address. Unlike clientID, a session doesn't count, since anyone can
+// start as many as they like.
+func rateLimitKey(r *http.Request) string {
+	ctx := r.Context()
+
+	if name, ok := apiKeyName(ctx); ok {
+		return "key:" + name
+	}
+	if claims, ok := requestJWT(ctx); ok {
+		return "jwt:" + claims.Subject
+	}
+	if user, ok := basicAuthUser(ctx); ok {
+		return "user:" + user
+	}
+	if name, ok := signatureKeyName(ctx); ok {
+		return "hmac:" + name
+	}
+
+	return "ip:" + clientIP(r)
+}
+
+// whole seconds, rounded up, as the RateLimit-* headers want
+func ceilSeconds(d time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+}
+
+// Takes a token for client, and says how they stand. If there wasn't one,
+// responds 429 and returns false.
+func (l *rateLimitStruct) allow(w http.ResponseWriter, client string) bool {
+	ok, remaining, wait := l.take(client, time.Now())
+
+	w.Header().Set("RateLimit-Limit", strconv.FormatFloat(l.burst, 'f', -1, 64))
+	w.Header().Set("RateLimit-Remaining", strconv.FormatFloat(math.Floor(remaining), 'f', -1, 64))
+	w.Header().Set("RateLimit-Reset", ceilSeconds(wait))
+	if ok {
+		return true
+	}
+
+	rateLimited.add(1)
+	w.Header().Set("Retry-After", ceilSeconds(wait))
+	httpErrorCode(w, http.StatusTooManyRequests, "rate_limited",
+		fmt.Sprintf("Too many requests; slow down to %g a second", l.rate))
+	return false
+}
+
+func withRateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := rateLimit.Load()
+		if limit == nil || rateLimitExemptPaths[r.URL.Path] || limit.allow(w, rateLimitKey(r)) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// withIPRateLimit limits each address, ahead of the middleware that checks
+// credentials. Its 429s count towards a ban, as withBans won't see them.
+func withIPRateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := ipRateLimit.Load()
+		if limit == nil || rateLimitExemptPaths[r.URL.Path] || isAdmin(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		client := "ip:" + clientIP(r)
+		if limit.allow(w, client) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		bans.observe(r, client, http.StatusTooManyRequests, time.Now())
+	})
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Behind a load balancer, RemoteAddr is the balancer's address. Requests
+// from trusted proxies have their forwarding header believed instead, so
+// logs and per-client policies see the real client. Only the one header the
+// proxies write is read (-forwarded-header): most only add to
+// X-Forwarded-For, and pass along whatever Forwarded header the client made
+// up.
+var trustedProxiesFlag = flag.String("trusted-proxies", "",
+	"comma-separated CIDRs of proxies whose -forwarded-header is believed; "+
+		`"unix" trusts peers on unix sockets`)
+var forwardedHeaderFlag = flag.String("forwarded-header", "X-Forwarded-For",
+	"header the -trusted-proxies say who they forwarded for in: X-Forwarded-For or Forwarded")
+
+var trustedProxies []*net.IPNet
+var trustUnixPeers bool
+
+// the canonical -forwarded-header
+var forwardedHeader string
+
+func parseTrustedProxies(list string) error {
+	trustedProxies = nil
+	trustUnixPeers = false
+
+	forwardedHeader = http.CanonicalHeaderKey(*forwardedHeaderFlag)
+	if forwardedHeader != "X-Forwarded-For" && forwardedHeader != "Forwarded" {
+		return fmt.Errorf("invalid -forwarded-header %q: expected X-Forwarded-For or Forwarded", *forwardedHeaderFlag)
+	}
+
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		switch {
+		case entry == "":
+			continue
+		case entry == "unix":
+			trustUnixPeers = true
+			continue
+		}
+
+		network, err := parseNetwork(entry)
+		if err != nil {
+			return fmt.Errorf("invalid -trusted-proxies entry %q: %v", entry, err)
+		}
+
+		trustedProxies = append(trustedProxies, network)
+	}
+
+	return nil
+}
+
+// Parses a CIDR, or a bare address as a network of one.
+func parseNetwork(entry string) (*net.IPNet, error) {
+	if !strings.Contains(entry, "/") {
+		if strings.Contains(entry, ":") {
+			entry += "/128"
+		} else {
+			entry += "/32"
+		}
+	}
+
+	_, network, err := net.ParseCIDR(entry)
+	return network, err
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// returns the addresses a request was forwarded for, client first
+func forwardedFor(r *http.Request) []string {
+	var addrs []string
+
+	if forwardedHeader == "Forwarded" {
+		for _, header := range r.Header.Values("Forwarded") {
+			for _, element := range strings.Split(header, ",") {
+				for _, pair := range strings.Split(element, ";") {
+					name, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+					if strings.EqualFold(name, "for") {
+						addrs = append(addrs, strings.Trim(value, `"`))
+					}
+				}
+			}
+		}
+
+		return addrs
+	}
+
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, addr := range strings.Split(header, ",") {
+			addrs = append(addrs, strings.TrimSpace(addr))
+		}
+	}
+
+	return addrs
+}
+
+// strips ports and IPv6 brackets from a forwarded address
+func parseForwardedIP(addr string) net.IP {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+
+	return net.ParseIP(strings.Trim(addr, "[]"))
+}
+
+// Works out the real client address. Forwarded addresses are walked from the
+// nearest hop outward, and the first one that isn't a trusted proxy is the
+// client; a client can prepend whatever it likes, so nothing further out
+// than that can be believed.
+func realClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	peer := net.ParseIP(host)
+	if peer == nil {
+		// unix socket peers have no address
+		if !trustUnixPeers {
+			return host
+		}
+	} else if !isTrustedProxy(peer) {
+		return host
+	}
+
+	addrs := forwardedFor(r)
+	for i := len(addrs) - 1; i >= 0; i-- {
+		ip := parseForwardedIP(addrs[i])
+		if ip == nil {
+			// obfuscated or "unknown"; we can't see past it
+			return addrs[i]
+		}
+
+		if !isTrustedProxy(ip) || i == 0 {
+			return ip.String()
+		}
+	}
+
+	return host
+}
+
+type clientIPKey struct{}
+
+// withRealIP works out the client address once per request
+func withRealIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), clientIPKey{}, realClientIP(r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// the client's address, as seen through any trusted proxies
+func clientIP(r *http.Request) string {
+	ip, ok := r.Context().Value(clientIPKey{}).(string)
+	if ok {
+		return ip
+	}
+
+	return realClientIP(r)
+}
@@ -0,0 +1,188 @@
+//go:build redis
+
+package main
+
+// The Redis cache needs go-redis, so it is only compiled in with:
+// go build -tags redis
+//
+// Replicas pointed at the same Redis share their answers. If Redis can't be
+// reached, answers are cached in memory instead until it comes back, so an
+// outage costs some recomputation rather than errors.
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var redisURLFlag = flag.String("redis-url", "redis://localhost:6379/0", "Redis server for -cache-backend=redis")
+var redisPrefixFlag = flag.String("redis-prefix", "http-math:", "prefix for cache keys in Redis, so it can be shared with other things")
+var redisTimeoutFlag = flag.Duration("redis-timeout", 500*time.Millisecond, "how long to wait on Redis before falling back to the memory cache")
+
+const redisPurgeBatch = 1000
+
+func init() {
+	cacheBackends["redis"] = newRedisCache
+}
+
+type redisCache struct {
+	client   *redis.Client
+	prefix   string
+	opts     cacheOptions
+	fallback *cacheStruct // used while Redis is unreachable
+	down     atomic.Bool  // so outages are logged once, not on every request
+	hits     atomic.Uint64
+	misses   atomic.Uint64
+	sets     atomic.Uint64
+}
+
+func newRedisCache(opts cacheOptions) (Cache, error) {
+	redisOpts, err := redis.ParseURL(*redisURLFlag)
+	if err != nil {
+		return nil, err
+	}
+
+	redisOpts.DialTimeout = *redisTimeoutFlag
+	redisOpts.ReadTimeout = *redisTimeoutFlag
+	redisOpts.WriteTimeout = *redisTimeoutFlag
+
+	c := &redisCache{
+		client:   redis.NewClient(redisOpts),
+		prefix:   *redisPrefixFlag,
+		opts:     opts,
+		fallback: newCache(opts),
+	}
+
+	// not fatal; we'll use the fallback until it's up
+	c.failed(context.Background(), c.client.Ping(context.Background()).Err())
+
+	return c, nil
+}
+
+// Keeps track of whether Redis is up, and returns true if err means it isn't.
+func (c *redisCache) failed(ctx context.Context, err error) bool {
+	if err == nil || errors.Is(err, redis.Nil) {
+		if c.down.Swap(false) {
+			slog.InfoContext(ctx, "Redis cache is back")
+		}
+		return false
+	}
+
+	if !c.down.Swap(true) {
+		slog.WarnContext(ctx, "Redis cache unavailable, using memory", "err", err)
+	}
+	return true
+}
+
+func (c *redisCache) Get(ctx context.Context, key string) (cachedAnswer, bool) {
+	// a request going away isn't Redis going down
+	ctx = context.WithoutCancel(ctx)
+
+	// GETEX so the TTL slides on use, like the memory cache
+	var val string
+	var err error
+	if c.opts.slidingFor(key) {
+		val, err = c.client.GetEx(ctx, c.prefix+key, c.opts.ttlFor(key, cachedAnswer{})).Result()
+	} else {
+		val, err = c.client.Get(ctx, c.prefix+key).Result()
+	}
+	if c.failed(ctx, err) {
+		return c.fallback.Get(ctx, key)
+	}
+
+	value, err := decodeCachedAnswer(val)
+	if err != nil {
+		// not ours, or redis.Nil
+		c.misses.Add(1)
+		return cachedAnswer{}, false
+	}
+
+	if value.err != "" && c.opts.slidingFor(key) {
+		// GETEX didn't know it was an error; put its TTL back
+		c.failed(ctx, c.client.PExpire(ctx, c.prefix+key, c.opts.ttlFor(key, value)).Err())
+	}
+
+	c.hits.Add(1)
+	return value, true
+}
+
+func (c *redisCache) Set(ctx context.Context, key string, value cachedAnswer) {
+	ctx = context.WithoutCancel(ctx)
+
+	// a TTL of 0 means no expiry to Redis too
+	val := encodeCachedAnswer(value)
+	err := c.client.Set(ctx, c.prefix+key, val, c.opts.jitterTTL(c.opts.ttlFor(key, value))).Err()
+	if c.failed(ctx, err) {
+		c.fallback.Set(ctx, key, value)
+		return
+	}
+
+	c.sets.Add(1)
+}
+
+func (c *redisCache) Delete(key string) {
+	// the fallback may have a copy from an outage
+	c.fallback.Delete(key)
+	c.failed(context.Background(), c.client.Del(context.Background(), c.prefix+key).Err())
+}
+
+func (c *redisCache) ping() error {
+	return c.client.Ping(context.Background()).Err()
+}
+
+// Only the fallback is local; Redis itself is shared.
+func (c *redisCache) invalidateLocal(key string) {
+	c.fallback.invalidateLocal(key)
+}
+
+// Deletes every key with our prefix, a batch at a time so Redis isn't
+// blocked for long.
+func (c *redisCache) Purge() error {
+	c.fallback.Purge()
+
+	ctx := context.Background()
+	iter := c.client.Scan(ctx, 0, c.prefix+"*", redisPurgeBatch).Iterator()
+
+	keys := make([]string, 0, redisPurgeBatch)
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+
+		if len(keys) == redisPurgeBatch {
+			err := c.client.Del(ctx, keys...).Err()
+			if err != nil {
+				return err
+			}
+			keys = keys[:0]
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+
+	if len(keys) > 0 {
+		return c.client.Del(ctx, keys...).Err()
+	}
+
+	return nil
+}
+
+// Entries and Bytes only count the fallback; counting ours in Redis would
+// need a scan of the whole keyspace.
+func (c *redisCache) Stats() CacheStats {
+	stats := c.fallback.Stats()
+	stats.Hits += c.hits.Load()
+	stats.Misses += c.misses.Load()
+	stats.Sets += c.sets.Load()
+
+	return stats
+}
+
+func (c *redisCache) Close() error {
+	c.fallback.Close()
+	return c.client.Close()
+}
@@ -0,0 +1,63 @@
+//go:build redis
+
+package main
+
+// -cache-invalidation=redis broadcasts over Redis pub/sub, using the server
+// from -redis-url.
+
+import (
+	"context"
+	"flag"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var redisInvalidationChannelFlag = flag.String("redis-invalidation-channel", "http-math:invalidate", "Redis pub/sub channel for -cache-invalidation=redis")
+
+func init() {
+	invalidationBuses["redis"] = newRedisBus
+}
+
+type redisBus struct {
+	client *redis.Client
+	pubsub *redis.PubSub
+}
+
+func newRedisBus() (invalidationBus, error) {
+	opts, err := redis.ParseURL(*redisURLFlag)
+	if err != nil {
+		return nil, err
+	}
+
+	return &redisBus{client: redis.NewClient(opts)}, nil
+}
+
+func (b *redisBus) publish(payload []byte) error {
+	return b.client.Publish(context.Background(), *redisInvalidationChannelFlag, payload).Err()
+}
+
+// go-redis resubscribes by itself if the connection drops
+func (b *redisBus) subscribe(handle func(payload []byte)) error {
+	ctx := context.Background()
+
+	b.pubsub = b.client.Subscribe(ctx, *redisInvalidationChannelFlag)
+	_, err := b.pubsub.Receive(ctx) // wait for the confirmation
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for msg := range b.pubsub.Channel() {
+			handle([]byte(msg.Payload))
+		}
+	}()
+
+	return nil
+}
+
+func (b *redisBus) Close() error {
+	if b.pubsub != nil {
+		b.pubsub.Close()
+	}
+	return b.client.Close()
+}
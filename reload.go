@@ -0,0 +1,134 @@
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// On SIGHUP, or POST /reload, the environment and -config are read again
+// and the settings that can change while running are applied, without
+// dropping requests or the cache. Everything else needs a restart. A
+// reloadable setting that's gone from both goes back to its default; the
+// command line still wins over them.
+//
+// Each part that can be reloaded registers the flags it reads with
+// registerReload, and only reads them from its apply function.
+
+type reloadable struct {
+	flags []string
+	apply func() error
+}
+
+var reloadables []reloadable
+
+// one reload at a time
+var reloadMutex sync.Mutex
+
+func registerReload(apply func() error, flags ...string) {
+	reloadables = append(reloadables, reloadable{flags, apply})
+}
+
+func applyReloads() error {
+	for _, r := range reloadables {
+		err := r.apply()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Reads the configuration again and applies what can be. If any of it is
+// invalid, none of it is.
+func reloadConfig() error {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	settings, err := layeredSettings()
+	if err != nil {
+		return err
+	}
+
+	latest := map[string]flagSetting{}
+	for _, setting := range settings {
+		latest[setting.name] = setting
+	}
+
+	var changes []flagSetting
+	previous := map[string]string{}
+	previousSources := map[string]string{}
+	for _, r := range reloadables {
+		for _, name := range r.flags {
+			if commandLineFlags[name] {
+				continue
+			}
+
+			f := flag.Lookup(name)
+			setting, exists := latest[name]
+			if !exists {
+				setting = flagSetting{name, f.DefValue, "default"}
+			}
+
+			previous[name] = f.Value.String()
+			previousSources[name] = flagSources[name]
+			changes = append(changes, setting)
+		}
+	}
+
+	err = setFlags(changes, nil)
+	if err == nil {
+		err = applyReloads()
+	}
+	if err != nil {
+		for name, value := range previous {
+			setFlags([]flagSetting{{name, value, previousSources[name]}}, nil)
+		}
+		applyReloads()
+
+		return err
+	}
+
+	slog.Info("Configuration reloaded")
+	return nil
+}
+
+// Reloads the configuration on every SIGHUP.
+func reloadOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	go func() {
+		for range signals {
+			err := reloadConfig()
+			if err != nil {
+				slog.Error("Error reloading configuration", "err", err)
+			}
+		}
+	}()
+}
+
+// POST /reload does what SIGHUP does. Admin only.
+func doReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Usage: curl -X POST -H 'Authorization: Bearer TOKEN' http://localhost:8080/reload",
+			http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := reloadConfig()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		slog.ErrorContext(r.Context(), "Error reloading configuration", "err", err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Configuration reloaded")
+	w.WriteHeader(http.StatusNoContent)
+}
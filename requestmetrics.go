@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Every request is counted and timed for /metrics, by route (the pattern it
+// was handled by, so IDs in paths don't make a series each), the operation
+// for / and status.
+
+var requestsTotal = newCounterVec("http_math_requests_total",
+	"HTTP requests answered, by route, operation and status.", "route", "op", "status")
+var requestDuration = newHistogramVec("http_math_request_duration_seconds",
+	"How long HTTP requests took to answer, by route, operation and status.", defaultLatencyBuckets, "route", "op", "status")
+
+var requestsInFlight atomic.Int64
+
+func init() {
+	registerMetrics(func() []metricValue {
+		return []metricValue{
+			{"http_math_requests_in_flight", "HTTP requests being answered right now.", "gauge", float64(requestsInFlight.Load())},
+		}
+	})
+}
+
+// statusWriter keeps track of the status and size of a response as it goes
+// through.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *statusWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// The status sent, which is 200 if the handler never said
+func (w *statusWriter) statusCode() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+func withMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestsInFlight.Add(1)
+		defer requestsInFlight.Add(-1)
+
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+
+		route, op := requestRoute(r)
+		status := strconv.Itoa(sw.statusCode())
+		requestsTotal.add(1, route, op, status)
+		requestDuration.observe(time.Since(start).Seconds(), route, op, status)
+		if op != "" {
+			requestsByOp.Add(op, 1)
+		}
+	})
+}
+
+// The pattern r is routed to, and the operation if it's a question; unknown
+// operations are left out, so they can't make up series.
+func requestRoute(r *http.Request) (route string, op string) {
+	_, route = publicMux.Handler(r)
+	if route == "" {
+		route = "none"
+	}
+
+	if route == "/" {
+		first, _, _ := strings.Cut(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/")
+		first, _ = url.PathUnescape(first)
+		if _, exists := operations[canonicalOp(first)]; exists {
+			op = canonicalOp(first)
+		}
+	}
+
+	return route, op
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Responses carry the usual security headers: X-Content-Type-Options,
+// Referrer-Policy, Strict-Transport-Security (HSTS), and on the web UI a
+// Content-Security-Policy that only lets it load its own scripts and
+// styles. By default they're sent on TLS connections only, since HSTS means
+// nothing over plain HTTP and most plain HTTP is behind a proxy that sets
+// its own; -security-headers always or never changes that. HSTS is never
+// sent over plain HTTP, whatever it says (browsers ignore it there).
+
+var securityHeadersFlag = flag.String("security-headers", "auto", "when to send security headers: auto (on TLS connections), always or never")
+var hstsMaxAgeFlag = flag.Duration("hsts-max-age", 365*24*time.Hour, "how long browsers should stick to HTTPS, in Strict-Transport-Security (0 to not send it)")
+var hstsIncludeSubdomainsFlag = flag.Bool("hsts-include-subdomains", false, "have Strict-Transport-Security cover subdomains too")
+var contentSecurityPolicyFlag = flag.String("content-security-policy", "default-src 'self'; base-uri 'none'; form-action 'none'; frame-ancestors 'none'", "Content-Security-Policy for the web UI (not sent if empty)")
+var referrerPolicyFlag = flag.String("referrer-policy", "no-referrer", "Referrer-Policy to send (not sent if empty)")
+
+type securityHeadersStruct struct {
+	always bool // or only on TLS connections
+	hsts   string
+	csp    string
+	ref    string
+}
+
+// nil when they're never sent
+var securityHeaders atomic.Pointer[securityHeadersStruct]
+
+func init() {
+	registerReload(loadSecurityHeaders, "security-headers", "hsts-max-age", "hsts-include-subdomains",
+		"content-security-policy", "referrer-policy")
+}
+
+func loadSecurityHeaders() error {
+	var always bool
+	switch *securityHeadersFlag {
+	case "auto":
+	case "always":
+		always = true
+	case "never":
+		securityHeaders.Store(nil)
+		return nil
+	default:
+		return fmt.Errorf("invalid -security-headers %q: expected auto, always or never", *securityHeadersFlag)
+	}
+	if *hstsMaxAgeFlag < 0 {
+		return fmt.Errorf("invalid -hsts-max-age %v", *hstsMaxAgeFlag)
+	}
+
+	var hsts string
+	if *hstsMaxAgeFlag > 0 {
+		hsts = "max-age=" + strconv.FormatInt(int64(hstsMaxAgeFlag.Seconds()), 10)
+		if *hstsIncludeSubdomainsFlag {
+			hsts += "; includeSubDomains"
+		}
+	}
+
+	securityHeaders.Store(&securityHeadersStruct{
+		always: always,
+		hsts:   hsts,
+		csp:    *contentSecurityPolicyFlag,
+		ref:    *referrerPolicyFlag,
+	})
+	return nil
+}
+
+// withSecurityHeaders sets the security headers before anything else gets
+// to respond, so errors have them too.
+func withSecurityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sh := securityHeaders.Load()
+		if sh == nil || (r.TLS == nil && !sh.always) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		h.Set("X-Content-Type-Options", "nosniff")
+		if sh.ref != "" {
+			h.Set("Referrer-Policy", sh.ref)
+		}
+		if sh.hsts != "" && r.TLS != nil {
+			h.Set("Strict-Transport-Security", sh.hsts)
+		}
+		if sh.csp != "" && strings.HasPrefix(r.URL.Path, "/ui/") {
+			h.Set("Content-Security-Policy", sh.csp)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
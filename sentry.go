@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// With -sentry-dsn, panics in handlers and the errors behind 5xx responses
+// are reported to Sentry (or anything that speaks its protocol, like
+// GlitchTip), with the request they happened in. 503s aren't reported;
+// we send those on purpose (maintenance, timeouts, shutting down). Events
+// are sent in the background, and dropped if they pile up faster than
+// they can be sent.
+
+var sentryDSNFlag = flag.String("sentry-dsn", "", "Sentry (or GlitchTip) DSN to report panics and server errors to (off if empty)")
+var sentryEnvironmentFlag = flag.String("sentry-environment", "", "environment to report to Sentry, e.g. production")
+
+const sentryQueueSize = 100
+
+type sentryStruct struct {
+	endpoint string // the envelope endpoint
+	auth     string // X-Sentry-Auth
+	dsn      string
+	queue    chan sentryEvent
+	sending  atomic.Bool
+	client   *http.Client
+}
+
+// nil when Sentry is off
+var sentry *sentryStruct
+
+// Reads -sentry-dsn and starts sending events.
+func startSentry() error {
+	if *sentryDSNFlag == "" {
+		return nil
+	}
+
+	// https://KEY@host/[path/]PROJECT
+	dsn, err := url.Parse(*sentryDSNFlag)
+	if err != nil {
+		return fmt.Errorf("invalid -sentry-dsn: %v", err)
+	}
+
+	slash := strings.LastIndex(dsn.Path, "/")
+	prefix, project := dsn.Path[:max(slash, 0)], dsn.Path[slash+1:]
+	if dsn.User == nil || dsn.User.Username() == "" || project == "" {
+		return errors.New("invalid -sentry-dsn: expected https://KEY@host/PROJECT")
+	}
+
+	sentry = &sentryStruct{
+		endpoint: fmt.Sprintf("%s://%s%s/api/%s/envelope/", dsn.Scheme, dsn.Host, prefix, project),
+		auth: fmt.Sprintf("Sentry sentry_version=7, sentry_client=http-math/%s, sentry_key=%s",
+			version, dsn.User.Username()),
+		dsn:    *sentryDSNFlag,
+		queue:  make(chan sentryEvent, sentryQueueSize),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+
+	go sentry.run()
+	onShutdown(sentry.flush)
+
+	return nil
+}
+
+// JSON data for a Sentry event; see https://develop.sentry.dev/sdk/event-payloads/
+type sentryEvent struct {
+	EventID     string            `json:"event_id"`
+	Timestamp   time.Time         `json:"timestamp"`
+	Level       string            `json:"level"`
+	Platform    string            `json:"platform"`
+	ServerName  string            `json:"server_name,omitempty"`
+	Release     string            `json:"release,omitempty"`
+	Environment string            `json:"environment,omitempty"`
+	Exception   *sentryExceptions `json:"exception,omitempty"`
+	Request     *sentryRequest    `json:"request,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+}
+
+type sentryExceptions struct {
+	Values []sentryException `json:"values"`
+}
+
+type sentryException struct {
+	Type       string            `json:"type"`
+	Value      string            `json:"value"`
+	Stacktrace *sentryStacktrace `json:"stacktrace,omitempty"`
+}
+
+type sentryStacktrace struct {
+	Frames []sentryFrame `json:"frames"` // outermost first
+}
+
+type sentryFrame struct {
+	Function string `json:"function"`
+	File     string `json:"abs_path"`
+	Line     int    `json:"lineno"`
+	InApp    bool   `json:"in_app"`
+}
+
+type sentryRequest struct {
+	URL         string            `json:"url"`
+	Method      string            `json:"method"`
+	QueryString string            `json:"query_string,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Env         map[string]string `json:"env,omitempty"`
+}
+
+// headers that aren't sent along with a request
+var sentryHiddenHeaders = map[string]bool{
+	"Authorization": true,
+	"Cookie":        true,
+	"X-Api-Key":     true,
+}
+
+func newSentryEvent(r *http.Request, level string, exception sentryException) sentryEvent {
+	id := make([]byte, 16)
+	rand.Read(id)
+	hostname, _ := os.Hostname()
+
+	headers := map[string]string{}
+	for name, values := range r.Header {
+		if !sentryHiddenHeaders[name] {
+			headers[name] = strings.Join(values, ", ")
+		}
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	return sentryEvent{
+		EventID:     hex.EncodeToString(id),
+		Timestamp:   time.Now().UTC(),
+		Level:       level,
+		Platform:    "go",
+		ServerName:  hostname,
+		Release:     version,
+		Environment: *sentryEnvironmentFlag,
+		Exception:   &sentryExceptions{Values: []sentryException{exception}},
+		Request: &sentryRequest{
+			URL:         scheme + "://" + r.Host + r.URL.Path,
+			Method:      r.Method,
+			QueryString: r.URL.RawQuery,
+			Headers:     headers,
+			Env:         map[string]string{"REMOTE_ADDR": clientIP(r)},
+		},
+		Tags: map[string]string{"request_id": requestID(r.Context())},
+	}
+}
+
+// Queues event to be sent, unless the queue's full.
+func (s *sentryStruct) report(event sentryEvent) {
+	select {
+	case s.queue <- event:
+	default:
+		slog.Warn("Sentry queue full, dropping event", "event_id", event.EventID)
+	}
+}
+
+func (s *sentryStruct) run() {
+	for event := range s.queue {
+		s.sending.Store(true)
+		err := s.send(event)
+		s.sending.Store(false)
+
+		if err != nil {
+			slog.Error("Error sending event to Sentry", "event_id", event.EventID, "err", err)
+		}
+	}
+}
+
+// Waits for what's queued to be sent, until ctx is done.
+func (s *sentryStruct) flush(ctx context.Context) {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for len(s.queue) > 0 || s.sending.Load() {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *sentryStruct) send(event sentryEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	// an envelope: its header, then the item's, then the item
+	var body bytes.Buffer
+	json.NewEncoder(&body).Encode(map[string]any{"event_id": event.EventID, "dsn": s.dsn, "sent_at": time.Now().UTC()})
+	json.NewEncoder(&body).Encode(map[string]any{"type": "event", "length": len(payload)})
+	body.Write(payload)
+	body.WriteByte('\n')
+
+	req, err := http.NewRequest(http.MethodPost, s.endpoint, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", s.auth)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+// The stack of the caller's caller, outermost first
+func sentryStack() *sentryStacktrace {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(3, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+
+	var stack []sentryFrame
+	for {
+		frame, more := frames.Next()
+		stack = append(stack, sentryFrame{
+			Function: frame.Function,
+			File:     frame.File,
+			Line:     frame.Line,
+			InApp:    strings.HasPrefix(frame.Function, "main."),
+		})
+		if !more {
+			break
+		}
+	}
+
+	for i, j := 0, len(stack)-1; i < j; i, j = i+1, j-1 {
+		stack[i], stack[j] = stack[j], stack[i]
+	}
+
+	return &sentryStacktrace{Frames: stack}
+}
+
+// Lets httpFail say what went wrong, for withSentry to report.
+type errorRecorder interface {
+	recordError(err error)
+}
+
+// Passes err to the errorRecorder w wraps, if there is one.
+func noteError(w http.ResponseWriter, err error) {
+	for {
+		if recorder, ok := w.(errorRecorder); ok {
+			recorder.recordError(err)
+			return
+		}
+
+		unwrapper, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return
+		}
+		w = unwrapper.Unwrap()
+	}
+}
+
+type sentryWriter struct {
+	*statusWriter
+	err error
+}
+
+func (w *sentryWriter) recordError(err error) {
+	w.err = err
+}
+
+func (w *sentryWriter) Unwrap() http.ResponseWriter {
+	return w.statusWriter
+}
+
+func withSentry(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sentry == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		sw := &sentryWriter{statusWriter: &statusWriter{ResponseWriter: w}}
+
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+
+			sentry.report(newSentryEvent(r, "fatal", sentryException{
+				Type:       "panic",
+				Value:      fmt.Sprint(v),
+				Stacktrace: sentryStack(),
+			}))
+			slog.ErrorContext(r.Context(), "Panic", "err", v)
+
+			if sw.status == 0 {
+				http.Error(sw, "Internal server error", http.StatusInternalServerError)
+			}
+		}()
+
+		next.ServeHTTP(sw, r)
+
+		status := sw.statusCode()
+		if status < 500 || status == http.StatusServiceUnavailable {
+			return
+		}
+
+		exception := sentryException{Type: "HTTP " + http.StatusText(status), Value: fmt.Sprintf("%d response", status)}
+		if sw.err != nil {
+			exception = sentryException{Type: fmt.Sprintf("%T", sw.err), Value: sw.err.Error()}
+		}
+		sentry.report(newSentryEvent(r, "error", exception))
+	})
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A session is a named scratchpad of variables for a calculator client.
+// Operands written as $name are looked up in the session, and every answer
+// computed within a session is stored in the "ans" variable. A session is
+// started by setting a variable or computing something in it, and belongs to
+// the client that started it (by its credentials, or else its address);
+// to anyone else, it isn't there.
+type session struct {
+	id    string
+	owner string // clientID of who started it
+	vars  map[string]float64
+	time  time.Time // last use; idle sessions are expired by the cleaner
+	mutex sync.Mutex
+}
+
+type sessionStruct struct {
+	hash  map[string]*session // keyed by session id
+	owned map[string]int      // how many sessions each owner has
+	mutex sync.Mutex
+}
+
+const sessionExpireSeconds = 30 * 60
+const sessionCleanupInterval = 60
+const sessionMaxVariables = 100
+const sessionMaxSessions = 10000
+const sessionMaxOwnerSessions = 100
+
+// the variable holding the last answer; clients cannot set it themselves
+const sessionAnsVariable = "ans"
+
+var sessions *sessionStruct
+
+var sessionIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+var variableNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,31}$`)
+
+func newSessionStore() *sessionStruct {
+	s := &sessionStruct{}
+	s.hash = map[string]*session{}
+	s.owned = map[string]int{}
+
+	go s.cleaner()
+
+	return s
+}
+
+var errSessionNotFound = errors.New("No such session")
+var errTooManySessions = fmt.Errorf("Too many sessions (max %d); try again later", sessionMaxSessions)
+var errTooManyOwnerSessions = fmt.Errorf("You have too many sessions (max %d); end some first", sessionMaxOwnerSessions)
+
+// get returns owner's session for id, starting it if it doesn't exist and
+// create is set
+func (s *sessionStruct) get(id string, owner string, create bool) (*session, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sess, exists := s.hash[id]
+	if exists && sess.owner != owner {
+		return nil, errSessionNotFound
+	}
+	if !exists {
+		if !create {
+			return nil, errSessionNotFound
+		}
+		if s.owned[owner] >= sessionMaxOwnerSessions {
+			return nil, errTooManyOwnerSessions
+		}
+		if len(s.hash) >= sessionMaxSessions {
+			return nil, errTooManySessions
+		}
+
+		sess = &session{id: id, owner: owner, vars: map[string]float64{}}
+		s.hash[id] = sess
+		s.owned[owner]++
+	}
+	sess.time = time.Now()
+
+	return sess, nil
+}
+
+func (s *sessionStruct) remove(id string, owner string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sess, exists := s.hash[id]
+	if !exists || sess.owner != owner {
+		return false
+	}
+	s.forget(sess)
+
+	return true
+}
+
+// Must hold the mutex.
+func (s *sessionStruct) forget(sess *session) {
+	delete(s.hash, sess.id)
+	s.owned[sess.owner]--
+	if s.owned[sess.owner] == 0 {
+		delete(s.owned, sess.owner)
+	}
+	history.remove("session:" + sess.id)
+}
+
+func (s *sessionStruct) cleanup() {
+	expireTime := time.Now().Add(time.Second * -sessionExpireSeconds)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for id, sess := range s.hash {
+		if sess.time.Before(expireTime) {
+			slog.Debug("Session expired", "session", id)
+			s.forget(sess)
+		}
+	}
+}
+
+// runs in a separate goroutine
+func (s *sessionStruct) cleaner() {
+	for {
+		time.Sleep(time.Second * sessionCleanupInterval)
+		s.cleanup()
+	}
+}
+
+func (sess *session) getVar(name string) (float64, bool) {
+	sess.mutex.Lock()
+	defer sess.mutex.Unlock()
+
+	val, exists := sess.vars[name]
+	return val, exists
+}
+
+func (sess *session) setVar(name string, value float64) error {
+	sess.mutex.Lock()
+	defer sess.mutex.Unlock()
+
+	_, exists := sess.vars[name]
+	if !exists && name != sessionAnsVariable && len(sess.vars) >= sessionMaxVariables {
+		return fmt.Errorf("Session has too many variables (max %d)", sessionMaxVariables)
+	}
+
+	sess.vars[name] = value
+	return nil
+}
+
+func (sess *session) variables() map[string]float64 {
+	sess.mutex.Lock()
+	defer sess.mutex.Unlock()
+
+	vars := make(map[string]float64, len(sess.vars))
+	for name, value := range sess.vars {
+		vars[name] = value
+	}
+
+	return vars
+}
+
+// JSON data for responding to session requests
+type sessionResponse struct {
+	ID        string             `json:"id"`
+	Variables map[string]float64 `json:"variables"`
+}
+
+// Handles everything under /session/:
+//
+//	/session/{id}           GET lists variables, DELETE ends the session
+//	/session/{id}/set       sets variable name to value
+//	/session/{id}/{OP}      same as /{OP}, but operands may be $variables
+func doSession(w http.ResponseWriter, r *http.Request) {
+	id, op, _ := strings.Cut(strings.TrimPrefix(r.URL.EscapedPath(), "/session/"), "/")
+
+	if !sessionIDPattern.MatchString(id) {
+		httpFail(w, errors.New("Invalid session id"))
+		return
+	}
+
+	owner := clientID(r, nil)
+
+	if op == "" {
+		switch r.Method {
+		case http.MethodDelete:
+			if !sessions.remove(id, owner) {
+				http.Error(w, errSessionNotFound.Error(), http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case http.MethodGet, http.MethodHead:
+		default:
+			w.Header().Set("Allow", "GET, HEAD, DELETE")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		sess, err := sessions.get(id, owner, false)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		data := sessionResponse{ID: id, Variables: sess.variables()}
+		writeData(w, r, http.StatusOK, data)
+		return
+	}
+
+	sess, err := sessions.get(id, owner, true)
+	switch err {
+	case nil:
+	case errTooManySessions:
+		w.Header().Set("Retry-After", strconv.Itoa(sessionCleanupInterval))
+		httpErrorCode(w, http.StatusServiceUnavailable, "too_many_sessions", err.Error())
+		return
+	case errTooManyOwnerSessions:
+		httpErrorCode(w, http.StatusTooManyRequests, "too_many_sessions", err.Error())
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if op == "set" {
+		setSessionVariable(w, r, sess)
+		return
+	}
+
+	answerMath(w, r, op, sess)
+}
+
+func setSessionVariable(w http.ResponseWriter, r *http.Request, sess *session) {
+	name := r.FormValue("name")
+	if !variableNamePattern.MatchString(name) {
+		httpFail(w, fmt.Errorf("Invalid variable name: %q", name))
+		return
+	}
+	if name == sessionAnsVariable {
+		httpFail(w, fmt.Errorf("%s is read-only", sessionAnsVariable))
+		return
+	}
+
+	value, err := getFormFloat(r, "value", sess)
+	if err != nil {
+		httpFail(w, err)
+		return
+	}
+
+	err = sess.setVar(name, value)
+	if err != nil {
+		httpFail(w, err)
+		return
+	}
+
+	writeData(w, r, http.StatusOK, map[string]float64{name: value})
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// For clients that can't do mutual TLS, -hmac-keys gives each a shared
+// secret to sign requests with instead. A signed request has:
+//
+//	X-Signature-Key: NAME
+//	X-Signature-Timestamp: UNIX_SECONDS
+//	X-Signature: hex(HMAC-SHA256(SECRET, METHOD\nPATH?QUERY\nTIMESTAMP\nhex(SHA-256(BODY))))
+//
+// The timestamp has to be within -hmac-skew of our clock, and a signature
+// is only good once, so one that's overheard can't be sent again. Like an
+// API key, a good signature authorizes computations, and the client is
+// known by the key's name.
+
+var hmacKeysFlag = flag.String("hmac-keys", "", "comma-separated NAME:SECRET pairs for signing requests (see X-Signature)")
+var hmacSkewFlag = flag.Duration("hmac-skew", 5*time.Minute, "how far a signed request's timestamp can be from our clock")
+
+const (
+	signatureKeyHeader       = "X-Signature-Key"
+	signatureTimestampHeader = "X-Signature-Timestamp"
+	signatureHeader          = "X-Signature"
+)
+
+type hmacKeysStruct struct {
+	secrets map[string][]byte // by name
+	skew    time.Duration
+	seen    map[string]time.Time // signatures used, until they'd be too old anyway
+	mutex   sync.Mutex
+}
+
+// nil when there are no keys
+var hmacKeys atomic.Pointer[hmacKeysStruct]
+
+// past this many, the ones too old to matter are forgotten
+const signaturesRemembered = 10000
+
+type signatureKeyKey struct{}
+type signatureErrorKey struct{}
+
+func init() {
+	registerReload(loadHMACKeys, "hmac-keys", "hmac-skew")
+}
+
+func loadHMACKeys() error {
+	if *hmacSkewFlag <= 0 {
+		return errors.New("-hmac-skew must be positive")
+	}
+	if *hmacKeysFlag == "" {
+		hmacKeys.Store(nil)
+		return nil
+	}
+
+	keys := &hmacKeysStruct{secrets: map[string][]byte{}, skew: *hmacSkewFlag, seen: map[string]time.Time{}}
+	for i, pair := range strings.Split(*hmacKeysFlag, ",") {
+		// the entries are secret, so errors only say which
+		name, secret, found := strings.Cut(strings.TrimSpace(pair), ":")
+		if !found || name == "" || secret == "" {
+			return fmt.Errorf("invalid -hmac-keys entry %d: expected NAME:SECRET", i+1)
+		}
+		keys.secrets[name] = []byte(secret)
+	}
+
+	if old := hmacKeys.Load(); old != nil {
+		old.mutex.Lock()
+		for signature, until := range old.seen {
+			keys.seen[signature] = until
+		}
+		old.mutex.Unlock()
+	}
+
+	hmacKeys.Store(keys)
+	return nil
+}
+
+// What's signed: the method, path and query, timestamp and body's hash
+func signedString(r *http.Request, timestamp string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	return r.Method + "\n" + r.URL.RequestURI() + "\n" + timestamp + "\n" + hex.EncodeToString(bodyHash[:])
+}
+
+// Checks a signed request, returning the key's name. The body's read, and
+// put back for what comes after.
+func (k *hmacKeysStruct) verify(r *http.Request) (string, error) {
+	name := r.Header.Get(signatureKeyHeader)
+	secret, exists := k.secrets[name]
+	if !exists {
+		return "", fmt.Errorf("unknown key %q", name)
+	}
+
+	timestamp := r.Header.Get(signatureTimestampHeader)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", errors.New("timestamp isn't a number of seconds")
+	}
+	now := time.Now()
+	signed := time.Unix(seconds, 0)
+	if signed.Before(now.Add(-k.skew)) || signed.After(now.Add(k.skew)) {
+		return "", fmt.Errorf("timestamp is more than %v from our clock", k.skew)
+	}
+
+	signature, err := hex.DecodeString(r.Header.Get(signatureHeader))
+	if err != nil {
+		return "", errors.New("signature isn't hex")
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, *maxBatchBodyBytesFlag+1))
+	r.Body.Close()
+	if err != nil {
+		return "", fmt.Errorf("can't read the body: %v", err)
+	}
+	if int64(len(body)) > *maxBatchBodyBytesFlag {
+		return "", errors.New("body is too large to sign")
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signedString(r, timestamp, body)))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return "", errors.New("signature doesn't match")
+	}
+
+	if !k.firstUse(string(signature), signed.Add(k.skew), now) {
+		return "", errors.New("signature was already used")
+	}
+
+	return name, nil
+}
+
+// Remembers a signature until it'd be too old anyway, returning whether
+// it's new.
+func (k *hmacKeysStruct) firstUse(signature string, until time.Time, now time.Time) bool {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if _, used := k.seen[signature]; used {
+		return false
+	}
+
+	if len(k.seen) >= signaturesRemembered {
+		for old, oldUntil := range k.seen {
+			if oldUntil.Before(now) {
+				delete(k.seen, old)
+			}
+		}
+	}
+	k.seen[signature] = until
+
+	return true
+}
+
+// The name of the key the request was signed with, if it was signed well
+func signatureKeyName(ctx context.Context) (string, bool) {
+	name, ok := ctx.Value(signatureKeyKey{}).(string)
+	return name, ok
+}
+
+// withSignature checks the request's signature, when we take them and it
+// has one, and puts the key's name in the context for what comes after (or
+// what was wrong with it, for requireAuth to say). Like withAPIKey, it
+// doesn't turn anyone away.
+func withSignature(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys := hmacKeys.Load()
+		if keys == nil || r.Header.Get(signatureHeader) == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		name, err := keys.verify(r)
+		if err != nil {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), signatureErrorKey{}, err)))
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), signatureKeyKey{}, name)))
+	})
+}
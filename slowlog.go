@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Requests that take longer than -slow-request are logged at warn level,
+// with what was asked (the start of the body too) and where the time went:
+// parsing the question, looking in the cache, working it out (or asking a
+// peer), and encoding the response. Handlers note those with addTiming; a
+// batch adds up each item's.
+
+var slowRequestFlag = flag.Duration("slow-request", 0, "log requests taking longer than this at warn level, with a timing breakdown (off if 0)")
+
+// how much of a slow request's body is logged
+const slowRequestBodyBytes = 1024
+
+var slowRequestThreshold atomic.Int64
+
+func init() {
+	registerReload(func() error {
+		slowRequestThreshold.Store(int64(*slowRequestFlag))
+		return nil
+	}, "slow-request")
+}
+
+// the phases a request's time is broken down into
+const (
+	timingParse   = "parse"
+	timingCache   = "cache_lookup"
+	timingCompute = "compute"
+	timingEncode  = "encode"
+)
+
+var timingPhases = []string{timingParse, timingCache, timingCompute, timingEncode}
+
+type requestTimings struct {
+	phases map[string]time.Duration
+	mutex  sync.Mutex
+}
+
+type requestTimingsKey struct{}
+
+// Adds d to the request's time in phase. Does nothing outside of a request.
+func addTiming(ctx context.Context, phase string, d time.Duration) {
+	timings, ok := ctx.Value(requestTimingsKey{}).(*requestTimings)
+	if !ok {
+		return
+	}
+
+	timings.mutex.Lock()
+	defer timings.mutex.Unlock()
+	timings.phases[phase] += d
+}
+
+// keeps the start of a body as it's read
+type bodyRecorder struct {
+	io.ReadCloser
+	start bytes.Buffer
+}
+
+func (b *bodyRecorder) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if room := slowRequestBodyBytes - b.start.Len(); room > 0 {
+		b.start.Write(p[:min(n, room)])
+	}
+	return n, err
+}
+
+func withSlowLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		threshold := time.Duration(slowRequestThreshold.Load())
+		if threshold <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		timings := &requestTimings{phases: map[string]time.Duration{}}
+		body := &bodyRecorder{ReadCloser: r.Body}
+		r.Body = body
+		sw := &statusWriter{ResponseWriter: w}
+
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), requestTimingsKey{}, timings)))
+
+		took := time.Since(start)
+		if took < threshold {
+			return
+		}
+
+		args := []any{
+			"method", r.Method,
+			"path", r.URL.EscapedPath(),
+			"query", r.URL.RawQuery,
+			"status", sw.statusCode(),
+			"client", clientIP(r),
+			"duration", took,
+		}
+		if body.start.Len() > 0 {
+			args = append(args, "body", body.start.String())
+		}
+
+		timings.mutex.Lock()
+		for _, phase := range timingPhases {
+			args = append(args, phase, timings.phases[phase])
+		}
+		timings.mutex.Unlock()
+
+		slog.WarnContext(r.Context(), "Slow request", args...)
+	})
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// For those without Prometheus, -statsd-addr sends the same metrics to
+// StatsD (or the Datadog agent) over UDP. What's counted or timed in a
+// metricVec is sent as it happens, with its labels as DogStatsD tags
+// (-statsd-tags adds more); durations in seconds become timers in
+// milliseconds. The totals and gauges in /metrics are sent every
+// -statsd-interval, the totals as how much they've gone up by. Names lose
+// their http_math_ and get -statsd-prefix instead.
+
+var statsdAddrFlag = flag.String("statsd-addr", "", "StatsD (or DogStatsD) server to send metrics to over UDP, as HOST:PORT (off if empty)")
+var statsdPrefixFlag = flag.String("statsd-prefix", "http_math.", "what StatsD metric names start with")
+var statsdTagsFlag = flag.String("statsd-tags", "", "comma-separated NAME:VALUE tags to add to every StatsD metric, e.g. env:prod,region:us")
+var statsdIntervalFlag = flag.Duration("statsd-interval", 10*time.Second, "how often to send totals and gauges (and anything buffered) to StatsD")
+
+// metrics are sent a packet's worth at a time; this fits in an ethernet frame
+const statsdMaxPacket = 1432
+
+type statsdStruct struct {
+	conn   net.Conn
+	prefix string
+	tags   []string
+	buf    bytes.Buffer
+	last   map[string]float64 // totals as last sent, to send the difference
+	mutex  sync.Mutex
+}
+
+// nil when StatsD is off
+var statsd *statsdStruct
+
+// Reads the -statsd flags and starts sending metrics.
+func startStatsd() error {
+	if *statsdAddrFlag == "" {
+		return nil
+	}
+	if *statsdIntervalFlag <= 0 {
+		return fmt.Errorf("invalid -statsd-interval %v", *statsdIntervalFlag)
+	}
+
+	var tags []string
+	for _, tag := range strings.Split(*statsdTagsFlag, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag != "" {
+			tags = append(tags, statsdEscaper.Replace(tag))
+		}
+	}
+
+	conn, err := net.Dial("udp", *statsdAddrFlag)
+	if err != nil {
+		return fmt.Errorf("invalid -statsd-addr: %v", err)
+	}
+
+	statsd = &statsdStruct{
+		conn:   conn,
+		prefix: *statsdPrefixFlag,
+		tags:   tags,
+		last:   map[string]float64{},
+	}
+
+	go statsd.run(*statsdIntervalFlag)
+	onShutdown(func(ctx context.Context) {
+		statsd.collect()
+		statsd.flush()
+	})
+
+	return nil
+}
+
+// what can't go in a name or tag
+var statsdEscaper = strings.NewReplacer("|", "_", "@", "_", "#", "_", ",", "_", "\n", "_")
+
+// Buffers a metric, sending what's buffered first if it won't fit.
+func (s *statsdStruct) send(name string, value string, kind string, tags []string) {
+	var line strings.Builder
+	line.WriteString(s.prefix)
+	line.WriteString(strings.TrimPrefix(name, "http_math_"))
+	line.WriteString(":" + value + "|" + kind)
+
+	if len(s.tags)+len(tags) > 0 {
+		line.WriteString("|#" + strings.Join(append(tags[:len(tags):len(tags)], s.tags...), ","))
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.buf.Len() > 0 && s.buf.Len()+1+line.Len() > statsdMaxPacket {
+		s.write()
+	}
+	if s.buf.Len() > 0 {
+		s.buf.WriteByte('\n')
+	}
+	s.buf.WriteString(line.String())
+}
+
+// Sends what's buffered; must hold the mutex.
+func (s *statsdStruct) write() {
+	if s.buf.Len() == 0 {
+		return
+	}
+
+	_, err := s.conn.Write(s.buf.Bytes())
+	if err != nil {
+		slog.Debug("Error sending metrics to StatsD", "err", err)
+	}
+	s.buf.Reset()
+}
+
+func (s *statsdStruct) flush() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.write()
+}
+
+func (s *statsdStruct) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.collect()
+		s.flush()
+	}
+}
+
+// Sends what the registerMetrics collectors say.
+func (s *statsdStruct) collect() {
+	metricsMutex.Lock()
+	collectors := metricsCollectors
+	metricsMutex.Unlock()
+
+	for _, collect := range collectors {
+		for _, m := range collect() {
+			if m.kind == "gauge" {
+				s.send(m.name, formatMetric(m.value), "g", nil)
+				continue
+			}
+
+			s.mutex.Lock()
+			delta := m.value - s.last[m.name]
+			if delta < 0 {
+				// it was reset
+				delta = m.value
+			}
+			s.last[m.name] = m.value
+			s.mutex.Unlock()
+
+			if delta > 0 {
+				s.send(m.name, formatMetric(delta), "c", nil)
+			}
+		}
+	}
+}
+
+// Sends something added to or observed by vec.
+func (s *statsdStruct) vecEvent(vec *metricVec, value float64, labelValues []string) {
+	tags := make([]string, len(vec.labels))
+	for i, label := range vec.labels {
+		tags[i] = label + ":" + statsdEscaper.Replace(labelValues[i])
+	}
+
+	switch vec.kind {
+	case "counter":
+		s.send(vec.name, formatMetric(value), "c", tags)
+	case "gauge":
+		// with a sign, it's a change to the gauge
+		sign := "+"
+		if value < 0 {
+			sign = ""
+		}
+		s.send(vec.name, sign+formatMetric(value), "g", tags)
+	case "histogram":
+		if name, found := strings.CutSuffix(vec.name, "_seconds"); found {
+			s.send(name+"_ms", formatMetric(math.Round(value*1e6)/1e3), "ms", tags)
+		} else {
+			s.send(vec.name, formatMetric(value), "h", tags)
+		}
+	}
+}
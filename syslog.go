@@ -0,0 +1,107 @@
+//go:build unix
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"log/syslog"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Logging to syslog or the systemd journal, for -log-output.
+
+// where journald takes native protocol messages
+const journalSocket = "/run/systemd/journal/socket"
+
+func init() {
+	openSystemLog = openUnixLog
+}
+
+func openUnixLog(output string) (func(level slog.Level, line []byte) error, error) {
+	if output == "journald" {
+		return openJournal()
+	}
+	return openSyslog()
+}
+
+// debug, info, warning and error, as syslog (and the journal) has them
+func syslogPriority(level slog.Level) syslog.Priority {
+	switch {
+	case level >= slog.LevelError:
+		return syslog.LOG_ERR
+	case level >= slog.LevelWarn:
+		return syslog.LOG_WARNING
+	case level >= slog.LevelInfo:
+		return syslog.LOG_INFO
+	default:
+		return syslog.LOG_DEBUG
+	}
+}
+
+func openSyslog() (func(level slog.Level, line []byte) error, error) {
+	var network, addr string
+	if *syslogAddrFlag != "" {
+		var ok bool
+		network, addr, ok = strings.Cut(*syslogAddrFlag, "://")
+		if !ok || (network != "udp" && network != "tcp") {
+			return nil, fmt.Errorf("invalid -syslog-addr %q: expected udp://HOST:PORT or tcp://HOST:PORT", *syslogAddrFlag)
+		}
+	}
+
+	writer, err := syslog.Dial(network, addr, syslog.LOG_DAEMON|syslog.LOG_INFO, *syslogTagFlag)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(level slog.Level, line []byte) error {
+		switch syslogPriority(level) {
+		case syslog.LOG_ERR:
+			return writer.Err(string(line))
+		case syslog.LOG_WARNING:
+			return writer.Warning(string(line))
+		case syslog.LOG_INFO:
+			return writer.Info(string(line))
+		default:
+			return writer.Debug(string(line))
+		}
+	}, nil
+}
+
+func openJournal() (func(level slog.Level, line []byte) error, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+
+	return func(level slog.Level, line []byte) error {
+		var message bytes.Buffer
+		journalField(&message, "PRIORITY", []byte(strconv.Itoa(int(syslogPriority(level)))))
+		journalField(&message, "SYSLOG_IDENTIFIER", []byte(*syslogTagFlag))
+		journalField(&message, "MESSAGE", line)
+
+		_, err := conn.Write(message.Bytes())
+		return err
+	}, nil
+}
+
+// Adds a field to a journal message in the native protocol. Values with
+// newlines in them have their length given instead of ending at one.
+func journalField(message *bytes.Buffer, name string, value []byte) {
+	message.WriteString(name)
+
+	if bytes.IndexByte(value, '\n') < 0 {
+		message.WriteByte('=')
+		message.Write(value)
+	} else {
+		message.WriteByte('\n')
+		message.Write(binary.LittleEndian.AppendUint64(nil, uint64(len(value))))
+		message.Write(value)
+	}
+
+	message.WriteByte('\n')
+}
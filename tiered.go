@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+)
+
+// -cache-backend=tiered puts a small memory cache in front of a shared one
+// (Redis, by default), so each replica answers its hottest questions without
+// a network round trip but they still share everything else. Writes go
+// through to both. Local copies expire after -cache-local-ttl from when they
+// were fetched, however they're used, so an answer purged from the shared
+// tier doesn't linger here for long.
+
+var cacheTierRemoteFlag = flag.String("cache-tier-remote", "redis", "shared cache behind the local one for -cache-backend=tiered")
+var cacheLocalTTLFlag = flag.Duration("cache-local-ttl", 5*time.Second, "how long the local tier of -cache-backend=tiered keeps answers")
+var cacheLocalMaxEntriesFlag = flag.Int("cache-local-max-entries", 10000, "most answers to keep in the local tier of -cache-backend=tiered")
+
+func init() {
+	cacheBackends["tiered"] = newTieredCache
+}
+
+type tieredCache struct {
+	local  *cacheStruct
+	remote Cache
+}
+
+func newTieredCache(opts cacheOptions) (Cache, error) {
+	if *cacheTierRemoteFlag == "tiered" || *cacheTierRemoteFlag == "memory" {
+		return nil, fmt.Errorf("-cache-tier-remote can't be %s", *cacheTierRemoteFlag)
+	}
+	if *cacheLocalTTLFlag <= 0 {
+		return nil, errors.New("-cache-local-ttl must be positive")
+	}
+
+	remote, err := newCacheBackend(*cacheTierRemoteFlag, opts)
+	if err != nil {
+		return nil, fmt.Errorf("-cache-tier-remote: %v", err)
+	}
+
+	localOpts := opts
+	localOpts.ttl = *cacheLocalTTLFlag
+	localOpts.opTTL = nil
+	localOpts.opStale = nil
+	localOpts.sliding = false
+	localOpts.opSliding = nil
+	localOpts.maxEntries = *cacheLocalMaxEntriesFlag
+	if localOpts.negativeTTL > localOpts.ttl {
+		localOpts.negativeTTL = localOpts.ttl
+	}
+
+	return &tieredCache{local: newCache(localOpts), remote: remote}, nil
+}
+
+func (c *tieredCache) Get(ctx context.Context, key string) (cachedAnswer, bool) {
+	value, exists := c.local.Get(ctx, key)
+	if exists {
+		return value, true
+	}
+
+	value, exists = c.remote.Get(ctx, key)
+	if exists && !value.stale {
+		c.local.Set(ctx, key, value)
+	}
+
+	return value, exists
+}
+
+func (c *tieredCache) Set(ctx context.Context, key string, value cachedAnswer) {
+	c.remote.Set(ctx, key, value)
+	c.local.Set(ctx, key, value)
+}
+
+func (c *tieredCache) Delete(key string) {
+	c.remote.Delete(key)
+	c.local.Delete(key)
+}
+
+func (c *tieredCache) ping() error {
+	pinger, ok := c.remote.(cachePinger)
+	if !ok {
+		return nil
+	}
+
+	return pinger.ping()
+}
+
+func (c *tieredCache) Purge() error {
+	c.local.Purge()
+	return c.remote.Purge()
+}
+
+// The shared tier's stats, with the local tier's hits added in; a local miss
+// just means asking the shared tier, so it isn't counted twice.
+func (c *tieredCache) Stats() CacheStats {
+	stats := c.remote.Stats()
+	local := c.local.Stats()
+
+	stats.Hits += local.Hits
+	stats.StaleHits += local.StaleHits
+
+	return stats
+}
+
+func (c *tieredCache) Close() error {
+	c.local.Close()
+	return c.remote.Close()
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// With -tls-cert and -tls-key, the TCP listeners serve HTTPS instead of
+// plain HTTP. Unix sockets stay plain; whatever's on the other end is local.
+// The certificate and key are read again on reload (see reload.go), so a
+// renewed certificate can be picked up without a restart.
+//
+// With -tls-client-ca too, clients have to present a certificate signed by
+// one of those CAs (mutual TLS). Its subject identifies the client; see
+// clientCertSubject.
+
+var tlsCertFlag = flag.String("tls-cert", "", "TLS certificate file, with any intermediates, to serve HTTPS with (plain HTTP if empty)")
+var tlsKeyFlag = flag.String("tls-key", "", "TLS private key file for -tls-cert")
+var tlsMinVersionFlag = flag.String("tls-min-version", "1.2", "oldest TLS version to accept: 1.0, 1.1, 1.2 or 1.3")
+var tlsCiphersFlag = flag.String("tls-ciphers", "", "comma-separated cipher suites to allow up to TLS 1.2, by Go name, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 (Go's defaults if empty; TLS 1.3's can't be changed)")
+
+var tlsClientCAFlag = flag.String("tls-client-ca", "", "PEM file of CA certificates that client certificates must be signed by (client certificates aren't asked for if empty)")
+var tlsClientAuthFlag = flag.String("tls-client-auth", "require", "with -tls-client-ca: require a client certificate, or make it optional (but still verified if one is given)")
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// the certificate being served, swapped on reload
+var tlsCert atomic.Pointer[tls.Certificate]
+
+func init() {
+	registerReload(reloadTLSCert, "tls-cert", "tls-key")
+}
+
+// set by acme.go when built with -tags acme; returns the TLS config for
+// certificates from an ACME CA, or nil if it's not configured
+var acmeTLSConfig func() (*tls.Config, error)
+
+// The TLS config for the TCP listeners, or nil without -tls-cert (or ACME).
+func tlsConfigFromFlags() (*tls.Config, error) {
+	var config *tls.Config
+	var err error
+
+	if acmeTLSConfig != nil {
+		config, err = acmeTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config != nil {
+		if *tlsCertFlag != "" || *tlsKeyFlag != "" {
+			return nil, errors.New("-tls-cert and ACME can't be used together")
+		}
+	} else if *tlsCertFlag == "" && *tlsKeyFlag == "" {
+		return nil, nil
+	} else {
+		err = loadTLSCert()
+		if err != nil {
+			return nil, err
+		}
+
+		config = &tls.Config{
+			GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return tlsCert.Load(), nil
+			},
+		}
+	}
+
+	// ahead of any the ACME config brought
+	protos := []string{"http/1.1"}
+	if *http2Flag {
+		protos = []string{"h2", "http/1.1"}
+	}
+	config.NextProtos = append(protos, config.NextProtos...)
+
+	var exists bool
+	config.MinVersion, exists = tlsVersions[*tlsMinVersionFlag]
+	if !exists {
+		return nil, fmt.Errorf("invalid -tls-min-version %q: expected 1.0, 1.1, 1.2 or 1.3", *tlsMinVersionFlag)
+	}
+
+	config.CipherSuites, err = parseCipherSuites(*tlsCiphersFlag)
+	if err != nil {
+		return nil, err
+	}
+
+	if *tlsClientCAFlag != "" {
+		config.ClientCAs, err = loadCertPool(*tlsClientCAFlag)
+		if err != nil {
+			return nil, err
+		}
+
+		switch *tlsClientAuthFlag {
+		case "require":
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		case "optional":
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+		default:
+			return nil, fmt.Errorf("invalid -tls-client-auth %q: expected require or optional", *tlsClientAuthFlag)
+		}
+	}
+
+	return config, nil
+}
+
+func loadTLSCert() error {
+	if *tlsCertFlag == "" || *tlsKeyFlag == "" {
+		return errors.New("-tls-cert and -tls-key have to be given together")
+	}
+
+	cert, err := tls.LoadX509KeyPair(*tlsCertFlag, *tlsKeyFlag)
+	if err != nil {
+		return err
+	}
+
+	tlsCert.Store(&cert)
+	return nil
+}
+
+// Picks up a renewed certificate. TLS can't be turned on or off without a
+// restart, though.
+func reloadTLSCert() error {
+	if tlsCert.Load() == nil {
+		return nil
+	}
+
+	return loadTLSCert()
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no PEM certificates found", path)
+	}
+
+	return pool, nil
+}
+
+// The subject of the client's verified certificate, like "CN=alice,O=Example",
+// or "" if it didn't present one.
+func clientCertSubject(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+
+	return r.TLS.VerifiedChains[0][0].Subject.String()
+}
+
+// Only the suites Go considers secure can be picked.
+func parseCipherSuites(list string) ([]uint16, error) {
+	if list == "" {
+		return nil, nil
+	}
+
+	byName := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		byName[suite.Name] = suite.ID
+	}
+
+	var ids []uint16
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		id, exists := byName[name]
+		if !exists {
+			return nil, fmt.Errorf("unknown or insecure -tls-ciphers suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+// Spans for distributed tracing: one per request, with getAnswer, the cache
+// and the peers under it. They're only recorded when built with -tags otel
+// (see otel.go); otherwise startSpan hands out spans that do nothing.
+
+// set by otel.go; sets up tracing if it's configured, returning handler
+// wrapped to start a span for each request
+var startTracing func(handler http.Handler) http.Handler
+
+// set by startTracing once there's somewhere to send spans
+var spanStarter func(ctx context.Context, name string, attrs []spanAttr) (context.Context, span)
+var traceInjector func(ctx context.Context, header http.Header)
+
+type spanAttr struct {
+	key   string
+	value any
+}
+
+type span interface {
+	setAttr(key string, value any)
+	end(err error) // err is recorded on the span, if not nil
+}
+
+type noSpan struct{}
+
+func (noSpan) setAttr(string, any) {}
+func (noSpan) end(error)           {}
+
+// Starts a span under whichever is in ctx; end it when done.
+func startSpan(ctx context.Context, name string, attrs ...spanAttr) (context.Context, span) {
+	if spanStarter == nil {
+		return ctx, noSpan{}
+	}
+
+	return spanStarter(ctx, name, attrs)
+}
+
+// Adds ctx's trace to header, so a request we make shows up in it.
+func injectTrace(ctx context.Context, header http.Header) {
+	if traceInjector != nil {
+		traceInjector(ctx, header)
+	}
+}
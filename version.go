@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// GET /version says what's deployed. The version and build date are set
+// when building a release:
+//
+//	go build -ldflags "-X main.version=1.2.3 -X main.buildDate=$(date -u +%FT%TZ)"
+//
+// The commit comes from the VCS info Go stamps into builds from a checkout.
+
+var version = "dev"
+var buildDate = ""
+
+var versionFlag = flag.Bool("version", false, "print the version and exit")
+
+// JSON data for /version
+type versionResponse struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	Modified  bool   `json:"modified,omitempty"` // built with uncommitted changes
+	BuildDate string `json:"build_date,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+func buildInfo() versionResponse {
+	data := versionResponse{
+		Version:   version,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+	}
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return data
+	}
+
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			data.Commit = setting.Value
+		case "vcs.modified":
+			data.Modified = setting.Value == "true"
+		case "vcs.time":
+			// the commit's time is better than nothing
+			if data.BuildDate == "" {
+				data.BuildDate = setting.Value
+			}
+		}
+	}
+
+	return data
+}
+
+func (v versionResponse) String() string {
+	s := fmt.Sprintf("http-math %s", v.Version)
+	if v.Commit != "" {
+		s += " (" + v.Commit
+		if v.Modified {
+			s += ", modified"
+		}
+		s += ")"
+	}
+	if v.BuildDate != "" {
+		s += " built " + v.BuildDate
+	}
+
+	return s + " with " + v.GoVersion
+}
+
+func doVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Usage: curl http://localhost:8080/version", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeData(w, r, http.StatusOK, buildInfo())
+}
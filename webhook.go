@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Callback URLs come from clients, so they're only ever posted to on the
+// public internet: not to us, the metadata service, or anything else on a
+// private network, whatever the name resolves to when we dial it. Redirects
+// aren't followed either. -webhook-allow-private lifts that, for trying it
+// out locally. On shutdown, deliveries still going get what's left of
+// -shutdown-timeout once the jobs are done.
+
+var webhookAllowPrivateFlag = flag.Bool("webhook-allow-private", false, "let job callbacks go to loopback, link-local and private addresses")
+
+const webhookMaxAttempts = 6
+const webhookInitialBackoff = time.Second
+const webhookMaxBackoff = time.Minute
+const webhookTimeout = 10 * time.Second
+
+// Ranges that aren't public but that net.IP doesn't have a method for:
+// "this network", and the shared address space carriers use for NAT.
+var webhookBlockedNets = []*net.IPNet{
+	mustParseCIDR("0.0.0.0/8"),
+	mustParseCIDR("100.64.0.0/10"),
+}
+
+// deliveries in flight, for waitWebhooks
+var webhooksInFlight sync.WaitGroup
+
+var webhookClient = &http.Client{
+	Timeout: webhookTimeout,
+	Transport: &http.Transport{
+		// no proxy from the environment, which would dial for us
+		DialContext:         (&net.Dialer{Timeout: webhookTimeout, Control: checkWebhookDial}).DialContext,
+		TLSHandshakeTimeout: webhookTimeout,
+		IdleConnTimeout:     time.Minute,
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return errors.New("callback redirected")
+	},
+}
+
+// Whether callbacks may go to ip
+func webhookAllowedIP(ip net.IP) bool {
+	if *webhookAllowPrivateFlag {
+		return true
+	}
+
+	// IsPrivate covers fc00::/7 as well
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	for _, blocked := range webhookBlockedNets {
+		if blocked.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+
+	return ipNet
+}
+
+// Checks the address a callback is about to be dialed at, once the name's
+// been resolved.
+func checkWebhookDial(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !webhookAllowedIP(ip) {
+		return fmt.Errorf("callback address %s isn't public", host)
+	}
+
+	return nil
+}
+
+func validateCallbackURL(callbackURL string) error {
+	u, err := url.Parse(callbackURL)
+	if err != nil {
+		return fmt.Errorf("Invalid callback_url: %v", err)
+	}
+
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("Invalid callback_url: must be an absolute http or https URL")
+	}
+
+	// names are checked when they're dialed, as they can change
+	if ip := net.ParseIP(u.Hostname()); ip != nil && !webhookAllowedIP(ip) {
+		return errors.New("Invalid callback_url: must be on a public address")
+	}
+	if u.Hostname() == "localhost" && !*webhookAllowPrivateFlag {
+		return errors.New("Invalid callback_url: must be on a public address")
+	}
+
+	return nil
+}
+
+// Posts a finished job to its callback URL in the background.
+func startWebhook(callbackURL string, data jobResponse) {
+	webhooksInFlight.Add(1)
+	go func() {
+		defer webhooksInFlight.Done()
+		deliverWebhook(callbackURL, data)
+	}()
+}
+
+// Waits for the deliveries in flight to finish, or ctx to be done.
+func waitWebhooks(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		webhooksInFlight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		slog.Warn("Webhooks still being delivered, giving up on them")
+	}
+}
+
+// Posts a finished job to its callback URL. Failed deliveries are retried
+// with exponential backoff until webhookMaxAttempts is reached.
+func deliverWebhook(callbackURL string, data jobResponse) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		slog.Error("Webhook failed", "job", data.ID, "err", err)
+		return
+	}
+
+	backoff := webhookInitialBackoff
+
+	for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+		err = postWebhook(callbackURL, data.ID, payload)
+		if err == nil {
+			slog.Info("Webhook delivered", "job", data.ID)
+			return
+		}
+
+		slog.Warn("Webhook attempt failed", "job", data.ID, "attempt", attempt, "of", webhookMaxAttempts, "err", err)
+
+		if attempt < webhookMaxAttempts {
+			time.Sleep(backoff)
+
+			backoff *= 2
+			if backoff > webhookMaxBackoff {
+				backoff = webhookMaxBackoff
+			}
+		}
+	}
+
+	slog.Error("Webhook failed, giving up", "job", data.ID)
+}
+
+func postWebhook(callbackURL string, jobID string, payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, callbackURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Job-ID", jobID)
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("callback responded %s", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+// There's no YAML encoder in the standard library, and our responses are
+// simple, so this works from orderedNode: anything encoding/json can marshal
+// (tags, omitempty, embedding and all) comes out as the equivalent
+// block-style YAML, with object keys kept in their JSON order.
+func marshalYAML(v interface{}) ([]byte, error) {
+	node, err := orderedNode(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	writeYAMLNode(&buf, node, 0, false)
+
+	return buf.Bytes(), nil
+}
+
+// Writes node at indent. A map inside a list starts on the list item's "- "
+// line, so its first key must not be indented again: that's inlineFirst.
+func writeYAMLNode(buf *bytes.Buffer, node interface{}, indent int, inlineFirst bool) {
+	pad := strings.Repeat(" ", indent)
+
+	switch n := node.(type) {
+	case orderedMap:
+		if len(n) == 0 {
+			buf.WriteString(pad + "{}\n")
+			return
+		}
+
+		for i, pair := range n {
+			if i > 0 || !inlineFirst {
+				buf.WriteString(pad)
+			}
+			buf.WriteString(yamlString(pair.key) + ":")
+			writeYAMLChild(buf, pair.value, indent)
+		}
+	case []interface{}:
+		if len(n) == 0 {
+			buf.WriteString(pad + "[]\n")
+			return
+		}
+
+		for i, item := range n {
+			if i > 0 || !inlineFirst {
+				buf.WriteString(pad)
+			}
+			buf.WriteString("-")
+
+			if m, isMap := item.(orderedMap); isMap && len(m) > 0 {
+				buf.WriteString(" ")
+				writeYAMLNode(buf, m, indent+2, true)
+			} else {
+				writeYAMLChild(buf, item, indent)
+			}
+		}
+	default:
+		buf.WriteString(pad + yamlScalar(n) + "\n")
+	}
+}
+
+// writes the value following a "key:" or "-"
+func writeYAMLChild(buf *bytes.Buffer, value interface{}, indent int) {
+	switch v := value.(type) {
+	case orderedMap:
+		if len(v) > 0 {
+			buf.WriteString("\n")
+			writeYAMLNode(buf, v, indent+2, false)
+			return
+		}
+		buf.WriteString(" {}\n")
+	case []interface{}:
+		if len(v) > 0 {
+			buf.WriteString("\n")
+			writeYAMLNode(buf, v, indent+2, false)
+			return
+		}
+		buf.WriteString(" []\n")
+	default:
+		buf.WriteString(" " + yamlScalar(v) + "\n")
+	}
+}
+
+func yamlScalar(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		if v {
+			return "true"
+		}
+		return "false"
+	case json.Number:
+		return v.String()
+	case string:
+		return yamlString(v)
+	}
+
+	return "null"
+}
+
+// strings that are safe to leave unquoted: no indicators, no leading or
+// trailing space, and nothing a YAML parser would read as another type
+var yamlPlainString = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_./ -]*[A-Za-z0-9_./-]$|^[A-Za-z_]$`)
+var yamlReservedWords = map[string]bool{
+	"true": true, "false": true, "yes": true, "no": true, "on": true, "off": true,
+	"y": true, "n": true, "null": true,
+}
+
+func yamlString(s string) string {
+	if yamlPlainString.MatchString(s) && !yamlReservedWords[strings.ToLower(s)] {
+		return s
+	}
+
+	// a JSON string is also a valid YAML double-quoted string
+	quoted, _ := marshalJSON(s)
+	return string(quoted)
+}